@@ -0,0 +1,143 @@
+package accesslog
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// albTimeFormat is the Go time layout of the times of the ALB access logs, in UTC
+const albTimeFormat = "2006-01-02T15:04:05.000000Z"
+
+// albCiphers maps the TLS 1.2 cipher suites to the OpenSSL names logged by ALB,
+// the TLS 1.3 suites are logged with their IANA names
+var albCiphers = map[uint16]string{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256:       "ECDHE-ECDSA-AES128-GCM-SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:         "ECDHE-RSA-AES128-GCM-SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384:       "ECDHE-ECDSA-AES256-GCM-SHA384",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:         "ECDHE-RSA-AES256-GCM-SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256: "ECDHE-ECDSA-CHACHA20-POLY1305",
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256:   "ECDHE-RSA-CHACHA20-POLY1305",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256:       "ECDHE-ECDSA-AES128-SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256:         "ECDHE-RSA-AES128-SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:          "ECDHE-ECDSA-AES128-SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:            "ECDHE-RSA-AES128-SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:          "ECDHE-ECDSA-AES256-SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:            "ECDHE-RSA-AES256-SHA",
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:               "AES128-GCM-SHA256",
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384:               "AES256-GCM-SHA384",
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA256:               "AES128-SHA256",
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA:                  "AES128-SHA",
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA:                  "AES256-SHA",
+}
+
+// ALBLogFormat will log HTTP requests as the entries of the AWS Application Load Balancer
+// access logs, so that the queries written for them, e.g. with Athena, can read the lines.
+// The server plays the part of both the load balancer and the target: the elb field is
+// the server name (see WithServerName), the target is the local address and the target processing
+// time is the time taken by the handler. The load balancer processing times are -1 and the fields
+// about target groups, rules and certificates are "-", as they do not apply.
+// The request and user agent are escaped as nginx does, unless WithReplacement is set.
+func ALBLogFormat(opts ...optFunc) func(http.Handler) http.Handler {
+	options := buildOpt(append([]optFunc{withNginxEscaping()}, opts...)...)
+	return middleware(options, func(w *responseWriter, r *http.Request) string {
+		ln := newLine(options, w, r)
+		defer ln.release()
+		return albLine(options, ln)
+	})
+}
+
+// albLine renders the fields of the ALB access log entry of ln
+func albLine(o *opt, ln *line) string {
+	r := ln.request
+	target := "-"
+	if ip, port := ln.localIP(), ln.port("local"); ip != "-" && port != "-" {
+		target = ip + ":" + port
+	}
+	status := ln.finalStatus()
+	cipher, protocol, sni := "-", "-", "-"
+	if r.TLS != nil {
+		cipher, protocol, sni = albCipher(r.TLS.CipherSuite), ln.extension("tls_protocol", nil), albValue(o, r.TLS.ServerName)
+	}
+
+	fields := []string{
+		albType(r),
+		ln.time.UTC().Format(albTimeFormat),
+		o.Sanitize(ln.serverName(o.ServerName)),
+		o.Sanitize(ln.remoteIP(o.TrustedProxies)) + ":" + ln.port("remote"),
+		target,
+		"-1", // request_processing_time
+		strconv.FormatFloat(ln.duration().Seconds(), 'f', 3, 64),
+		"-1", // response_processing_time
+		status,
+		status,
+		string(ln.bytesReceived(nil)),
+		string(ln.bytesSent(nil)),
+		`"` + o.Sanitize(albRequest(ln)) + `"`,
+		`"` + albValue(o, ln.redact.headerValue(r.Header, "User-Agent", "")) + `"`,
+		cipher,
+		protocol,
+		"-", // target_group_arn
+		`"` + albValue(o, ln.redact.headerValue(r.Header, "X-Amzn-Trace-Id", "")) + `"`,
+		`"` + sni + `"`,
+		`"-"`, // chosen_cert_arn
+		"-",   // matched_rule_priority
+		ln.writer.start.UTC().Format(albTimeFormat),
+		`"forward"`,
+		`"-"`, // redirect_url
+		`"-"`, // error_reason
+		`"` + target + `"`,
+		`"` + status + `"`,
+		`"-"`, // classification
+		`"-"`, // classification_reason
+		"-",   // conn_trace_id
+	}
+	return strings.Join(fields, " ")
+}
+
+// albType returns the type of the request: http, https, h2, ws or wss
+func albType(r *http.Request) string {
+	websocket := strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+	switch {
+	case r.TLS == nil && websocket:
+		return "ws"
+	case r.TLS == nil:
+		return "http"
+	case websocket:
+		return "wss"
+	case r.ProtoMajor == 2:
+		return "h2"
+	}
+	return "https"
+}
+
+// albRequest returns the request as logged by ALB: the method, the absolute URL
+// with the port and the protocol, e.g. GET http://example.com:80/path?q=1 HTTP/1.1
+func albRequest(ln *line) string {
+	scheme := "http"
+	if ln.request.TLS != nil {
+		scheme = "https"
+	}
+	host := hostOnly(ln.request.Host)
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return ln.method() + " " + scheme + "://" + host + ":" + ln.port("") + ln.requestURI() + " " + ln.protocol()
+}
+
+// albValue returns the escaped value s, or "-" when it is empty
+func albValue(o *opt, s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return o.Sanitize(s)
+}
+
+// albCipher returns the name of the cipher suite id as logged by ALB
+func albCipher(id uint16) string {
+	if name, ok := albCiphers[id]; ok {
+		return name
+	}
+	return tls.CipherSuiteName(id)
+}
@@ -0,0 +1,72 @@
+package accesslog
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestALBLogFormat(t *testing.T) {
+	req, err := http.NewRequest("GET", "https://example.com/index.html?x=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.RequestURI = "/index.html?x=1"
+	req.Header.Set("User-Agent", `curl "7"`)
+	req.Header.Set("X-Amzn-Trace-Id", "Root=1-67891233-abcdef012345678912345678")
+	req.TLS = &tls.ConnectionState{Version: tls.VersionTLS12, CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, ServerName: "example.com"}
+	local := &net.TCPAddr{IP: net.IPv4(192, 168, 0, 5), Port: 8443}
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, local))
+
+	clock := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	now := func() time.Time {
+		clock = clock.Add(50 * time.Millisecond)
+		return clock
+	}
+	buf := new(bytes.Buffer)
+	aLog := ALBLogFormat(WithOutput(buf), WithNowFunc(now), WithServerName("app/my-alb/50dc6c495c0c9188"))
+	handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// the clock ticks at the start, the first byte and the end of the request
+	want := `https 2024-01-02T03:04:05.150000Z app/my-alb/50dc6c495c0c9188 10.0.0.1:1234 192.168.0.5:8443 -1 0.100 -1 200 200 ` +
+		`132 21 "GET https://example.com:443/index.html?x=1 HTTP/1.1" "curl \x227\x22" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2 - ` +
+		`"Root=1-67891233-abcdef012345678912345678" "example.com" "-" - 2024-01-02T03:04:05.050000Z "forward" "-" "-" ` +
+		`"192.168.0.5:8443" "200" "-" "-" -` + "\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+}
+
+func TestALBLogFormatPlaintext(t *testing.T) {
+	req := httptest.NewRequest("GET", "/chat", nil)
+	req.Host = "[::1]:8080"
+	req.Header.Set("Upgrade", "websocket")
+
+	buf := new(bytes.Buffer)
+	aLog := ALBLogFormat(WithOutput(buf))
+	aLog(http.HandlerFunc(HandlerTesting)).ServeHTTP(httptest.NewRecorder(), req)
+
+	fields := strings.Fields(buf.String())
+	if got := fields[0]; got != "ws" {
+		t.Errorf("wrong type: got %v expect %v", got, "ws")
+	}
+	if got := fields[4]; got != "-" {
+		t.Errorf("wrong target: got %v expect %v", got, "-")
+	}
+	if got, want := strings.Join(fields[12:15], " "), `"GET http://[::1]:8080/chat HTTP/1.1"`; got != want {
+		t.Errorf("wrong request: got %v expect %v", got, want)
+	}
+	if got, want := strings.Join(fields[16:18], " "), "- -"; got != want {
+		t.Errorf("wrong TLS fields: got %v expect %v", got, want)
+	}
+}
@@ -0,0 +1,77 @@
+package accesslog
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// ipAnonymizer replaces the client addresses before they are logged,
+// either masking them to a network prefix or with a keyed hash
+type ipAnonymizer struct {
+	v4bits, v6bits int
+	secret         []byte // the HMAC key, nil when masking
+}
+
+// WithAnonymizeIP masks the client address logged by the %h and %a directives to its first
+// v4bits or v6bits bits, e.g. 203.0.113.42 is logged as 203.0.113.0 with 24 bits and
+// 2001:db8:1234:5678::1 as 2001:db8:1234:: with 48 bits. The masked address is also the one
+// of the LogEntry and the %{for}F directive, and hostname lookups are disabled as the hostname
+// would reveal the address. Addresses taken from headers, e.g. %{X-Forwarded-For}i,
+// are not masked, see WithRedactHeaders.
+func WithAnonymizeIP(v4bits, v6bits int) optFunc {
+	return func(o *opt) {
+		if v4bits < 0 || v4bits > 32 || v6bits < 0 || v6bits > 128 {
+			if o.Err == nil {
+				o.Err = fmt.Errorf("accesslog: invalid IP anonymization prefixes /%d and /%d", v4bits, v6bits)
+			}
+			return
+		}
+		o.Anonymizer = &ipAnonymizer{v4bits: v4bits, v6bits: v6bits}
+	}
+}
+
+// WithHashIP is like WithAnonymizeIP, but logs the client address as a prefix of its
+// HMAC-SHA256 keyed with secret, e.g. 1f2a3b4c5d6e7f80, so that the requests of a client
+// can be correlated without logging its address. The secret must not be empty.
+func WithHashIP(secret []byte) optFunc {
+	return func(o *opt) {
+		if len(secret) == 0 {
+			if o.Err == nil {
+				o.Err = errors.New("accesslog: empty IP hashing secret")
+			}
+			return
+		}
+		o.Anonymizer = &ipAnonymizer{secret: append([]byte(nil), secret...)}
+	}
+}
+
+// anonymize returns the address addr as it may be logged: masked, hashed, or "-"
+// if it is not an IP address that can be masked
+func (an *ipAnonymizer) anonymize(addr string) string {
+	if an == nil || addr == "-" {
+		return addr
+	}
+	if an.secret != nil {
+		mac := hmac.New(sha256.New, an.secret)
+		mac.Write([]byte(addr))
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return "-"
+	}
+	ip = ip.Unmap()
+	bits := an.v6bits
+	if ip.Is4() {
+		bits = an.v4bits
+	}
+	prefix, err := ip.WithZone("").Prefix(bits)
+	if err != nil {
+		return "-"
+	}
+	return prefix.Addr().String()
+}
@@ -0,0 +1,83 @@
+package accesslog
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWithAnonymizeIP(t *testing.T) {
+	lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		return []string{"client.example.com."}, nil
+	}
+	defer func() { lookupAddr = net.DefaultResolver.LookupAddr }()
+
+	tests := []struct {
+		remoteAddr string
+		opts       []optFunc
+		want       string // the %a of the line and the entry, %h when not anonymized
+	}{
+		{"203.0.113.42:1234", nil, "203.0.113.42"},
+		{"203.0.113.42:1234", []optFunc{WithAnonymizeIP(24, 48)}, "203.0.113.0"},
+		{"[2001:db8:1234:5678::1]:1234", []optFunc{WithAnonymizeIP(24, 48)}, "2001:db8:1234::"},
+		{"[::ffff:203.0.113.42]:1234", []optFunc{WithAnonymizeIP(16, 48)}, "203.0.0.0"},
+		{"pipe", []optFunc{WithAnonymizeIP(24, 48)}, "-"},
+		{"203.0.113.42:1234", []optFunc{WithHashIP([]byte("secret"))}, "a35f6ceb431882d1"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = tt.remoteAddr
+
+		buf := new(bytes.Buffer)
+		var entry LogEntry
+		opts := append(tt.opts, WithOutput(buf), WithHostnameLookups(time.Second),
+			WithEntryHandler(func(e LogEntry) { entry = e }))
+		aLog := FormatWith("%h %a", opts...)
+		aLog(http.HandlerFunc(HandlerTesting)).ServeHTTP(httptest.NewRecorder(), req)
+
+		host := tt.want
+		if tt.opts == nil {
+			host = "client.example.com"
+		}
+		if want := host + " " + tt.want + "\n"; buf.String() != want {
+			t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+		}
+		if entry.RemoteAddr != tt.want {
+			t.Errorf("wrong entry address: got %v expect %v", entry.RemoteAddr, tt.want)
+		}
+	}
+}
+
+func TestWithAnonymizeIPForwarded(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("Forwarded", `for="[2001:db8::7]:4711";proto=https, for=10.0.0.2`)
+
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%a %{for}F %{proto}F", WithOutput(buf), WithTrustedProxies("10.0.0.0/8"), WithAnonymizeIP(24, 32))
+	aLog(http.HandlerFunc(HandlerTesting)).ServeHTTP(httptest.NewRecorder(), req)
+
+	want := "2001:db8:: 2001:db8:: https\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+}
+
+func TestWithAnonymizeIPInvalid(t *testing.T) {
+	for _, opt := range []optFunc{WithAnonymizeIP(33, 48), WithAnonymizeIP(24, -1), WithHashIP(nil)} {
+		if _, err := FormatWithStrict(ApacheCommonLogFormat, opt); err == nil {
+			t.Errorf("no error for invalid anonymization")
+		}
+	}
+}
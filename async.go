@@ -0,0 +1,138 @@
+package accesslog
+
+import (
+	"errors"
+	"sync"
+)
+
+// DropPolicy is what asynchronous logging does with a line when its queue is full
+type DropPolicy int
+
+const (
+	// DropNone blocks the request until there is room in the queue
+	DropNone DropPolicy = iota
+
+	// DropNewest drops the line of the request
+	DropNewest
+
+	// DropOldest drops the oldest line waiting in the queue to make room for the line of the request
+	DropOldest
+)
+
+// ErrDropped is reported to the error handler for every line dropped by asynchronous logging
+var ErrDropped = errors.New("accesslog: async queue full, line dropped")
+
+// WithAsync writes the log lines on a background goroutine, so request latency does not
+// include writing them. The lines are formatted before they are queued, as the response
+// can not be read once the handler has returned. Up to queueSize requests wait to be logged, policy decides what
+// happens when more are waiting. Every dropped line is reported to the error handler with ErrDropped.
+// Conditions, sampling and rate limiting are applied before queuing, the lines they drop never wait.
+// Use WithFlusher to wait for the queue to be drained, Close stops the goroutine and
+// later requests are logged synchronously.
+func WithAsync(queueSize int, policy DropPolicy) optFunc {
+	return func(o *opt) {
+		o.AsyncSize = queueSize
+		o.DropPolicy = policy
+	}
+}
+
+// asyncItem is a rendered request waiting to be written, or a flush marker with done set
+type asyncItem struct {
+	rec  record
+	done chan struct{}
+}
+
+// asyncQueue writes the records sent to it on a background goroutine
+type asyncQueue struct {
+	o    *opt
+	emit func(rec record)
+
+	mu     sync.RWMutex // held for writing to close c
+	c      chan asyncItem
+	closed bool
+	exited chan struct{}
+}
+
+func newAsyncQueue(o *opt, emit func(rec record)) *asyncQueue {
+	q := &asyncQueue{o: o, emit: emit, c: make(chan asyncItem, o.AsyncSize), exited: make(chan struct{})}
+	go q.run()
+	return q
+}
+
+func (q *asyncQueue) run() {
+	defer close(q.exited)
+	for it := range q.c {
+		if it.done != nil {
+			close(it.done)
+			continue
+		}
+		q.emit(it.rec)
+	}
+}
+
+// send queues the record to be written according to the drop policy,
+// or writes it right away once the queue is closed
+func (q *asyncQueue) send(rec record) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		q.emit(rec)
+		return
+	}
+	it := asyncItem{rec: rec}
+	switch q.o.DropPolicy {
+	case DropNewest:
+		select {
+		case q.c <- it:
+		default:
+			q.o.error(ErrDropped)
+		}
+	case DropOldest:
+		for {
+			select {
+			case q.c <- it:
+				return
+			default:
+			}
+			select {
+			case old := <-q.c:
+				// a dropped flush marker is released early rather than blocking Flush
+				if old.done != nil {
+					close(old.done)
+				} else {
+					q.o.error(ErrDropped)
+				}
+			default:
+			}
+		}
+	default:
+		q.c <- it
+	}
+}
+
+// Flush waits for the requests queued so far to be logged
+func (q *asyncQueue) Flush() error {
+	q.mu.RLock()
+	if q.closed {
+		q.mu.RUnlock()
+		return nil
+	}
+	done := make(chan struct{})
+	q.c <- asyncItem{done: done}
+	q.mu.RUnlock()
+	<-done
+	return nil
+}
+
+// Close logs the queued requests and stops the background goroutine
+func (q *asyncQueue) Close() error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.c)
+	}
+	q.mu.Unlock()
+	<-q.exited
+	return nil
+}
@@ -0,0 +1,126 @@
+package accesslog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWithAsync(t *testing.T) {
+	buf := new(syncBuffer)
+	var flusher Flusher
+	aLog := FormatWith("%U", WithOutput(buf), WithAsync(16, DropNone), WithFlusher(&flusher))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "/testing", nil)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+	}
+	wg.Wait()
+	if err := flusher.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Repeat("/testing\n", 100); buf.String() != want {
+		t.Errorf("wrong log lines: got %v expect %v", len(buf.String()), len(want))
+	}
+
+	if err := flusher.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "/closed", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if !strings.HasSuffix(buf.String(), "/testing\n/closed\n") {
+		t.Errorf("wrong log line after close: got %v", buf.String()[len(buf.String())-20:])
+	}
+}
+
+func TestWithAsyncDropPolicy(t *testing.T) {
+	tests := []struct {
+		policy DropPolicy
+		want   string
+	}{
+		{DropNewest, "/0\n/1\n"},
+		{DropOldest, "/3\n/4\n"},
+	}
+
+	for _, tt := range tests {
+		buf := new(syncBuffer)
+		var flusher Flusher
+		dropped := make(chan error, 10)
+		blocked, release := make(chan struct{}), make(chan struct{})
+		aLog := FormatWith("%U", WithOutput(buf), WithAsync(2, tt.policy), WithFlusher(&flusher),
+			WithErrorHandler(func(err error) { dropped <- err }),
+			WithEntryHandler(func(e LogEntry) {
+				if e.Path == "/block" {
+					close(blocked)
+					<-release
+				}
+			}))
+		handler := aLog(http.HandlerFunc(HandlerTesting))
+
+		// the first line keeps the goroutine busy while the queue of 2 fills up
+		req, _ := http.NewRequest("GET", "/block", nil)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		<-blocked
+		for i := 0; i < 5; i++ {
+			req, _ := http.NewRequest("GET", "/"+string(rune('0'+i)), nil)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		close(release)
+		if err := flusher.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if want := "/block\n" + tt.want; buf.String() != want {
+			t.Errorf("wrong log lines: got %q expect %q", buf.String(), want)
+		}
+		for i := 0; i < 3; i++ {
+			if err := <-dropped; err != ErrDropped {
+				t.Errorf("wrong error: got %v expect %v", err, ErrDropped)
+			}
+		}
+	}
+}
+
+func TestWithAsyncHTTP2(t *testing.T) {
+	buf := new(syncBuffer)
+	var flusher Flusher
+	release := make(chan struct{})
+	aLog := FormatWith("%>s %{X-Test}o %B %X", WithOutput(buf), WithAsync(16, DropNone), WithFlusher(&flusher),
+		WithContentLengthFallback(), WithEntryHandler(func(e LogEntry) { <-release }))
+	ts := httptest.NewUnstartedServer(aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Test", "h2")
+		w.Header().Set("Content-Length", "5")
+		w.Write([]byte("hello"))
+	})))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	// the lines are written once the handlers have returned, the HTTP/2 responses
+	// can not be read anymore by then
+	for i := 0; i < 4; i++ {
+		resp, err := ts.Client().Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.ProtoMajor != 2 {
+			t.Fatalf("wrong protocol: got %v", resp.Proto)
+		}
+	}
+	close(release)
+	if err := flusher.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Repeat("200 h2 5 +\n", 4); buf.String() != want {
+		t.Errorf("wrong log lines: got %v expect %v", buf.String(), want)
+	}
+}
@@ -0,0 +1,170 @@
+package accesslog
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// WithBufferedOutput buffers up to size bytes of log lines in memory before writing them
+// to the output, flushing at least every flushInterval when it is positive. Whole lines are
+// written to the output, so a rotating file from WithFile or WithFilePattern never splits a line
+// across files, and the buffer is flushed before the file is reopened. Use WithFlusher to flush
+// the buffer on shutdown, lines still buffered are lost otherwise.
+func WithBufferedOutput(size int, flushInterval time.Duration) optFunc {
+	return func(o *opt) {
+		o.BufferSize = size
+		o.FlushInterval = flushInterval
+	}
+}
+
+// Flusher is implemented by buffered and asynchronous outputs. Flush writes the buffered
+// and queued lines to the output, Close also stops the background goroutines,
+// later lines are written synchronously and unbuffered.
+type Flusher interface {
+	Flush() error
+	Close() error
+}
+
+// errNotBuffered is returned when flushing an output that is neither buffered nor asynchronous
+var errNotBuffered = errors.New("accesslog: output is not buffered")
+
+// outputFlusher flushes the async queue and the output of the options once they are built
+type outputFlusher struct {
+	o *opt
+}
+
+func (f outputFlusher) Flush() error {
+	return f.do(Flusher.Flush)
+}
+
+func (f outputFlusher) Close() error {
+	return f.do(Flusher.Close)
+}
+
+// do calls fn on the async queue first, so that its lines reach the output, then on the output
+func (f outputFlusher) do(fn func(Flusher) error) error {
+	out, ok := f.o.Output.(Flusher)
+	if f.o.Queue == nil && !ok {
+		return errNotBuffered
+	}
+	if f.o.Queue != nil {
+		if err := fn(f.o.Queue); err != nil {
+			return err
+		}
+	}
+	if ok {
+		return fn(out)
+	}
+	return nil
+}
+
+// WithFlusher sets *f to a handle flushing the output of the middleware buffered with WithBufferedOutput,
+// or the queue of WithAsync.
+func WithFlusher(f *Flusher) optFunc {
+	return func(o *opt) {
+		*f = outputFlusher{o}
+	}
+}
+
+// bufferedWriter buffers whole lines for out, flushing them periodically
+type bufferedWriter struct {
+	out io.Writer
+	o   *opt
+
+	mu     sync.Mutex
+	w      *bufio.Writer
+	stop   chan struct{}
+	closed bool
+}
+
+// newBufferedWriter returns a buffered writer for the output of o
+func newBufferedWriter(o *opt) *bufferedWriter {
+	b := &bufferedWriter{out: o.Output, o: o, w: bufio.NewWriterSize(o.Output, o.BufferSize)}
+	if o.FlushInterval > 0 {
+		b.stop = make(chan struct{})
+		go b.run(o.FlushInterval)
+	}
+	return b
+}
+
+func (b *bufferedWriter) run(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := b.Flush(); err != nil {
+				b.o.error(err)
+			}
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// Write buffers the line p, flushing the buffered lines first if it does not fit
+func (b *bufferedWriter) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return b.out.Write(p)
+	}
+	if len(p) > b.w.Available() && b.w.Buffered() > 0 {
+		if err := b.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return b.w.Write(p)
+}
+
+func (b *bufferedWriter) locksWrites() {}
+
+// Flush writes the buffered lines to the output
+func (b *bufferedWriter) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flush()
+}
+
+// flush writes the buffered lines, they are dropped on failure so that the buffer remains usable
+func (b *bufferedWriter) flush() error {
+	err := b.w.Flush()
+	if err != nil {
+		b.w.Reset(b.out)
+	}
+	return err
+}
+
+// Close flushes the buffered lines and stops buffering
+func (b *bufferedWriter) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	if b.stop != nil {
+		close(b.stop)
+	}
+	return b.flush()
+}
+
+// Reopen flushes the buffered lines and reopens the output
+func (b *bufferedWriter) Reopen() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.flush(); err != nil {
+		b.o.error(err)
+	}
+	if out, ok := b.out.(Reopener); ok {
+		return out.Reopen()
+	}
+	b.o.error(errNotReopenable)
+	return errNotReopenable
+}
@@ -0,0 +1,127 @@
+package accesslog
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for the background flushes
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWithBufferedOutput(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(syncBuffer)
+	var flusher Flusher
+	aLog := FormatWith("%U", WithOutput(buf), WithBufferedOutput(4096, 0), WithFlusher(&flusher))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if buf.String() != "" {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), "")
+	}
+	if err := flusher.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "/testing\n" {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), "/testing\n")
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if err := flusher.Close(); err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if want := strings.Repeat("/testing\n", 3); buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+}
+
+func TestWithBufferedOutputInterval(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(syncBuffer)
+	var flusher Flusher
+	aLog := FormatWith("%U", WithOutput(buf), WithBufferedOutput(4096, 10*time.Millisecond), WithFlusher(&flusher))
+	defer flusher.Close()
+	aLog(http.HandlerFunc(HandlerTesting)).ServeHTTP(httptest.NewRecorder(), req)
+
+	for deadline := time.Now().Add(5 * time.Second); buf.String() == "" && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if buf.String() != "/testing\n" {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), "/testing\n")
+	}
+}
+
+func TestWithBufferedOutputRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+
+	var flusher Flusher
+	clock := time.Date(2013, time.February, 3, 19, 54, 0, 0, time.UTC)
+	aLog := FormatWith("%U", WithFile(path, 1, 0), WithBufferedOutput(600<<10, 0), WithFlusher(&flusher),
+		WithNowFunc(func() time.Time { return clock }), WithErrorHandler(func(err error) { t.Error(err) }))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+
+	// each line is 100KiB, so flushes write 6 lines and the file rotates after 10
+	uri := "/" + strings.Repeat("a", 100<<10-2)
+	for i := 0; i < 25; i++ {
+		req, err := http.NewRequest("GET", uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		clock = clock.Add(time.Second)
+	}
+	if err := flusher.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines int
+	for _, name := range names {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b)%(100<<10) != 0 || len(b) > 1<<20 {
+			t.Errorf("split line in %s of %v bytes", name, len(b))
+		}
+		lines += len(b) / (100 << 10)
+	}
+	if lines != 25 {
+		t.Errorf("wrong number of lines: got %v expect %v", lines, 25)
+	}
+}
@@ -0,0 +1,106 @@
+package accesslog
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// Closer shuts down a middleware cleanly, see WithCloser.
+type Closer interface {
+	Close(ctx context.Context) error
+}
+
+// outputCloser closes the outputs of the options once they are built
+type outputCloser struct {
+	o *opt
+}
+
+// WithCloser sets *c to a handle shutting the middleware down, e.g. once the http.Server
+// has been shut down. Close writes the summary of the lines suppressed by WithRateLimit, drains
+// the queue of WithAsync and the syslog queue, flushes the buffer of WithBufferedOutput, and closes
+// the files of WithFile and WithFilePattern and the connection of WithNetworkOutput, then waits for
+// the error handler to handle the errors reported and stops its goroutine. The writers
+// passed to WithOutput, WithOutputs, WithStatusOutput and WithSlowLog belong to the caller and are
+// left open, those with a Flush() error method such as a *bufio.Writer are flushed. The lines of the
+// requests completed before Close is called are written before it returns, unless ctx is done
+// first, in which case Close returns the context error and shutting down continues in the background.
+// Lines of requests completing later are written synchronously and unbuffered, the files are
+// opened again as needed, while lines for a closed network output are dropped.
+func WithCloser(c *Closer) optFunc {
+	return func(o *opt) {
+		*c = outputCloser{o}
+	}
+}
+
+func (c outputCloser) Close(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- c.o.close()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close writes the pending summary and drains the queues, then closes the outputs,
+// in the order lines go through them, and stops the error handler last
+func (o *opt) close() error {
+	if o.RateLimit != nil && o.Notice != nil {
+		if s := o.RateLimit.pending(o.now()); len(s) > 0 {
+			o.Notice(s)
+		}
+	}
+	var errs []error
+	if o.Queue != nil {
+		errs = append(errs, o.Queue.Close())
+	}
+	if o.Syslog != nil {
+		errs = append(errs, o.Syslog.close())
+	}
+	o.OutputMu.Lock()
+	errs = append(errs, closeOutput(o.Output))
+	o.OutputMu.Unlock()
+	for _, so := range o.StatusOutputs {
+		so.mu.Lock()
+		errs = append(errs, flushOutput(so.w))
+		so.mu.Unlock()
+	}
+	if sl := o.SlowLog; sl != nil {
+		sl.mu.Lock()
+		errs = append(errs, flushOutput(sl.w))
+		sl.mu.Unlock()
+	}
+	o.Errors.close()
+	return errors.Join(errs...)
+}
+
+// closeOutput closes w if it is an output opened by this package, or flushes it
+func closeOutput(w io.Writer) error {
+	switch w := w.(type) {
+	case *bufferedWriter:
+		return errors.Join(w.Close(), closeOutput(w.out))
+	case *rotatingFile, *patternFile, *networkWriter:
+		return w.(io.Closer).Close()
+	case *teeWriter:
+		var errs []error
+		for _, s := range w.sinks {
+			s.mu.Lock()
+			errs = append(errs, closeOutput(s.w))
+			s.mu.Unlock()
+		}
+		return errors.Join(errs...)
+	}
+	return flushOutput(w)
+}
+
+// flushOutput flushes the writer w of the caller if it buffers its writes, e.g. a *bufio.Writer
+func flushOutput(w io.Writer) error {
+	if f, ok := w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
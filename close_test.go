@@ -0,0 +1,114 @@
+package accesslog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWithCloser(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	var closer Closer
+	aLog := FormatWith("%U", WithFile(path, 0, 0), WithBufferedOutput(4096, time.Hour), WithAsync(16, DropNone), WithCloser(&closer))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/testing", nil))
+		}()
+	}
+	wg.Wait()
+
+	// every line queued and buffered is in the file once Close returns
+	if err := closer.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Repeat("/testing\n", 100); string(b) != want {
+		t.Errorf("wrong log lines: got %v expect %v", len(b), len(want))
+	}
+
+	// the file is opened again for the requests completing later
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/closed", nil))
+	if b, _ = os.ReadFile(path); !strings.HasSuffix(string(b), "/testing\n/closed\n") {
+		t.Errorf("wrong log line after close: got %v", string(b[len(b)-20:]))
+	}
+}
+
+// closeRecorder records whether it was closed
+type closeRecorder struct {
+	syncBuffer
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestWithCloserUserOutput(t *testing.T) {
+	out := new(closeRecorder)
+	var closer Closer
+	handler := FormatWith("%U", WithOutput(out), WithCloser(&closer))(http.HandlerFunc(HandlerTesting))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/testing", nil))
+
+	if err := closer.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if out.closed {
+		t.Error("output set with WithOutput closed")
+	}
+}
+
+func TestWithCloserFlush(t *testing.T) {
+	var tee1, tee2, status, slow bytes.Buffer
+	outputs := []*bufio.Writer{bufio.NewWriter(&tee1), bufio.NewWriter(&tee2), bufio.NewWriter(&status), bufio.NewWriter(&slow)}
+	var closer Closer
+	aLog := FormatWith("%U", WithOutputs(outputs[0], outputs[1]), WithStatusOutput(200, 299, outputs[2]),
+		WithStatusOutputCopies(), WithSlowLog(0, outputs[3], "%U"), WithCloser(&closer))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/testing", nil))
+
+	if err := closer.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i, buf := range []*bytes.Buffer{&tee1, &tee2, &status, &slow} {
+		if got := buf.String(); got != "/testing\n" {
+			t.Errorf("wrong log line of output %d: got %q expect %q", i, got, "/testing\n")
+		}
+	}
+}
+
+func TestWithCloserDeadline(t *testing.T) {
+	blocked, release := make(chan struct{}), make(chan struct{})
+	var closer Closer
+	aLog := FormatWith("%U", WithOutput(new(syncBuffer)), WithAsync(16, DropNone), WithCloser(&closer),
+		WithEntryHandler(func(e LogEntry) {
+			close(blocked)
+			<-release
+		}))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/testing", nil))
+	<-blocked
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := closer.Close(ctx); err != context.DeadlineExceeded {
+		t.Errorf("wrong close error: got %v expect %v", err, context.DeadlineExceeded)
+	}
+	close(release)
+}
@@ -0,0 +1,148 @@
+package accesslog
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DevLogFormat is the format of DevLog, the time, status, method, duration and path of each request
+const DevLogFormat = "%{%H:%M:%S}t %>s %m %{ms}Tms %U%q"
+
+// DevLog will log HTTP requests in a readable, aligned and colored format for local development,
+// see WithDevLayout and WithColor. Custom formats get the same layout with WithDevLayout,
+// e.g. FormatWith(DevLogFormat+" %{cache}n", WithDevLayout()).
+func DevLog(opts ...optFunc) func(http.Handler) http.Handler {
+	return FormatWith(DevLogFormat, append([]optFunc{WithDevLayout()}, opts...)...)
+}
+
+// ColorMode is whether statuses are colored, see WithColor
+type ColorMode int
+
+const (
+	// ColorAuto colors the statuses when the output is a terminal and NO_COLOR is not set
+	ColorAuto ColorMode = iota
+
+	// ColorAlways colors the statuses
+	ColorAlways
+
+	// ColorNever never colors the statuses
+	ColorNever
+)
+
+// WithColor colors the statuses logged by %s and %>s with ANSI escape codes by class:
+// green for 2xx, cyan for 3xx, yellow for 4xx and red for 5xx. It is meant for local development,
+// colors are added once the values are escaped so they can not be forged by clients.
+func WithColor(mode ColorMode) optFunc {
+	return func(o *opt) {
+		o.Color = mode
+		o.ColorSet = true
+	}
+}
+
+// WithDevLayout aligns the columns of the log lines for reading in a terminal: methods are padded
+// to 7 characters, durations right-aligned to 6 and paths truncated to fit the terminal width
+// given by the COLUMNS environment variable, 80 by default. Statuses are colored as with
+// WithColor(ColorAuto), unless WithColor is set.
+func WithDevLayout() optFunc {
+	return func(o *opt) {
+		o.DevLayout = true
+	}
+}
+
+// colored returns whether the statuses are colored on out
+func (m ColorMode) colored(out io.Writer) bool {
+	switch m {
+	case ColorAlways:
+		return true
+	case ColorNever:
+		return false
+	}
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false
+	}
+	f, ok := out.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// statusColors are the ANSI colors of the status classes
+var statusColors = map[byte]string{
+	'2': "\x1b[32m",
+	'3': "\x1b[36m",
+	'4': "\x1b[33m",
+	'5': "\x1b[31m",
+}
+
+// colorStatus colors the status s by class
+func colorStatus(s string) string {
+	if len(s) == 0 {
+		return s
+	}
+	if c, ok := statusColors[s[0]]; ok {
+		return c + s + "\x1b[0m"
+	}
+	return s
+}
+
+// devPathWidth returns the width left for the path in the lines of DevLogFormat
+func devPathWidth() int {
+	columns, err := strconv.Atoi(os.Getenv("COLUMNS"))
+	if err != nil || columns <= 0 {
+		columns = 80
+	}
+	// the time, status, method and duration columns
+	return max(columns-len("15:04:05 200 OPTIONS 123456ms "), 20)
+}
+
+// decorators returns the functions rewriting the values of tokens for the dev layout and colors,
+// nil when there are none
+func decorators(o *opt, tokens []token) []func(string) string {
+	if !o.Colored && !o.DevLayout {
+		return nil
+	}
+	pathWidth := devPathWidth()
+	dec := make([]func(string) string, len(tokens))
+	for i, tok := range tokens {
+		d := tok.directive
+		switch {
+		case (d == "%s" || d == "%>s") && o.Colored:
+			dec[i] = colorStatus
+		case !o.DevLayout:
+		case d == "%m":
+			dec[i] = func(s string) string { return padRight(s, 7) }
+		case d == "%D" || d == "%T" || isDuration(d):
+			dec[i] = func(s string) string { return padLeft(s, 6) }
+		case d == "%U":
+			dec[i] = func(s string) string { return truncatePath(s, pathWidth) }
+		}
+	}
+	return dec
+}
+
+func padRight(s string, n int) string {
+	if len(s) >= n {
+		return s
+	}
+	return s + strings.Repeat(" ", n-len(s))
+}
+
+func padLeft(s string, n int) string {
+	if len(s) >= n {
+		return s
+	}
+	return strings.Repeat(" ", n-len(s)) + s
+}
+
+// truncatePath cuts the path s to at most n bytes ending with "..."
+func truncatePath(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:cutIndex(s, n-len("..."))] + "..."
+}
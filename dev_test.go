@@ -0,0 +1,92 @@
+package accesslog
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDevLog(t *testing.T) {
+	t.Setenv("COLUMNS", "50")
+	tests := []struct {
+		opts []optFunc
+		path string
+		want string
+	}{
+		{nil, "/home?q=1", "13:55:36 404 GET         12ms /home?q=1\n"},
+		{[]optFunc{WithColor(ColorAlways)}, "/home", "13:55:36 \x1b[33m404\x1b[0m GET         12ms /home\n"},
+		{nil, "/" + strings.Repeat("a", 30), "13:55:36 404 GET         12ms /aaaaaaaaaaaaaaaa...\n"},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the clock is read at the start, on the first byte and at the end of the request
+		clock := time.Date(2000, 10, 10, 13, 55, 36, 0, time.UTC)
+		now := func() time.Time {
+			clock = clock.Add(6 * time.Millisecond)
+			return clock
+		}
+		buf := new(bytes.Buffer)
+		aLog := DevLog(append(tt.opts, WithOutput(buf), WithNowFunc(now))...)
+		handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if buf.String() != tt.want {
+			t.Errorf("wrong log line: got %q expect %q", buf.String(), tt.want)
+		}
+	}
+}
+
+func TestDevLayoutCustomFields(t *testing.T) {
+	req, err := http.NewRequest("POST", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%m %{cache}n", WithOutput(buf), WithDevLayout())
+	handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		AddField(r, "cache", "hit")
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	want := "POST    hit\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %q expect %q", buf.String(), want)
+	}
+}
+
+func TestColorAuto(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "access.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	tests := []struct {
+		mode ColorMode
+		out  io.Writer
+		want bool
+	}{
+		{ColorAuto, f, false},
+		{ColorAuto, new(bytes.Buffer), false},
+		{ColorAlways, f, true},
+		{ColorNever, f, false},
+	}
+	for _, tt := range tests {
+		if got := tt.mode.colored(tt.out); got != tt.want {
+			t.Errorf("wrong color for %T: got %v expect %v", tt.out, got, tt.want)
+		}
+	}
+}
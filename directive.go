@@ -0,0 +1,41 @@
+package accesslog
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DirectiveFunc resolves a user-defined directive at log time. arg is the label
+// of the %{arg}Z form of the directive, or an empty string for %Z.
+type DirectiveFunc func(w ResponseInfo, r *http.Request, arg string) string
+
+// WithDirective defines the directive letter, so that %letter and %{arg}letter are
+// logged with the value returned by fn. Values are sanitized like request headers.
+// Letters used by built-in directives can not be redefined, FormatWithStrict reports
+// them as an error and FormatWith ignores them.
+func WithDirective(letter byte, fn DirectiveFunc) optFunc {
+	return func(o *opt) {
+		if err := checkCustomDirective(letter); err != nil {
+			if o.Err == nil {
+				o.Err = err
+			}
+			return
+		}
+		if o.Directives == nil {
+			o.Directives = make(map[byte]DirectiveFunc)
+		}
+		o.Directives[letter] = fn
+	}
+}
+
+// checkCustomDirective returns an error if letter can not be used for a user-defined directive
+func checkCustomDirective(letter byte) error {
+	switch {
+	case !isLetter(letter):
+		return fmt.Errorf("invalid directive letter %q", letter)
+	case directiveNames["%"+string(letter)] || strings.IndexByte(enclosedDirectives, letter) >= 0:
+		return fmt.Errorf("directive %%%c is built in", letter)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package accesslog
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestWithDirective(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Shard", "eu\n1")
+
+	shard := WithDirective('Z', func(w ResponseInfo, r *http.Request, arg string) string {
+		if len(arg) == 0 {
+			return strconv.Itoa(w.Status())
+		}
+		return r.Header.Get(arg)
+	})
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"%Z", "200\n"},
+		{"%{X-Shard}Z", "eu\\x0a1\n"},
+		{"%404Z %>s", "- 200\n"},
+	}
+
+	for _, tt := range tests {
+		buf := new(bytes.Buffer)
+		aLog, err := FormatWithStrict(tt.format, WithOutput(buf), shard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aLog(http.HandlerFunc(HandlerTesting)).ServeHTTP(httptest.NewRecorder(), req)
+		if buf.String() != tt.want {
+			t.Errorf("wrong log line: got %v expect %v", buf.String(), tt.want)
+		}
+	}
+}
+
+func TestWithDirectiveInvalid(t *testing.T) {
+	fn := func(ResponseInfo, *http.Request, string) string { return "" }
+	tests := []struct {
+		letter byte
+		err    string
+	}{
+		{'h', "directive %h is built in"},
+		{'i', "directive %i is built in"},
+		{'1', "invalid directive letter '1'"},
+	}
+
+	for _, tt := range tests {
+		_, err := FormatWithStrict("%h", WithDirective(tt.letter, fn))
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("wrong error for %q: got %v expect %v", tt.letter, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package accesslog
+
+import (
+	"context"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// LogEntry is the structured form of the data collected by the middleware for a request,
+// passed to the handler set with WithEntryHandler. It holds copies of the request data
+// and is safe to retain after the request has ended.
+type LogEntry struct {
+	Time       time.Time
+	RemoteAddr string // client IP, after trusted proxies
+	User       string
+	RequestID  string // the request ID if the request has one, as logged by %L, it is not generated for the entry
+
+	Method string
+	Host   string
+	Path   string
+	Query  string // raw query, without the leading "?"
+	Proto  string
+
+	Status   int // final status, as %>s
+	Bytes    int // response body bytes, as %B
+	Duration time.Duration
+	Aborted  bool // the client went away before the response was complete, as %X
+
+	// Truncated is set when the log line was truncated by WithMaxLineLength
+	Truncated bool
+
+	// BytesFromHeader is set when Bytes was taken from the Content-Length header,
+	// see WithContentLengthFallback
+	BytesFromHeader bool
+
+	// BytesRead is the number of request body bytes read by the handler, as %{req}B
+	BytesRead int64
+
+	// Header holds the request headers selected with WithEntryHeaders
+	Header http.Header
+
+	// Fields holds the fields added by handlers with AddField
+	Fields map[string]string
+}
+
+// WithEntryHandler sets a function called with the LogEntry of each request once the
+// handler has returned, in addition to writing the formatted log line unless WithEntryOnly is set.
+func WithEntryHandler(fn func(LogEntry)) optFunc {
+	return func(o *opt) {
+		o.EntryHandler = fn
+	}
+}
+
+// WithEntryHeaders sets the request headers copied to the Header field of the LogEntry.
+func WithEntryHeaders(names ...string) optFunc {
+	return func(o *opt) {
+		o.EntryHeaders = names
+	}
+}
+
+// WithEntryOnly disables the formatted log line, so the LogEntry of each request
+// is only passed to the handler set with WithEntryHandler.
+func WithEntryOnly() optFunc {
+	return func(o *opt) {
+		o.EntryOnly = true
+	}
+}
+
+// newEntry returns the LogEntry of the request, copying the values it takes from it
+func newEntry(o *opt, w *responseWriter, r *http.Request) LogEntry {
+	ln := newLine(o, w, r)
+	defer ln.release()
+
+	e := LogEntry{
+		Time:       ln.time,
+		RemoteAddr: strings.Clone(ln.remoteIP(o.TrustedProxies)),
+		User:       strings.Clone(ln.username(o.UserFunc)),
+		RequestID:  strings.Clone(existingRequestID(r.Context())),
+		Method:     strings.Clone(r.Method),
+		Host:       strings.Clone(r.Host),
+		Path:       strings.Clone(r.URL.Path),
+		Query:      strings.Clone(ln.rawQuery()),
+		Proto:      strings.Clone(r.Proto),
+		Status:     w.finalStatus,
+		Duration:   ln.duration(),
+		Aborted:    w.aborted,
+	}
+	e.Bytes, e.BytesFromHeader = ln.bodySize()
+	if w.body != nil {
+		e.BytesRead = w.body.n.Load()
+	}
+	if v, ok := r.Context().Value(varsContextKey).(*vars); ok {
+		e.Fields = v.copyFields()
+	}
+	if len(o.EntryHeaders) > 0 {
+		e.Header = make(http.Header, len(o.EntryHeaders))
+		for _, name := range o.EntryHeaders {
+			redacted := ln.redact.header(textproto.CanonicalMIMEHeaderKey(name))
+			for _, v := range r.Header.Values(name) {
+				if redacted {
+					v = ln.redact.value(v)
+				}
+				e.Header.Add(name, strings.Clone(v))
+			}
+		}
+	}
+	return e
+}
+
+// existingRequestID returns the request ID of ctx if it was received, propagated or generated
+// already, so that building an entry does not generate one
+func existingRequestID(ctx context.Context) string {
+	if v, ok := ctx.Value(varsContextKey).(*vars); ok {
+		return v.existingID()
+	}
+	return ""
+}
@@ -0,0 +1,79 @@
+package accesslog
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEntryHandler(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://example.com/testing?q=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("User-Agent", "test-agent")
+	req.Header.Set("Referer", "http://example.com/")
+	req.SetBasicAuth("alice", "secret")
+
+	clock := time.Date(2013, time.February, 3, 19, 54, 0, 0, time.UTC)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		AddField(r, "cache", "miss")
+		w.WriteHeader(http.StatusTeapot)
+		io.WriteString(w, "short and stout")
+		clock = clock.Add(time.Millisecond)
+	})
+
+	// the request ID is only generated for %L, not for the entry
+	tests := []struct {
+		name   string
+		format string
+		opts   []optFunc
+		expect string
+		id     string
+	}{
+		{"with line", "%>s", nil, "418\n", ""},
+		{"with request ID", "%>s %L", nil, "418 id-1\n", "id-1"},
+		{"entry only", "%>s %L", []optFunc{WithEntryOnly()}, "", ""},
+	}
+
+	for _, test := range tests {
+		var entry LogEntry
+		out := &bytes.Buffer{}
+		opts := append([]optFunc{
+			WithOutput(out),
+			WithNowFunc(func() time.Time { return clock }),
+			WithIDGenerator(func(*http.Request) string { return "id-1" }),
+			WithEntryHeaders("User-Agent", "X-Missing"),
+			WithEntryHandler(func(e LogEntry) { entry = e }),
+		}, test.opts...)
+		FormatWith(test.format, opts...)(handler).ServeHTTP(httptest.NewRecorder(), req)
+
+		if out.String() != test.expect {
+			t.Errorf("%s: wrong log line: got %q expect %q", test.name, out.String(), test.expect)
+		}
+		expect := LogEntry{
+			Time:       clock,
+			RemoteAddr: "10.0.0.1",
+			User:       "alice",
+			RequestID:  test.id,
+			Method:     "GET",
+			Host:       "example.com",
+			Path:       "/testing",
+			Query:      "q=1",
+			Proto:      "HTTP/1.1",
+			Status:     http.StatusTeapot,
+			Bytes:      15,
+			Duration:   time.Millisecond,
+			Header:     http.Header{"User-Agent": {"test-agent"}},
+			Fields:     map[string]string{"cache": "miss"},
+		}
+		if !reflect.DeepEqual(entry, expect) {
+			t.Errorf("%s: wrong log entry: got %+v expect %+v", test.name, entry, expect)
+		}
+	}
+}
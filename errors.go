@@ -0,0 +1,77 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errorQueueSize is the number of errors waiting for the error handler before new ones are dropped
+const errorQueueSize = 64
+
+// errorReporter calls the error handler on a goroutine of its own, started on the first error
+// and stopped by close, so that it is never called concurrently and can not deadlock the output that failed
+type errorReporter struct {
+	mu   sync.Mutex
+	c    chan error    // nil while the goroutine is not running
+	done chan struct{} // closed once the last goroutine started has returned
+}
+
+// report queues err for handler, dropping it when the queue is full
+func (e *errorReporter) report(handler func(error), err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.c == nil {
+		// an error reported after close starts a new goroutine, once the previous one has returned
+		c, prev, done := make(chan error, errorQueueSize), e.done, make(chan struct{})
+		e.c, e.done = c, done
+		go func() {
+			defer close(done)
+			if prev != nil {
+				<-prev
+			}
+			for err := range c {
+				handler(err)
+			}
+		}()
+	}
+	select {
+	case e.c <- err:
+	default:
+	}
+}
+
+// close stops the goroutine once the handler has been called for the errors queued
+func (e *errorReporter) close() {
+	e.mu.Lock()
+	c, done := e.c, e.done
+	e.c = nil
+	e.mu.Unlock()
+	if c != nil {
+		close(c)
+		<-done
+	}
+}
+
+// stderrErrors returns the default error handler, writing errors to os.Stderr
+// at most once per second with the number of errors suppressed in between
+func stderrErrors() func(error) {
+	var last time.Time
+	var suppressed int
+	return func(err error) {
+		now := time.Now()
+		if now.Sub(last) < time.Second {
+			suppressed++
+			return
+		}
+		msg := strings.TrimPrefix(err.Error(), "accesslog: ")
+		if suppressed > 0 {
+			fmt.Fprintf(os.Stderr, "accesslog: %s (%d errors suppressed)\n", msg, suppressed)
+		} else {
+			fmt.Fprintf(os.Stderr, "accesslog: %s\n", msg)
+		}
+		last, suppressed = now, 0
+	}
+}
@@ -0,0 +1,86 @@
+package accesslog
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestWithErrorHandler(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var calls, concurrent int
+	reported := make(chan error, 100)
+	aLog := FormatWith("%U", WithOutput(failingWriter{}), WithErrorHandler(func(err error) {
+		if !mu.TryLock() {
+			concurrent++
+			return
+		}
+		calls++
+		time.Sleep(time.Millisecond)
+		mu.Unlock()
+		reported <- err
+	}))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 10; i++ {
+		if err := <-reported; err.Error() != "disk full" {
+			t.Errorf("wrong error: got %v expect %v", err, "disk full")
+		}
+	}
+	if concurrent > 0 {
+		t.Errorf("error handler called concurrently %v times", concurrent)
+	}
+}
+
+func TestWithErrorHandlerClose(t *testing.T) {
+	var reported []error
+	var closer Closer
+	aLog := FormatWith("%U", WithOutput(failingWriter{}), WithCloser(&closer), WithErrorHandler(func(err error) {
+		time.Sleep(time.Millisecond)
+		reported = append(reported, err)
+	}))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/testing", nil))
+
+	for i := 0; i < 2; i++ {
+		if err := closer.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		// the handler has returned, its goroutine is stopped
+		if len(reported) != i+1 {
+			t.Fatalf("wrong errors reported: got %v expect %v", len(reported), i+1)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/testing", nil))
+	}
+	if err := closer.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(reported) != 3 {
+		t.Errorf("wrong errors reported: got %v expect %v", len(reported), 3)
+	}
+}
@@ -0,0 +1,87 @@
+package accesslog
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+const hexDigits = "0123456789abcdef"
+
+// needsSanitizing reports if s has control characters or invalid UTF-8,
+// it is the fast path that keeps clean ASCII values from being copied
+func needsSanitizing(s string) bool {
+	var nonASCII bool
+	for i := 0; i < len(s); i++ {
+		switch b := s[i]; {
+		case b < 0x20 || b == 0x7f:
+			return true
+		case b >= utf8.RuneSelf:
+			nonASCII = true
+		}
+	}
+	return nonASCII && !utf8.ValidString(s)
+}
+
+// sanitize replaces each control character and byte of an invalid UTF-8 sequence in s with repl(b)
+func sanitize(s string, repl func(b byte) string) string {
+	if !needsSanitizing(s) {
+		return s
+	}
+	var sb strings.Builder
+	sb.Grow(len(s) + 8)
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if (r == utf8.RuneError && size == 1) || r < 0x20 || r == 0x7f {
+			sb.WriteString(repl(s[i]))
+		} else {
+			sb.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	return sb.String()
+}
+
+// escapeString replaces control characters and invalid UTF-8 in s with \xhh escapes
+func escapeString(s string) string {
+	return sanitize(s, func(b byte) string {
+		return `\x` + string(hexDigits[b>>4]) + string(hexDigits[b&0x0f])
+	})
+}
+
+// replaceString returns a sanitizer replacing control characters and invalid UTF-8 with repl
+func replaceString(repl string) func(string) string {
+	return func(s string) string {
+		return sanitize(s, func(byte) string { return repl })
+	}
+}
+
+// unescapeLiteral interprets the \n, \t, \r, \\ and \" escape sequences
+// in the literal text of a format, other sequences are left as they are
+func unescapeLiteral(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	var sb strings.Builder
+	sb.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			sb.WriteByte(s[i])
+			continue
+		}
+		switch s[i+1] {
+		case 'n':
+			sb.WriteByte('\n')
+		case 't':
+			sb.WriteByte('\t')
+		case 'r':
+			sb.WriteByte('\r')
+		case '\\', '"':
+			sb.WriteByte(s[i+1])
+		default:
+			sb.WriteByte(s[i])
+			continue
+		}
+		i++
+	}
+	return sb.String()
+}
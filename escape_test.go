@@ -0,0 +1,89 @@
+package accesslog
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEscapeString(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Go testing", "Go testing"},
+		{"café", "café"},
+		{"a\nb\tc", `a\x0ab\x09c`},
+		{"bad \xff\xfe utf8", `bad \xff\xfe utf8`},
+		{"\x1b[31mred", `\x1b[31mred`},
+		{"del\x7f", `del\x7f`},
+	}
+
+	for _, tt := range tests {
+		if got := escapeString(tt.in); got != tt.want {
+			t.Errorf("escapeString(%q): got %v expect %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLoggingMiddlewareSanitize(t *testing.T) {
+	tests := []struct {
+		opts []optFunc
+		want string
+	}{
+		{nil, `"evil\x0a\xffagent"`},
+		{[]optFunc{WithReplacement("?")}, `"evil??agent"`},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header["User-Agent"] = []string{"evil\n\xffagent"}
+
+		buf := new(bytes.Buffer)
+		aLog := FormatWith(`"%{User-agent}i"`, append(tt.opts, WithOutput(buf))...)
+		handler := aLog(http.HandlerFunc(HandlerTesting))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if buf.String() != tt.want+"\n" {
+			t.Errorf("wrong log line: got %v expect %v", buf.String(), tt.want)
+		}
+	}
+}
+
+func TestLoggingMiddlewareEscapeSequences(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{`%m\t%U\t%>s`, "GET\t/testing\t200\n"},
+		{`%m\n%U`, "GET\n/testing\n"},
+		{`\"%r\"`, `"GET /testing HTTP/1.1"` + "\n"},
+		{`a\\b\r\q`, "a\\b\r\\q\n"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		aLog := FormatWith(tt.format, WithOutput(buf))
+		handler := aLog(http.HandlerFunc(HandlerTesting))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if buf.String() != tt.want {
+			t.Errorf("wrong log line for %q: got %q expect %q", tt.format, buf.String(), tt.want)
+		}
+	}
+}
+
+func BenchmarkEscapeStringClean(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		escapeString("Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko)")
+	}
+}
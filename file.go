@@ -0,0 +1,319 @@
+package accesslog
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the layout of the timestamp suffix of rotated log files
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// WithFile writes the log lines to the file at path, rotating it once it exceeds maxSizeMB
+// megabytes: the file is renamed with a timestamp suffix, e.g. access.log.2013-02-03T19-54-00.000,
+// followed by a counter such as .1 if a backup of the same millisecond exists,
+// a new file is opened and the oldest backups beyond maxBackups are deleted.
+// A maxSizeMB of 0 disables rotation and a maxBackups of 0 keeps all backups.
+// Rotation failures are reported to the error handler.
+func WithFile(path string, maxSizeMB int, maxBackups int) optFunc {
+	return func(o *opt) {
+		o.Output = &rotatingFile{
+			path:       path,
+			maxSize:    int64(maxSizeMB) << 20,
+			maxBackups: maxBackups,
+			o:          o,
+		}
+	}
+}
+
+// rotatingFile is a log file rotated by size, opened on first write
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	o          *opt
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Write writes p to the file, rotating it first if p would make it exceed the maximum size
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		f.rotate()
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) locksWrites() {}
+
+// Reopen closes the file and opens the file at its path again, for when it was renamed
+// by an external tool such as logrotate. Lines being written complete to the old file first.
+func (f *rotatingFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	old := f.file
+	if err := f.open(); err != nil {
+		f.o.error(err)
+		return err
+	}
+	if old == nil {
+		return nil
+	}
+	// the preamble was written to the old file, a new one needs its own
+	if f.o.Preamble != nil && f.size == 0 {
+		n, _ := f.file.WriteString(f.o.Preamble())
+		f.size += int64(n)
+	}
+	return old.Close()
+}
+
+// Close closes the file, it is opened again by the next write
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// open opens the file for appending
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// rotate renames the file with a timestamp suffix and opens a new one. On failure
+// the error is reported and writing continues to the current file.
+func (f *rotatingFile) rotate() {
+	old := f.file
+	backup := f.backupName(f.o.now())
+	if err := os.Rename(f.path, backup); err != nil {
+		f.o.error(err)
+		return
+	}
+	if err := f.open(); err != nil {
+		// keep writing to the renamed file rather than losing lines
+		f.o.error(err)
+		return
+	}
+	if err := old.Close(); err != nil {
+		f.o.error(err)
+	}
+	f.prune()
+	if f.o.Preamble != nil {
+		n, _ := f.file.WriteString(f.o.Preamble())
+		f.size += int64(n)
+	}
+}
+
+// backupName returns the name of a new backup at now. os.Rename replaces existing files,
+// so the name has a counter above those of the backups of the same millisecond, if any.
+func (f *rotatingFile) backupName(now time.Time) string {
+	name := f.path + "." + now.Format(backupTimeFormat)
+	matches, _ := filepath.Glob(name + "*")
+	last := -1
+	for _, m := range matches {
+		if n, ok := parseBackupCounter(m[len(name):]); ok && n > last {
+			last = n
+		}
+	}
+	if last < 0 {
+		return name
+	}
+	return name + "." + strconv.Itoa(last+1)
+}
+
+// prune deletes the oldest backups beyond the maximum number of backups
+func (f *rotatingFile) prune() {
+	if f.maxBackups <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		f.o.error(err)
+		return
+	}
+	type backup struct {
+		name string
+		t    time.Time
+		n    int
+	}
+	var backups []backup
+	for _, m := range matches {
+		if t, n, ok := parseBackupSuffix(m[len(f.path)+1:]); ok {
+			backups = append(backups, backup{m, t, n})
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		if !backups[i].t.Equal(backups[j].t) {
+			return backups[i].t.Before(backups[j].t)
+		}
+		return backups[i].n < backups[j].n
+	})
+	for len(backups) > f.maxBackups {
+		if err := os.Remove(backups[0].name); err != nil {
+			f.o.error(err)
+		}
+		backups = backups[1:]
+	}
+}
+
+// parseBackupSuffix parses the suffix of a backup, its timestamp optionally followed by a counter
+func parseBackupSuffix(suffix string) (t time.Time, n int, ok bool) {
+	if len(suffix) < len(backupTimeFormat) {
+		return t, 0, false
+	}
+	t, err := time.Parse(backupTimeFormat, suffix[:len(backupTimeFormat)])
+	if err != nil {
+		return t, 0, false
+	}
+	n, ok = parseBackupCounter(suffix[len(backupTimeFormat):])
+	return t, n, ok
+}
+
+// parseBackupCounter parses the counter following the timestamp of a backup, e.g. ".1",
+// which is 0 when there is none
+func parseBackupCounter(s string) (int, bool) {
+	if len(s) == 0 {
+		return 0, true
+	}
+	if len(s) < 2 || s[0] != '.' || s[1] < '1' || s[1] > '9' {
+		return 0, false
+	}
+	n, err := strconv.Atoi(s[1:])
+	return n, err == nil
+}
+
+// WithFilePattern writes the log lines to files named by rendering pattern with the
+// strftime-style conversions of the %{...}t directive, e.g. "logs/access-%Y-%m-%d.log"
+// for one file per day. The name is checked once a minute and the output switches to the
+// new file when it changes. Missing parent directories are created and existing files are appended to.
+// Failures to open a new file are reported to the error handler and the current file is kept.
+func WithFilePattern(pattern string) optFunc {
+	return func(o *opt) {
+		o.Output = &patternFile{pattern: pattern, o: o}
+	}
+}
+
+// patternFile is a log file named after a time pattern, opened on first write
+type patternFile struct {
+	pattern string
+	o       *opt
+
+	mu      sync.Mutex
+	file    *os.File
+	name    string
+	checked int64 // the minute of the last name check, in Unix time
+}
+
+// Write writes p to the file, switching to a new file first if the name changed
+func (f *patternFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.o.now()
+	if f.o.Location != nil {
+		now = now.In(f.o.Location)
+	}
+	if minute := now.Unix() / 60; f.file == nil || minute != f.checked {
+		f.checked = minute
+		if name := convertTimeFormat(now, f.pattern); name != f.name || f.file == nil {
+			if err := f.open(name); err != nil {
+				f.o.error(err)
+				if f.file == nil {
+					return 0, err
+				}
+			}
+		}
+	}
+	return f.file.Write(p)
+}
+
+func (f *patternFile) locksWrites() {}
+
+// Reopen closes the file and opens the file with the current name again, for when it was
+// renamed by an external tool such as logrotate. Lines being written complete to the old file first.
+func (f *patternFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	old := f.file
+	file, err := os.OpenFile(f.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		f.o.error(err)
+		return err
+	}
+	f.file = file
+	if info, err := file.Stat(); err == nil && info.Size() == 0 && f.o.Preamble != nil {
+		// the preamble was written to the old file, a new one needs its own
+		file.WriteString(f.o.Preamble())
+	}
+	return old.Close()
+}
+
+// Close closes the file, it is opened again by the next write
+func (f *patternFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// open switches to the file name, creating it and its parent directories as needed
+func (f *patternFile) open(name string) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	old := f.file
+	f.file, f.name = file, name
+	if old != nil {
+		if err := old.Close(); err != nil {
+			f.o.error(err)
+		}
+		if f.o.Preamble != nil {
+			file.WriteString(f.o.Preamble())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package accesslog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	if err := os.WriteFile(path+".gz", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := time.Date(2013, time.February, 3, 19, 54, 0, 0, time.UTC)
+	aLog := FormatWith("%U", WithFile(path, 1, 2), WithNowFunc(func() time.Time { return clock }),
+		WithErrorHandler(func(err error) { t.Error(err) }))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+
+	// each line is a 256KiB path, so the file rotates every 4 lines
+	uri := "/" + strings.Repeat("a", 256<<10-2)
+	for i := 0; i < 14; i++ {
+		req, err := http.NewRequest("GET", uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		clock = clock.Add(time.Second)
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	want := []string{path, path + ".2013-02-03T19-54-08.000", path + ".2013-02-03T19-54-12.000", path + ".gz"}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("wrong files: got %v expect %v", names, want)
+	}
+	for i, name := range want[:3] {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := []int{2, 4, 4}[i]
+		if len(b) != lines*256<<10 {
+			t.Errorf("wrong size of %s: got %v expect %v", name, len(b), lines*256<<10)
+		}
+	}
+}
+
+func TestWithFileSameMillisecond(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+
+	clock := time.Date(2013, time.February, 3, 19, 54, 0, 0, time.UTC)
+	aLog := FormatWith("%U", WithFile(path, 1, 3), WithNowFunc(func() time.Time { return clock }),
+		WithErrorHandler(func(err error) { t.Error(err) }))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+
+	// the file rotates every 4 lines, 12 times in the same millisecond
+	uri := "/" + strings.Repeat("a", 256<<10-2)
+	for i := 0; i < 50; i++ {
+		req, err := http.NewRequest("GET", uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	backup := path + ".2013-02-03T19-54-00.000"
+	want := []string{path, backup + ".10", backup + ".11", backup + ".9"}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("wrong files: got %v expect %v", names, want)
+	}
+	for _, name := range want[1:] {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != 4*256<<10 {
+			t.Errorf("wrong size of %s: got %v expect %v", name, len(b), 4*256<<10)
+		}
+	}
+}
+
+func TestWithFilePattern(t *testing.T) {
+	dir := t.TempDir()
+	pattern := filepath.Join(dir, "%Y", "access-%m-%d.log")
+	if err := os.MkdirAll(filepath.Join(dir, "2013"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "2013", "access-02-03.log"), []byte("/earlier\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := time.Date(2013, time.February, 3, 23, 59, 0, 0, time.UTC)
+	aLog := FormatWith("%U", WithFilePattern(pattern), WithUTC(), WithNowFunc(func() time.Time { return clock }),
+		WithErrorHandler(func(err error) { t.Error(err) }))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+
+	for _, path := range []string{"/before", "/midnight", "/after"} {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		clock = clock.Add(30 * time.Second)
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{filepath.Join(dir, "2013", "access-02-03.log"), "/earlier\n/before\n/midnight\n"},
+		{filepath.Join(dir, "2013", "access-02-04.log"), "/after\n"},
+	}
+	for _, tt := range tests {
+		b, err := os.ReadFile(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("wrong log file %s: got %q expect %q", tt.name, b, tt.want)
+		}
+	}
+}
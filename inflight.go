@@ -0,0 +1,111 @@
+package accesslog
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WithInFlightInterval writes a progress line for the requests still running after each interval d,
+// such as server-sent events and large uploads. Progress lines use the format of the middleware
+// with the status logged as "...", the bytes written and the time elapsed so far, and "-" for
+// the other directives about the response, while %{req}B logs the request body bytes read so far.
+// The directives about the request log it as it was before the handler ran.
+// Progress lines go where the start lines of WithRequestStartLine go. It applies to the middleware
+// of Format, FormatWith and FormatWithStrict.
+func WithInFlightInterval(d time.Duration) optFunc {
+	return func(o *opt) {
+		o.InFlightInterval = d
+	}
+}
+
+// progressTokens returns tokens for progress lines, with the status replaced by "..." and the directives
+// about the response that are not tracked while it is written replaced by empty
+func progressTokens(tokens []token, empty string) []token {
+	prog := make([]token, len(tokens))
+	for i, tok := range tokens {
+		switch d := tok.directive; {
+		case len(d) == 0:
+		case d == "%s" || d == "%>s":
+			tok = token{literal: "..."}
+		case d == "%b" || d == "%B" || d == "%D" || d == "%T" || isDuration(d):
+			tok.cond = nil
+		case tok.cond != nil, responseDirectives[d],
+			strings.HasPrefix(d, "%{") && strings.IndexByte("oT", d[len(d)-1]) >= 0:
+			tok = token{literal: empty}
+		}
+		prog[i] = tok
+	}
+	return prog
+}
+
+// inFlightState is what the progress lines read of a response while the handler writes it
+type inFlightState struct {
+	bytes  atomic.Int64
+	header atomic.Pointer[http.Header] // a copy of the header once it is written
+}
+
+// setHeader keeps a copy of the header h of the response, as it was written
+func (st *inFlightState) setHeader(h http.Header) {
+	c := h.Clone()
+	st.header.Store(&c)
+}
+
+// snapshotWriter is the ResponseWriter of the snapshots of the progress lines, holding
+// a copy of the response header so custom directives can read it, writing to it does nothing
+type snapshotWriter struct {
+	header http.Header
+}
+
+func (sw snapshotWriter) Header() http.Header         { return sw.header }
+func (sw snapshotWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (sw snapshotWriter) WriteHeader(int)             {}
+
+// inFlight writes the progress lines of a request until it is stopped
+type inFlight struct {
+	mu    sync.Mutex
+	timer *time.Timer
+	done  bool
+}
+
+// startInFlight starts rendering the progress lines of the request with logFunc every interval,
+// write writes them to the outputs. The lines are rendered from a copy of the request taken
+// before the handler runs, as it may change the header or URL of the request concurrently.
+func startInFlight(o *opt, logFunc func(w *responseWriter, r *http.Request) string, write func(s string), rw *responseWriter, r *http.Request) *inFlight {
+	rw.progress = new(inFlightState)
+	r = r.Clone(r.Context())
+	f := new(inFlight)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.timer = time.AfterFunc(o.InFlightInterval, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.done {
+			return
+		}
+		// a snapshot of the response, the handler may be writing it concurrently
+		h := http.Header{}
+		if p := rw.progress.header.Load(); p != nil {
+			h = *p
+		}
+		snap := &responseWriter{ResponseWriter: snapshotWriter{h}, now: rw.now, start: rw.start, end: o.now(), byteCount: int(rw.progress.bytes.Load())}
+		if rw.body != nil {
+			snap.body = new(countingBody)
+			snap.body.n.Store(rw.body.n.Load())
+		}
+		s, _ := truncateLine(logFunc(snap, r), o.MaxLineLength)
+		write(s)
+		f.timer.Reset(o.InFlightInterval)
+	})
+	return f
+}
+
+// stop stops the progress lines, none is written once it returns
+func (f *inFlight) stop() {
+	f.mu.Lock()
+	f.done = true
+	f.timer.Stop()
+	f.mu.Unlock()
+}
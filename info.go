@@ -0,0 +1,50 @@
+package accesslog
+
+import (
+	"net/http"
+	"time"
+)
+
+// ResponseInfo gives access to what the access log middleware knows about a response,
+// so that other middleware such as metrics or error reporting can cooperate with it
+// instead of wrapping the http.ResponseWriter again.
+type ResponseInfo interface {
+	// Status returns the final status written, or 0 if nothing has been written yet
+	Status() int
+
+	// BytesWritten returns the number of response body bytes written
+	BytesWritten() int
+
+	// Elapsed returns the time since the request entered the access log middleware
+	Elapsed() time.Duration
+}
+
+// Status implements ResponseInfo
+func (rw *responseWriter) Status() int {
+	return rw.finalStatus
+}
+
+// BytesWritten implements ResponseInfo
+func (rw *responseWriter) BytesWritten() int {
+	return rw.byteCount
+}
+
+// Elapsed implements ResponseInfo
+func (rw *responseWriter) Elapsed() time.Duration {
+	return rw.now().Sub(rw.start)
+}
+
+// InfoFrom returns the ResponseInfo of the access log middleware wrapping w,
+// following the Unwrap() chain of other wrapping http.ResponseWriters to find it.
+func InfoFrom(w http.ResponseWriter) (ResponseInfo, bool) {
+	for {
+		switch t := w.(type) {
+		case *responseWriter:
+			return t, true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = t.Unwrap()
+		default:
+			return nil, false
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package accesslog
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// wrappingWriter is a http.ResponseWriter wrapper as used by other middleware
+type wrappingWriter struct {
+	http.ResponseWriter
+}
+
+func (w *wrappingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func TestInfoFrom(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := time.Date(2013, time.February, 3, 19, 54, 0, 0, time.UTC)
+	var info ResponseInfo
+	metrics := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&wrappingWriter{w}, r)
+			var ok bool
+			if info, ok = InfoFrom(w); !ok {
+				t.Error("no response info found")
+			}
+		})
+	}
+	aLog := FormatWith("%>s", WithOutput(io.Discard), WithNowFunc(func() time.Time { return clock }))
+	handler := aLog(metrics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := InfoFrom(w); !ok {
+			t.Error("no response info found through the wrapper")
+		}
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "created")
+		clock = clock.Add(time.Second)
+	})))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if info == nil {
+		t.Fatal("no response info found")
+	}
+	if info.Status() != http.StatusCreated {
+		t.Errorf("wrong status: got %v expect %v", info.Status(), http.StatusCreated)
+	}
+	if info.BytesWritten() != 7 {
+		t.Errorf("wrong bytes written: got %v expect %v", info.BytesWritten(), 7)
+	}
+	if info.Elapsed() != time.Second {
+		t.Errorf("wrong elapsed time: got %v expect %v", info.Elapsed(), time.Second)
+	}
+
+	if _, ok := InfoFrom(httptest.NewRecorder()); ok {
+		t.Error("unexpected response info")
+	}
+}
@@ -0,0 +1,112 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// DefaultJSONFields are the JSON field names and directives equivalent to the Apache Combined Log Format,
+// with the time in ISO 8601 and the duration in microseconds. JSONFormat copies the fields when it
+// compiles them, so changing the map only affects the middleware returned by later calls, and it
+// must not be changed while JSONFormat is running.
+var DefaultJSONFields = map[string]string{
+	"remote_host": "%h",
+	"user":        "%u",
+	"time":        "%{%Y-%m-%dT%H:%M:%S%z}t",
+	"request":     "%r",
+	"status":      "%>s",
+	"bytes":       "%B",
+	"referer":     "%{Referer}i",
+	"user_agent":  "%{User-agent}i",
+	"duration":    "%D",
+}
+
+// numericDirectives are the directives logged as JSON numbers
+var numericDirectives = map[string]bool{
+	"%s": true, "%>s": true, "%b": true, "%B": true, "%D": true, "%T": true,
+	"%I": true, "%O": true, "%p": true, "%P": true, "%^FB": true,
+}
+
+// jsonField is a field of a JSON log line with its compiled format
+type jsonField struct {
+	key     []byte // the JSON encoded name
+	numeric bool
+	render  func(buf *bytes.Buffer, ln *line)
+}
+
+// JSONFormat returns middleware logging one compact JSON object per request, for log shippers
+// such as ELK. The keys of fields are the JSON field names and the values are format strings
+// using Apache formatting directives, e.g. "%>s" or "%{User-agent}i". Fields made of a single
+// numeric directive such as %>s, %B or %D are logged as numbers, or null when they have
+// no value. Unknown directives are ignored. Values are escaped for JSON only,
+// unless WithReplacement is set. The fields are compiled when JSONFormat is called,
+// the map is not read again.
+func JSONFormat(fields map[string]string, opts ...optFunc) func(http.Handler) http.Handler {
+	options := buildOpt(append([]optFunc{withoutSanitizing()}, opts...)...)
+
+	copied := make([]FieldFormat, 0, len(fields))
+	for key, format := range fields {
+		copied = append(copied, FieldFormat{key, format})
+	}
+	sort.Slice(copied, func(i, j int) bool { return copied[i].Key < copied[j].Key })
+
+	compiled := make([]jsonField, 0, len(copied))
+	for _, f := range copied {
+		tokens, _ := parseFormat(f.Format, options.Directives)
+		name, _ := json.Marshal(f.Key)
+		compiled = append(compiled, jsonField{
+			key:     name,
+			numeric: len(tokens) == 1 && (numericDirectives[tokens[0].directive] || isDuration(tokens[0].directive)),
+			render:  compile(options, tokens),
+		})
+	}
+
+	return middleware(options, func(w *responseWriter, r *http.Request) string {
+		ln := newLine(options, w, r)
+		defer ln.release()
+
+		buf, val := getBuffer(), getBuffer()
+		defer putBuffer(buf)
+		defer putBuffer(val)
+		enc := json.NewEncoder(buf)
+		enc.SetEscapeHTML(false)
+
+		buf.WriteByte('{')
+		for i, f := range compiled {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.Write(f.key)
+			buf.WriteByte(':')
+
+			val.Reset()
+			f.render(val, ln)
+			switch {
+			case f.numeric && val.String() == options.EmptyValue:
+				buf.WriteString("null")
+			case f.numeric:
+				buf.Write(val.Bytes())
+			default:
+				enc.Encode(val.String())
+				buf.Truncate(buf.Len() - 1) // the newline added by Encode
+			}
+		}
+		buf.WriteByte('}')
+		return buf.String()
+	})
+}
+
+// isDuration reports whether s is a %{unit}T directive
+func isDuration(s string) bool {
+	return len(s) > 4 && s[:2] == "%{" && s[len(s)-2:] == "}T"
+}
+
+// withoutSanitizing leaves values taken from the request as they are, for outputs
+// doing their own escaping
+func withoutSanitizing() optFunc {
+	return func(o *opt) {
+		o.Sanitize = func(s string) string { return s }
+	}
+}
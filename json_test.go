@@ -0,0 +1,61 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestJSONFormat(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing?a=1&b=2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("User-Agent", "agent \"quoted\"\n")
+
+	date := time.Date(2013, time.February, 3, 19, 54, 0, 0, time.UTC)
+	tests := []struct {
+		fields map[string]string
+		want   string
+	}{
+		{
+			DefaultJSONFields,
+			`{"bytes":17,"duration":0,"referer":"-","remote_host":"10.0.0.1","request":"GET /testing?a=1&b=2 HTTP/1.1",` +
+				`"status":200,"time":"2013-02-03T19:54:00+0000","user":"-","user_agent":"agent \"quoted\"\n"}` + "\n",
+		},
+		{
+			map[string]string{"status": "%404>s", "size": "%b", "line": "%m %U", "empty": ""},
+			`{"empty":"","line":"GET /testing","size":17,"status":null}` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		buf := new(bytes.Buffer)
+		aLog := JSONFormat(tt.fields, WithOutput(buf), WithTime(date), WithUTC())
+		aLog(http.HandlerFunc(HandlerTesting)).ServeHTTP(httptest.NewRecorder(), req)
+
+		if buf.String() != tt.want {
+			t.Errorf("wrong log line: got %v expect %v", buf.String(), tt.want)
+		}
+		if !json.Valid(buf.Bytes()) {
+			t.Errorf("invalid JSON: %v", buf.String())
+		}
+	}
+}
+
+func TestJSONFormatFieldsCopied(t *testing.T) {
+	fields := map[string]string{"status": "%>s"}
+	buf := new(bytes.Buffer)
+	aLog := JSONFormat(fields, WithOutput(buf))
+	fields["status"] = "%U"
+	fields["path"] = "%U"
+	aLog(http.HandlerFunc(HandlerTesting)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/testing", nil))
+
+	if want := `{"status":200}` + "\n"; buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+}
@@ -1,16 +1,22 @@
 package accesslog
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/base64"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
-	"unicode"
+	"unicode/utf8"
 )
 
 // optFunc is the type to use to options to the option struct during initialization
@@ -18,17 +24,146 @@ type optFunc func(*opt)
 
 // opt is the internal struct that holds the options for logging.
 type opt struct {
-	Output io.Writer
-	Time   time.Time
+	Output     io.Writer
+	OutputMu   sync.Mutex
+	Now        func() time.Time
+	ServerName string
+
+	IDGenerator       func(*http.Request) string
+	RequestIDHeader   string
+	PropagateID       bool
+	EchoID            bool
+	TraceExtractor    func(context.Context) (traceID, spanID string)
+	FileResolver      func(*http.Request) string
+	UserFunc          func(*http.Request) string
+	Resolver          *hostResolver
+	TrustedProxies    trustedProxies
+	Anonymizer        *ipAnonymizer
+	TimeFormat        string
+	Sanitize          func(string) string
+	HeaderMissing     string
+	HeaderUnderscores bool
+	Redactor          *redactor
+	Unknown           UnknownDirective
+	Location          *time.Location
+	HijackCounting    bool
+	LengthFallback    bool
+
+	EntryHandler func(LogEntry)
+	EntryHeaders []string
+	EntryOnly    bool
+
+	Directives map[byte]DirectiveFunc
+	Err        error // the first invalid option, reported by FormatWithStrict
+
+	Slog             *slog.Logger
+	SlogLevel        slog.Level
+	SlogStatusLevels bool
+
+	BufferSize    int
+	FlushInterval time.Duration
+	AsyncSize     int
+	DropPolicy    DropPolicy
+	Queue         *asyncQueue
+
+	StatusOutputs []*statusOutput
+	StatusCopies  bool
+	SlowLog       *slowLog
+	StartFormat   string
+
+	InFlightInterval time.Duration
+	RecoverPanics    bool
+	PanicResponse    bool
+	Tokens           []token // the parsed format, for the progress lines
+
+	Sampler      *sampler
+	SampleExempt func(status int, r *http.Request) bool
+	Suppressed   *atomic.Uint64
+	RateLimit    *rateLimiter
+	Notice       func(s string) // writes a line about the log itself, set by the middleware
+	Skip         func(*http.Request) bool
+	Condition    func(status int, d time.Duration, r *http.Request) bool
+
+	Syslog       *syslogWriter
+	ErrorHandler func(error)
+	Errors       errorReporter
+
+	// Preamble returns the header lines written to the output before the first log line
+	Preamble func() string
+
+	// Terminator is appended to every line written to the output
+	Terminator string
+
+	MaxLineLength int
+	EmptyValue    string
+
+	Color     ColorMode
+	ColorSet  bool
+	DevLayout bool
+	Colored   bool // resolved from Color once the output is known
+
+	Collector *Collector
 }
 
 // newOpt returns a new struct to hold options, with the default output to stdout.
 func newOpt() *opt {
 	o := new(opt)
 	o.Output = os.Stdout
+	o.IDGenerator = newRequestID
+	o.TimeFormat = CommonLogTimeFormat
+	o.Sanitize = escapeString
+	o.HeaderMissing = "-"
+	o.EmptyValue = "-"
+	o.Terminator = "\n"
+	o.ErrorHandler = stderrErrors()
 	return o
 }
 
+// error reports err to the error handler, if any
+func (o *opt) error(err error) {
+	if o.ErrorHandler != nil {
+		o.Errors.report(o.ErrorHandler, err)
+	}
+}
+
+// lockingWriter is implemented by the outputs of this package, which serialize their writes themselves
+type lockingWriter interface {
+	locksWrites()
+}
+
+// write writes p to the output with a single Write call, serialized so that the lines
+// of concurrent requests do not interleave in outputs that are not safe for concurrent use
+func (o *opt) write(p []byte) {
+	var err error
+	if _, ok := o.Output.(lockingWriter); ok {
+		_, err = o.Output.Write(p)
+	} else {
+		o.OutputMu.Lock()
+		_, err = o.Output.Write(p)
+		o.OutputMu.Unlock()
+	}
+	if err != nil {
+		o.error(err)
+	}
+}
+
+// terminated returns a pooled buffer holding the line s followed by the line terminator
+func (o *opt) terminated(s string) *bytes.Buffer {
+	buf := getBuffer()
+	buf.Grow(len(s) + len(o.Terminator))
+	buf.WriteString(s)
+	buf.WriteString(o.Terminator)
+	return buf
+}
+
+// now returns the current time from the injected clock, if any
+func (o *opt) now() time.Time {
+	if o.Now != nil {
+		return o.Now()
+	}
+	return time.Now()
+}
+
 // WithOutput sets the io.Writer output for the log file.
 func WithOutput(out io.Writer) optFunc {
 	return func(o *opt) {
@@ -36,46 +171,505 @@ func WithOutput(out io.Writer) optFunc {
 	}
 }
 
+// WithLineTerminator sets the string appended to every log line, "\n" by default.
+// It may be empty, e.g. when the output frames the lines itself, or "\r\n".
+// The line and its terminator are written to the output in a single Write.
+func WithLineTerminator(terminator string) optFunc {
+	return func(o *opt) {
+		o.Terminator = terminator
+	}
+}
+
+// WithMaxLineLength truncates the log lines longer than n bytes, not counting the terminator,
+// so that they end with TruncatedMarker and are at most n bytes long. Lines are cut once
+// rendered and escaped, at a UTF-8 character boundary. The LogEntry of a truncated line
+// has its Truncated field set, its fields are never cut.
+func WithMaxLineLength(n int) optFunc {
+	return func(o *opt) {
+		o.MaxLineLength = n
+	}
+}
+
+// TruncatedMarker ends the lines truncated by WithMaxLineLength.
+const TruncatedMarker = "...(truncated)"
+
+// truncateLine cuts s to at most max bytes ending with TruncatedMarker, when max is positive.
+// Escape sequences such as \x01 or \u0001 are never split.
+func truncateLine(s string, max int) (string, bool) {
+	if max <= 0 || len(s) <= max {
+		return s, false
+	}
+	limit := max - len(TruncatedMarker)
+	if limit < 0 {
+		return TruncatedMarker[:max], true
+	}
+	return s[:cutIndex(s, limit)] + TruncatedMarker, true
+}
+
+// cutIndex returns the largest index up to limit where s can be cut
+// without splitting a UTF-8 character or an escape sequence
+func cutIndex(s string, limit int) int {
+	n := 0
+	for n < limit {
+		size := 1
+		switch {
+		case s[n] == '\\' && n+1 < len(s) && s[n+1] == 'x':
+			size = 4
+		case s[n] == '\\' && n+1 < len(s) && s[n+1] == 'u':
+			size = 6
+		case s[n] == '\\':
+			size = 2
+		case s[n] >= utf8.RuneSelf:
+			_, size = utf8.DecodeRuneInString(s[n:])
+		}
+		if n+size > limit {
+			break
+		}
+		n += size
+	}
+	return n
+}
+
+// WithEmptyValue sets the value logged by the directives without a value, "-" by default,
+// such as %l, %u without authentication, %b for an empty body, missing headers, the TLS variables
+// of plaintext requests and directives excluded by a status condition. The connection status %X
+// is not affected, neither are headers with a placeholder set with WithHeaderPlaceholder.
+// Directives whose actual value is "-", such as a header sent as "-", are logged as empty as well.
+func WithEmptyValue(value string) optFunc {
+	return func(o *opt) {
+		o.EmptyValue = value
+	}
+}
+
+// WithNowFunc sets the clock used by the middleware for the request start time,
+// the log line timestamp and elapsed time calculations, e.g. for deterministic tests.
+func WithNowFunc(now func() time.Time) optFunc {
+	return func(o *opt) {
+		o.Now = now
+	}
+}
+
+// WithTime fixes the time used by the middleware to t, it is a shorthand for
+// WithNowFunc with a clock that never moves, so elapsed times are always zero.
+func WithTime(t time.Time) optFunc {
+	return WithNowFunc(func() time.Time { return t })
+}
+
+// WithTimeFormat sets the Go time layout used by the %t directive,
+// by default the Common Log Format layout CommonLogTimeFormat.
+func WithTimeFormat(layout string) optFunc {
+	return func(o *opt) {
+		o.TimeFormat = layout
+	}
+}
+
+// WithReplacement sets the string that replaces control characters and invalid UTF-8
+// in values taken from the request, such as headers, instead of the default \xhh escapes.
+func WithReplacement(repl string) optFunc {
+	return func(o *opt) {
+		o.Sanitize = replaceString(repl)
+	}
+}
+
+// WithHeaderPlaceholder sets the string logged by the %{...}i and %{...}o directives when the
+// header is not present, by default "-". Headers that are present but empty
+// are always logged as an empty string.
+func WithHeaderPlaceholder(placeholder string) optFunc {
+	return func(o *opt) {
+		o.HeaderMissing = placeholder
+	}
+}
+
+// WithHeaderUnderscores makes the %{...}i and %{...}o directives look the headers up with the
+// underscores of their names replaced by hyphens, as nginx does for its $http_... variables,
+// so that %{X_Forwarded_For}i logs the X-Forwarded-For header.
+func WithHeaderUnderscores() optFunc {
+	return func(o *opt) {
+		o.HeaderUnderscores = true
+	}
+}
+
+// UnknownDirective is how directives that are not recognized are logged
+type UnknownDirective int
+
+const (
+	// UnknownDrop leaves unknown directives out of the log line
+	UnknownDrop UnknownDirective = iota
+
+	// UnknownEcho logs unknown directives literally, e.g. %z
+	UnknownEcho
+
+	// UnknownMarker logs unknown directives with a marker, e.g. %!z(UNKNOWN)
+	UnknownMarker
+)
+
+// WithUnknownDirective sets how directives that are not recognized are logged,
+// by default they are dropped.
+func WithUnknownDirective(mode UnknownDirective) optFunc {
+	return func(o *opt) {
+		o.Unknown = mode
+	}
+}
+
+// WithLocation sets the time zone of the timestamps logged by the %t and %{...}t directives,
+// by default the local time zone.
+func WithLocation(loc *time.Location) optFunc {
+	return func(o *opt) {
+		o.Location = loc
+	}
+}
+
+// WithUTC logs timestamps in UTC, it is a shorthand for WithLocation(time.UTC).
+func WithUTC() optFunc {
+	return WithLocation(time.UTC)
+}
+
+// WithHijackByteCounting counts the bytes written to hijacked connections, such as
+// WebSocket upgrades, so that %b reflects the full tunneled traffic. Only bytes written
+// before the handler returns are logged.
+func WithHijackByteCounting() optFunc {
+	return func(o *opt) {
+		o.HijackCounting = true
+	}
+}
+
+// WithContentLengthFallback logs the Content-Length response header for %b, %B and %O when
+// no body bytes went through the middleware, e.g. when a downstream wrapper writes the body
+// to the underlying connection directly. By default only the bytes actually written are logged.
+func WithContentLengthFallback() optFunc {
+	return func(o *opt) {
+		o.LengthFallback = true
+	}
+}
+
+// WithErrorHandler sets the function called when writing a log line fails, and with the other
+// errors of the log outputs such as file rotation failures or an unreachable syslog daemon.
+// By default errors are written to os.Stderr, at most once per second, and nil discards them.
+// The handler is called on a goroutine of its own, never concurrently for the same middleware,
+// so it may log through the failing output. Errors are dropped while it falls behind.
+// The Close of WithCloser stops the goroutine once the errors reported are handled.
+func WithErrorHandler(fn func(error)) optFunc {
+	return func(o *opt) {
+		o.ErrorHandler = fn
+	}
+}
+
+// WithServerName sets the canonical server name logged by the %v directive,
+// instead of the name taken from the request Host.
+func WithServerName(name string) optFunc {
+	return func(o *opt) {
+		o.ServerName = name
+	}
+}
+
+// WithIDGenerator sets the function used to generate the unique request ID
+// logged by the %L directive. By default a random 16-byte hex string is used.
+func WithIDGenerator(fn func(*http.Request) string) optFunc {
+	return func(o *opt) {
+		o.IDGenerator = fn
+	}
+}
+
+// WithRequestIDHeader reuses the value of the named inbound request header
+// (e.g. X-Request-Id) as the request ID when it is present, instead of generating a new one.
+func WithRequestIDHeader(header string) optFunc {
+	return func(o *opt) {
+		o.RequestIDHeader = header
+	}
+}
+
+// WithRequestID gives every request an ID carried in the named header, e.g. X-Request-Id,
+// so the same ID appears in the access log and in the calls made to downstream services.
+// When the inbound header is empty, an ID is generated with gen, or a random 16-byte hex
+// string if gen is nil, and set on the request header seen by the handler.
+// The ID is logged by %L and by %{X-Request-Id}i, and returned by RequestID.
+func WithRequestID(header string, gen func() string) optFunc {
+	return func(o *opt) {
+		o.RequestIDHeader = header
+		o.PropagateID = true
+		if gen != nil {
+			o.IDGenerator = func(*http.Request) string { return gen() }
+		}
+	}
+}
+
+// WithRequestIDResponseHeader echoes the request ID set with WithRequestID in the response headers.
+func WithRequestIDResponseHeader() optFunc {
+	return func(o *opt) {
+		o.EchoID = true
+	}
+}
+
+// WithFileResolver sets the function used to resolve the filesystem path
+// of the file served for a request, logged by the %f directive.
+// For an http.FileServer this is typically the URL path joined to the served root.
+func WithFileResolver(fn func(*http.Request) string) optFunc {
+	return func(o *opt) {
+		o.FileResolver = fn
+	}
+}
+
+// WithUserFunc sets the function used to find the authenticated user logged by the %u directive,
+// for applications using bearer tokens or session cookies. When it returns an empty
+// string the HTTP Basic Auth user is logged instead.
+func WithUserFunc(fn func(*http.Request) string) optFunc {
+	return func(o *opt) {
+		o.UserFunc = fn
+	}
+}
+
+// WithHostnameLookups logs the client hostname for the %h directive instead of its IP,
+// like Apache's HostnameLookups. Lookups are bounded by timeout and cached; when a lookup
+// fails or times out the IP is logged.
+func WithHostnameLookups(timeout time.Duration) optFunc {
+	return func(o *opt) {
+		o.Resolver = newHostResolver(timeout, hostCacheSize)
+	}
+}
+
+// WithTrustedProxies sets the CIDR ranges (or single addresses) of proxies in front of the server.
+// When a request comes from one of them the %h and %a directives log the client address
+// taken from the Forwarded, X-Forwarded-For or X-Real-IP headers, and the %{param}F directive
+// logs a parameter of the RFC 7239 Forwarded header, e.g. %{proto}F. Invalid ranges are ignored.
+func WithTrustedProxies(cidrs ...string) optFunc {
+	return func(o *opt) {
+		o.TrustedProxies = parseTrustedProxies(cidrs...)
+	}
+}
+
 // responseWriter is the internal struct that will wrap the http.ResponseWriter
 // and hold the status and number of bytes written
 type responseWriter struct {
 	http.ResponseWriter
 
-	status    int
-	byteCount int
+	status      int // first status written, %s
+	finalStatus int // last status written, %>s
+	byteCount   int
+	headerBytes int
+
+	// body counts the request body bytes read by the handler
+	body *countingBody
+
+	start     time.Time
+	firstByte time.Time
+	end       time.Time // when the handler returned
+	now       func() time.Time
+
+	// hijacked is set once the connection is taken over by the handler,
+	// hijackCounting wraps the hijacked connection to count the bytes written to it
+	hijacked       bool
+	hijackCounting bool
+	hijackedBytes  int64
+
+	// lengthFallback uses the Content-Length header when no body bytes were written
+	lengthFallback bool
+
+	// pushes are the targets pushed with HTTP/2 server push
+	pushes []string
+
+	// skipped is set for requests left out of the log, which only track what InfoFrom reports
+	skipped bool
+
+	// progress is what the progress lines of WithInFlightInterval read of the response
+	progress *inFlightState
 
-	start time.Time
+	// aborted is set when writing the response failed or the client went away
+	// before the handler returned
+	aborted bool
+
+	// vars is the carrier installed in the request context, allocated along with the writer
+	vars vars
+
+	// logLine and logSlow are the decisions to write the line and the slow request line
+	logLine, logSlow bool
 }
 
-// WriteHeader intercepts the http.ResponseWriter WriteHeader method so we can save the status to display later
-func (rw *responseWriter) WriteHeader(i int) {
+// latchStatus saves the status, the header size and the time of the first byte
+// the first time the response is written
+func (rw *responseWriter) latchStatus(i int) {
 	if rw.status == 0 {
 		rw.status = i
+		rw.finalStatus = i
+		if rw.skipped {
+			return
+		}
+		rw.headerBytes = headerSize(rw.Header())
+		rw.firstByte = rw.now()
+		if rw.progress != nil {
+			rw.progress.setHeader(rw.Header())
+		}
 	}
+}
+
+// WriteHeader intercepts the http.ResponseWriter WriteHeader method so we can save the status to display later
+func (rw *responseWriter) WriteHeader(i int) {
+	rw.latchStatus(i)
+	rw.finalStatus = i
 	rw.ResponseWriter.WriteHeader(i)
 }
 
 // Write intercepts the http.ResponseWriter Write method so we can capture the bytes written
 func (rw *responseWriter) Write(p []byte) (n int, err error) {
-	if rw.status == 0 {
-		rw.status = http.StatusOK
-	}
+	rw.latchStatus(http.StatusOK)
 	n, err = rw.ResponseWriter.Write(p)
 	rw.byteCount += n
+	if rw.progress != nil {
+		rw.progress.bytes.Add(int64(n))
+	}
+	if err != nil {
+		rw.aborted = true
+	}
 	return
 }
 
+// ReadFrom implements io.ReaderFrom so the sendfile fast path used by http.ServeFile
+// and io.Copy is kept behind the middleware, while the bytes are still counted
+func (rw *responseWriter) ReadFrom(src io.Reader) (n int64, err error) {
+	rw.latchStatus(http.StatusOK)
+	if rf, ok := rw.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(writerOnly{rw.ResponseWriter}, src)
+	}
+	rw.byteCount += int(n)
+	if rw.progress != nil {
+		rw.progress.bytes.Add(n)
+	}
+	if err != nil {
+		rw.aborted = true
+	}
+	return
+}
+
+// writerOnly hides the optional interfaces of a writer so io.Copy doesn't use them
+type writerOnly struct {
+	io.Writer
+}
+
+// Unwrap returns the wrapped http.ResponseWriter, for http.ResponseController
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// Flush implements http.Flusher so streaming handlers keep working behind the middleware,
+// it does nothing if the wrapped http.ResponseWriter can't flush
+func (rw *responseWriter) Flush() {
+	rw.latchStatus(http.StatusOK)
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker so connection upgrades such as WebSockets keep
+// working behind the middleware. The response is logged with status 101 unless
+// the handler wrote another status before hijacking.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, brw, err := h.Hijack()
+	if err != nil {
+		return conn, brw, err
+	}
+	rw.hijacked = true
+	if rw.status == 0 {
+		rw.status, rw.finalStatus = http.StatusSwitchingProtocols, http.StatusSwitchingProtocols
+		rw.firstByte = rw.now()
+	}
+	if rw.hijackCounting {
+		cc := &countingConn{Conn: conn, n: &rw.hijackedBytes}
+		conn, brw = cc, bufio.NewReadWriter(brw.Reader, bufio.NewWriter(cc))
+	}
+	return conn, brw, nil
+}
+
+// Push implements http.Pusher so HTTP/2 server push keeps working behind the middleware,
+// it returns http.ErrNotSupported if the wrapped http.ResponseWriter can't push
+func (rw *responseWriter) Push(target string, opts *http.PushOptions) error {
+	p, ok := rw.ResponseWriter.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+	err := p.Push(target, opts)
+	if err == nil {
+		rw.pushes = append(rw.pushes, target)
+	}
+	return err
+}
+
+// countingConn counts the bytes written to a hijacked connection
+type countingConn struct {
+	net.Conn
+	n *int64
+}
+
+func (c *countingConn) Write(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	return
+}
+
+// countingBody wraps a request body and counts the bytes read from it
+type countingBody struct {
+	io.ReadCloser
+	n atomic.Int64 // read by the progress lines while the handler reads the body
+}
+
+func (b *countingBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return
+}
+
+// withCountingBody replaces the body of r with a countingBody, r must not be shared with the caller
+func (rw *responseWriter) withCountingBody(r *http.Request) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+	rw.body = &countingBody{ReadCloser: r.Body}
+	r.Body = rw.body
+}
+
+// headerSize returns the number of bytes the header fields take on the wire,
+// including the blank line terminating the header block.
+func headerSize(h http.Header) int {
+	n := 2
+	for k, vv := range h {
+		for _, v := range vv {
+			n += len(k) + len(v) + 4 // ": " and "\r\n"
+		}
+	}
+	return n
+}
+
 // startTime sets the start time to calculate the elapsed time for the %D directive
 func (rw *responseWriter) startTime() {
-	rw.start = time.Now()
+	rw.start = rw.now()
 }
 
 const (
+	// CommonLogTimeFormat is the Go time layout of the %t directive in the Common Log Format
+	CommonLogTimeFormat = "[02/Jan/2006:15:04:05 -0700]"
+
 	// ApacheCommonLogFormat is the Apache Common Log directives
 	ApacheCommonLogFormat = "%h %l %u %t \"%r\" %>s %b"
 
 	// ApacheCombinedLogFormat is the Apache Combined Log directives
 	ApacheCombinedLogFormat = "%h %l %u %t \"%r\" %>s %b \"%{Referer}i\" \"%{User-agent}i\""
+
+	// ApacheCombinedIOLogFormat is the Apache Combined Log directives with the mod_logio byte counts
+	ApacheCombinedIOLogFormat = "%h %l %u %t \"%r\" %>s %b \"%{Referer}i\" \"%{User-agent}i\" %I %O"
+
+	// ApacheVhostCombinedLogFormat is the Apache vhost_combined directives, the Combined Log
+	// prefixed with the server name and port, with the bytes sent including headers
+	ApacheVhostCombinedLogFormat = "%v:%p %h %l %u %t \"%r\" %>s %O \"%{Referer}i\" \"%{User-agent}i\""
+
+	// ApacheRefererLogFormat is the Apache legacy Referer Log directives
+	ApacheRefererLogFormat = "%{Referer}i -> %U"
+
+	// ApacheAgentLogFormat is the Apache legacy Agent Log directives
+	ApacheAgentLogFormat = "%{User-agent}i"
 )
 
 // ApacheCommonLog will log HTTP requests using the Apache Common Log format
@@ -84,29 +678,66 @@ var ApacheCommonLog = Format(ApacheCommonLogFormat)
 // ApacheCombinedLog will log HTTP requests using the Apache Combined Log format
 var ApacheCombinedLog = Format(ApacheCombinedLogFormat)
 
+// ApacheCombinedIOLog will log HTTP requests using the Apache Combined Log format with byte counts
+var ApacheCombinedIOLog = Format(ApacheCombinedIOLogFormat)
+
+// ApacheVhostCombinedLog will log HTTP requests using the Apache vhost_combined format
+var ApacheVhostCombinedLog = Format(ApacheVhostCombinedLogFormat)
+
+// ApacheRefererLog will log the referer of HTTP requests using the Apache legacy Referer Log format
+var ApacheRefererLog = Format(ApacheRefererLogFormat)
+
+// ApacheAgentLog will log the user agent of HTTP requests using the Apache legacy Agent Log format
+var ApacheAgentLog = Format(ApacheAgentLogFormat)
+
 var timeFmtMap = map[rune]string{
-	'a': "Mon", 'A': "Monday", 'b': "Jan", 'B': "January", 'C': "06",
+	'a': "Mon", 'A': "Monday", 'b': "Jan", 'B': "January",
 	'd': "02", 'D': "01/02/06", 'e': "_2", 'F': "2006-01-02",
-	'h': "Jan", 'H': "15", 'I': "3", 'k': "•15", 'l': "_3",
+	'h': "Jan", 'H': "15", 'I': "3", 'l': "_3",
 	'm': "01", 'M': "04", 'n': "\n", 'p': "PM", 'P': "pm",
 	'r': "03:04:05 PM", 'R': "15:04", 'S': "05",
 	't': "\t", 'T': "15:04:05", 'y': "06", 'Y': "2006",
-	'z': "-700", 'Z': "MST", '%': "%%",
+	'z': "-0700", 'Z': "MST", '%': "%%",
 
 	// require calculated time
-	'G': "%v", 'g': "%v", 'j': "%v", 's': "%v",
-	'u': "%v", 'V': "%v", 'w': "%v",
+	'C': "%v", 'G': "%v", 'g': "%v", 'j': "%v", 'k': "%v",
+	's': "%v", 'u': "%v", 'V': "%v", 'w': "%v", 'U': "%v",
+	'W': "%v", 'c': "%v", 'x': "%v", 'X': "%v",
 
 	// Unsupported directives
-	'c': "?", 'E': "?", 'O': "?", 'U': "?",
-	'W': "?", 'x': "?", 'X': "?", '+': "?",
+	'E': "?", 'O': "?", '+': "?",
+}
+
+// epochFormat renders the Apache sec, msec, usec, msec_frac and usec_frac time labels
+func epochFormat(now time.Time, label string) (string, bool) {
+	switch label {
+	case "sec":
+		return strconv.FormatInt(now.Unix(), 10), true
+	case "msec":
+		return strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10), true
+	case "usec":
+		return strconv.FormatInt(now.UnixNano()/int64(time.Microsecond), 10), true
+	case "msec_frac":
+		return fmt.Sprintf("%03d", now.Nanosecond()/int(time.Millisecond)), true
+	case "usec_frac":
+		return fmt.Sprintf("%06d", now.Nanosecond()/int(time.Microsecond)), true
+	}
+	return "", false
 }
 
 // convertTimeFormat converts strftime formatting directives to a go time.Time format
 func convertTimeFormat(now time.Time, format string) string {
+	if s, ok := epochFormat(now, format); ok {
+		return s
+	}
+
 	var isDirective bool
+	var skipTo int // index after an embedded label
 	var buf = new(bytes.Buffer)
-	for _, r := range format {
+	for i, r := range format {
+		if i < skipTo {
+			continue
+		}
 		if !isDirective && r == '%' {
 			isDirective = true
 			continue
@@ -115,10 +746,25 @@ func convertTimeFormat(now time.Time, format string) string {
 			buf.WriteRune(r)
 			continue
 		}
+		if r == '{' {
+			// embedded %{msec_frac}t style labels
+			if end := strings.Index(format[i:], "}t"); end > 0 {
+				if s, ok := epochFormat(now, format[i+1:i+end]); ok {
+					buf.WriteString(s)
+					skipTo = i + end + 2
+					isDirective = false
+					continue
+				}
+			}
+		}
 		if val, ok := timeFmtMap[r]; ok {
 			switch val {
 			case "%v":
 				switch r {
+				case 'C':
+					buf.WriteString(fmt.Sprintf("%02d", now.Year()/100))
+				case 'k':
+					buf.WriteString(fmt.Sprintf("%2d", now.Hour()))
 				case 'G':
 					y, _ := now.ISOWeek()
 					buf.WriteString(strconv.Itoa(y))
@@ -141,6 +787,21 @@ func convertTimeFormat(now time.Time, format string) string {
 					buf.WriteString(strconv.Itoa(w))
 				case 'w':
 					buf.WriteString(strconv.Itoa(int(now.Weekday())))
+				case 'U':
+					// weeks starting on Sunday, days before the first Sunday are in week 0
+					buf.WriteString(fmt.Sprintf("%02d", (now.YearDay()+6-int(now.Weekday()))/7))
+				case 'W':
+					// weeks starting on Monday, days before the first Monday are in week 0
+					buf.WriteString(fmt.Sprintf("%02d", (now.YearDay()+6-(int(now.Weekday())+6)%7)/7))
+				case 'c':
+					// C locale date and time representation
+					buf.WriteString(now.Format("Mon Jan _2 15:04:05 2006"))
+				case 'x':
+					// C locale date representation
+					buf.WriteString(now.Format("01/02/06"))
+				case 'X':
+					// C locale time representation
+					buf.WriteString(now.Format("15:04:05"))
 				}
 			default:
 				buf.WriteString(now.Format(val))
@@ -160,15 +821,63 @@ type line struct {
 	writer  *responseWriter
 
 	// directives
-	h, u, t, r, s, b, D string
+	h, a, A, v, V, u, t, r, fs, tid string
+	traceID, spanID                 string
+
+	// tLayout is the layout of t: the memoized values of directives
+	// taking an argument are only reused for the same argument
+	tLayout string
+
+	// redact replaces the sensitive values of the request, nil if none are
+	redact *redactor
+	// anon replaces the client address, nil if it is logged as is
+	anon *ipAnonymizer
+
+	elapsed time.Duration
+}
+
+// linePool and bufferPool recycle the lines and the buffers they are rendered into
+var (
+	linePool   = sync.Pool{New: func() any { return new(line) }}
+	bufferPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+)
+
+// maxPooledBuffer is the capacity above which a buffer is dropped rather than pooled,
+// so that an unusually long line does not keep its memory alive
+const maxPooledBuffer = 64 << 10
+
+// newLine returns a line for the request r and its response w, from the pool
+func newLine(o *opt, w *responseWriter, r *http.Request) *line {
+	ln := linePool.Get().(*line).withTime(o, w.end).withRequest(r).withResponse(w)
+	ln.redact, ln.anon = o.Redactor, o.Anonymizer
+	return ln
+}
+
+// release resets ln and puts it back in the pool, ln must not be used afterwards
+func (ln *line) release() {
+	*ln = line{}
+	linePool.Put(ln)
 }
 
-func (ln *line) withTime(o *opt) *line {
-	if !o.Time.IsZero() {
-		ln.time = o.Time
-		return ln
+// getBuffer returns an empty buffer from the pool
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// putBuffer resets buf and puts it back in the pool, buf must not be used afterwards
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+func (ln *line) withTime(o *opt, t time.Time) *line {
+	ln.time = t
+	if o.Location != nil {
+		ln.time = ln.time.In(o.Location)
 	}
-	ln.time = time.Now()
 	return ln
 }
 
@@ -183,111 +892,666 @@ func (ln *line) withResponse(a *responseWriter) *line {
 }
 
 // remoteHostname - %h
-func (ln *line) remoteHostname() string {
+func (ln *line) remoteHostname(proxies trustedProxies, resolver *hostResolver) string {
 	if len(ln.h) == 0 {
-		ln.h = ln.request.URL.Host
-		if len(ln.h) == 0 {
-			ln.h = "127.0.0.1"
+		ln.h = ln.remoteIP(proxies)
+		if ln.h != "-" && resolver != nil && ln.anon == nil {
+			ln.h = resolver.lookup(ln.h)
 		}
 	}
 	return ln.h
 }
 
+// forwarded - %{proto}F, %{host}F, %{by}F, %{for}F
+func (ln *line) forwarded(proxies trustedProxies, param string) string {
+	if v := proxies.forwardedParam(ln.request, param); len(v) > 0 {
+		if ip := parseIP(v); ip != nil && param == "for" {
+			return ln.anon.anonymize(ip.String())
+		}
+		return v
+	}
+	return "-"
+}
+
+// remoteIP - %a
+func (ln *line) remoteIP(proxies trustedProxies) string {
+	if len(ln.a) == 0 {
+		ln.a = proxies.clientIP(ln.request)
+		if len(ln.a) == 0 {
+			ln.a = "-"
+		}
+		ln.a = ln.anon.anonymize(ln.a)
+	}
+	return ln.a
+}
+
+// localIP - %A
+func (ln *line) localIP() string {
+	if len(ln.A) == 0 {
+		ln.A = "-"
+		if addr, ok := ln.request.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			ln.A = hostOnly(addr.String())
+		}
+	}
+	return ln.A
+}
+
+// port - %p, %{local}p, %{remote}p, %{canonical}p
+func (ln *line) port(kind string) string {
+	var p string
+	switch kind {
+	case "local":
+		if addr, ok := ln.request.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			p = portOnly(addr.String())
+		}
+	case "remote":
+		p = portOnly(ln.request.RemoteAddr)
+	case "", "canonical":
+		p = portOnly(ln.request.Host)
+		if len(p) == 0 {
+			p = "80"
+			if ln.request.TLS != nil {
+				p = "443"
+			}
+		}
+	}
+	if len(p) == 0 {
+		return "-"
+	}
+	return p
+}
+
+// serverName - %v
+func (ln *line) serverName(canonical string) string {
+	if len(ln.v) == 0 {
+		ln.v = canonical
+		if len(ln.v) == 0 {
+			ln.v = hostOnly(ln.request.Host)
+		}
+		if len(ln.v) == 0 {
+			ln.v = "-"
+		}
+	}
+	return ln.v
+}
+
+// requestedServerName - %V
+func (ln *line) requestedServerName() string {
+	if len(ln.V) == 0 {
+		ln.V = ln.request.Host
+		if len(ln.V) == 0 {
+			ln.V = "-"
+		}
+	}
+	return ln.V
+}
+
+// portOnly returns the port of an address, or an empty string if there is none
+func portOnly(addr string) string {
+	if _, port, err := net.SplitHostPort(addr); err == nil {
+		return port
+	}
+	return ""
+}
+
+// hostOnly strips the port from an address, handling the bracketed IPv6 form
+func hostOnly(addr string) string {
+	if strings.IndexByte(addr, ':') < 0 {
+		return addr
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+// requestHeader - %{Header}i
+func (ln *line) requestHeader(name, missing string) string {
+	return ln.redact.headerValue(ln.request.Header, name, missing)
+}
+
+// responseHeader - %{Header}o
+func (ln *line) responseHeader(name, missing string) string {
+	return ln.redact.headerValue(ln.writer.Header(), name, missing)
+}
+
+// headerValue returns all the values of the header name joined with ", ", or missing if it is not present.
+// The name is in canonical form, see headerKey.
+func headerValue(h http.Header, name, missing string) string {
+	vv, ok := h[name]
+	switch {
+	case !ok || len(vv) == 0:
+		return missing
+	case len(vv) == 1:
+		return vv[0]
+	}
+	return strings.Join(vv, ", ")
+}
+
+// variable - %{key}e
+func (ln *line) variable(key string) string {
+	if v, ok := ln.request.Context().Value(varsContextKey).(*vars); ok {
+		if val, ok := v.get(key); ok {
+			return val
+		}
+	}
+	return "-"
+}
+
+// note - %{key}n
+func (ln *line) note(key string) string {
+	if v, ok := ln.request.Context().Value(varsContextKey).(*vars); ok {
+		if val, ok := v.field(key); ok {
+			return val
+		}
+	}
+	return "-"
+}
+
+// filename - %f
+func (ln *line) filename(resolve func(*http.Request) string) string {
+	if resolve != nil {
+		if f := resolve(ln.request); len(f) > 0 {
+			return f
+		}
+	}
+	return "-"
+}
+
+// requestID - %L
+func (ln *line) requestID() string {
+	if id := RequestID(ln.request.Context()); len(id) > 0 {
+		return id
+	}
+	return "-"
+}
+
 // username - %u
-func (ln *line) username() string {
+func (ln *line) username(userFunc func(*http.Request) string) string {
 	if len(ln.u) == 0 {
-		ln.u = "-"
-		if s := strings.SplitN(ln.request.Header.Get("Authorization"), " ", 2); len(s) == 2 {
-			if b, err := base64.StdEncoding.DecodeString(s[1]); err == nil {
-				if pair := strings.SplitN(string(b), ":", 2); len(pair) == 2 {
-					ln.u = pair[0]
-				}
-			}
+		if userFunc != nil {
+			ln.u = userFunc(ln.request)
+		}
+		if len(ln.u) == 0 {
+			ln.u, _, _ = ln.request.BasicAuth()
+		}
+		if len(ln.u) == 0 && ln.request.URL.User != nil {
+			ln.u = ln.request.URL.User.Username()
+		}
+		if len(ln.u) == 0 {
+			ln.u = "-"
 		}
 	}
 	return ln.u
 }
 
-//timeFormatted - %t
-func (ln *line) timeFormatted(format string) string {
-	if len(ln.t) == 0 {
-		ln.t = ln.time.Format(format)
+// timeFormatted - %t
+func (ln *line) timeFormatted(format string, cache *timeCache) string {
+	if len(ln.t) == 0 || ln.tLayout != format {
+		ln.tLayout = format
+		if cache != nil {
+			ln.t = cache.format(ln.time)
+		} else {
+			ln.t = ln.time.Format(format)
+		}
 	}
 	return ln.t
 }
 
+// timeCache holds the %t timestamp of the current second for a middleware instance,
+// so that only one time.Format call happens per second
+type timeCache struct {
+	layout string
+	last   atomic.Value // of cachedTime
+}
+
+type cachedTime struct {
+	unix      int64
+	formatted string
+}
+
+// newTimeCache returns a cache for the layout, or nil if the timestamps can't be
+// cached because a clock is injected or the layout has fractional seconds
+func newTimeCache(o *opt) *timeCache {
+	if o.Now != nil {
+		return nil
+	}
+	for _, frac := range []string{".0", ".9", ",0", ",9"} {
+		if strings.Contains(o.TimeFormat, frac) {
+			return nil
+		}
+	}
+	return &timeCache{layout: o.TimeFormat}
+}
+
+func (tc *timeCache) format(t time.Time) string {
+	unix := t.Unix()
+	if c, ok := tc.last.Load().(cachedTime); ok && c.unix == unix {
+		return c.formatted
+	}
+	formatted := t.Format(tc.layout)
+	tc.last.Store(cachedTime{unix: unix, formatted: formatted})
+	return formatted
+}
+
+// requestURI returns the request target with the redacted query parameters replaced
+func (ln *line) requestURI() string {
+	return ln.redact.uri(ln.rawRequestURI())
+}
+
+// rawRequestURI returns the request target as received, falling back to one built
+// from the URL for requests that were not read by a server
+func (ln *line) rawRequestURI() string {
+	if len(ln.request.RequestURI) > 0 {
+		return ln.request.RequestURI
+	}
+	return ln.request.URL.RequestURI()
+}
+
 // requestLine - %r
 func (ln *line) requestLine() string {
 	if len(ln.r) == 0 {
-		ln.r = strings.ToUpper(ln.request.Method) + " " + ln.request.URL.Path + " " + ln.request.Proto
+		ln.r = ln.request.Method + " " + ln.requestURI() + " " + ln.request.Proto
 	}
 	return ln.r
 }
 
-// status - %s
-func (ln *line) status() string {
-	if len(ln.s) == 0 {
-		ln.s = strconv.Itoa(ln.writer.status)
+// method - %m
+func (ln *line) method() string {
+	return ln.request.Method
+}
+
+// urlPath - %U
+func (ln *line) urlPath() string {
+	return ln.request.URL.Path
+}
+
+// queryString - %q
+func (ln *line) queryString() string {
+	if len(ln.request.URL.RawQuery) == 0 {
+		return ""
+	}
+	return "?" + ln.rawQuery()
+}
+
+// rawQuery returns the query of the URL, without the leading "?" and with the
+// redacted query parameters replaced
+func (ln *line) rawQuery() string {
+	return ln.redact.query(ln.request.URL.RawQuery)
+}
+
+// protocol - %H
+func (ln *line) protocol() string {
+	return ln.request.Proto
+}
+
+// finalStatus - %>s
+func (ln *line) finalStatus() string {
+	if len(ln.fs) == 0 {
+		ln.fs = strconv.Itoa(ln.writer.finalStatus)
+	}
+	return ln.fs
+}
+
+// bodyBytes returns the number of response body bytes sent, the server discards
+// anything written in response to a HEAD request
+func (ln *line) bodyBytes() int {
+	n, _ := ln.bodySize()
+	return n
+}
+
+// bodySize returns the number of response body bytes and whether it was taken
+// from the Content-Length header because none went through the middleware
+func (ln *line) bodySize() (int, bool) {
+	if ln.request.Method == http.MethodHead {
+		return 0, false
 	}
-	return ln.s
+	n := ln.writer.byteCount + int(atomic.LoadInt64(&ln.writer.hijackedBytes))
+	if n == 0 && ln.writer.lengthFallback {
+		if cl, err := strconv.Atoi(ln.writer.Header().Get("Content-Length")); err == nil && cl > 0 {
+			return cl, true
+		}
+	}
+	return n, false
+}
+
+// connectionStatus - %X
+// "X" when the client aborted the request before the response was complete,
+// "-" when the connection is closed after the response or was hijacked, "+" when it may be kept alive
+func (ln *line) connectionStatus() string {
+	if ln.writer.aborted {
+		return "X"
+	}
+	if ln.writer.hijacked || ln.request.Close || ln.writer.Header().Get("Connection") == "close" {
+		return "-"
+	}
+	return "+"
+}
+
+// bytesWritten - %b, "-" when no bytes were written
+func (ln *line) bytesWritten(dst []byte) []byte {
+	if n := ln.bodyBytes(); n > 0 {
+		return strconv.AppendInt(dst, int64(n), 10)
+	}
+	return append(dst, '-')
+}
+
+// bytesWrittenNumeric - %B
+func (ln *line) bytesWrittenNumeric(dst []byte) []byte {
+	return strconv.AppendInt(dst, int64(ln.bodyBytes()), 10)
 }
 
-// bytesWritten - %b
-func (ln *line) bytesWritten() string {
-	if len(ln.b) == 0 {
-		ln.b = strconv.Itoa(ln.writer.byteCount)
+// bytesReceived - %I
+// This is an estimate: the request line and headers are measured as Go parsed
+// them, and the body is counted as read by the handler (or Content-Length if it read nothing),
+// so transfer-encoding overhead such as chunk framing is not included.
+func (ln *line) bytesReceived(dst []byte) []byte {
+	n := int64(len(ln.request.Method) + len(ln.rawRequestURI()) + len(ln.request.Proto) + 4)
+	n += int64(headerSize(ln.request.Header))
+	if len(ln.request.Host) > 0 {
+		n += int64(len("Host: ") + len(ln.request.Host) + 2)
 	}
-	return ln.b
+	switch {
+	case ln.writer.body != nil && ln.writer.body.n.Load() > 0:
+		n += ln.writer.body.n.Load()
+	case ln.request.ContentLength > 0:
+		n += ln.request.ContentLength
+	}
+	return strconv.AppendInt(dst, n, 10)
 }
 
-// timeElapsed - %D
-func (ln *line) timeElapsed() string {
-	if len(ln.D) > 0 {
-		ln.D = time.Now().Sub(ln.writer.start).String()
+// bodyBytesRead - %{req}B
+// the request body bytes read by the handler through the body installed by the middleware
+func (ln *line) bodyBytesRead(dst []byte) []byte {
+	if ln.writer.body == nil {
+		return append(dst, '0')
 	}
-	return ln.D
+	return strconv.AppendInt(dst, ln.writer.body.n.Load(), 10)
 }
 
-// flatten takes two slices and merges them into one
-func flatten(o *opt, a, b []string) func(w *responseWriter, r *http.Request) string {
+// bytesSent - %O
+// This is an estimate: the headers are measured when the handler writes the status,
+// so headers added later by the server (Date, Content-Length) and chunk framing are not included.
+func (ln *line) bytesSent(dst []byte) []byte {
+	status := ln.writer.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	n := len(ln.request.Proto) + decimalLen(status) + len(http.StatusText(status)) + 4
+	n += ln.writer.headerBytes + ln.bodyBytes()
+	return strconv.AppendInt(dst, int64(n), 10)
+}
+
+// decimalLen returns the number of decimal digits of n, n >= 0
+func decimalLen(n int) int {
+	l := 1
+	for ; n >= 10; n /= 10 {
+		l++
+	}
+	return l
+}
+
+// extension - %{push}x, %{trace_id}x, %{tls_protocol}x
+func (ln *line) extension(name string, extract func(context.Context) (string, string)) string {
+	switch name {
+	case "push":
+		if len(ln.writer.pushes) > 0 {
+			return strings.Join(ln.writer.pushes, ",")
+		}
+	case "trace_id":
+		traceID, _ := ln.traceContext(extract)
+		return traceID
+	case "span_id":
+		_, spanID := ln.traceContext(extract)
+		return spanID
+	default:
+		if v, ok := tlsVariable(ln.request, name); ok {
+			return v
+		}
+	}
+	return "-"
+}
+
+// workerID - %{tid}P
+func (ln *line) workerID(counter *uint64) string {
+	if len(ln.tid) == 0 {
+		ln.tid = strconv.FormatUint(atomic.AddUint64(counter, 1), 10)
+	}
+	return ln.tid
+}
+
+// duration returns the time elapsed since the request started, computed once per line
+func (ln *line) duration() time.Duration {
+	if ln.elapsed == 0 {
+		ln.elapsed = ln.writer.end.Sub(ln.writer.start)
+	}
+	return ln.elapsed
+}
+
+// timeElapsed - %D, in microseconds
+func (ln *line) timeElapsed(dst []byte) []byte {
+	return strconv.AppendInt(dst, int64(ln.duration()/time.Microsecond), 10)
+}
+
+// timeToFirstByte - %^FB
+func (ln *line) timeToFirstByte(dst []byte) []byte {
+	if ln.writer.firstByte.IsZero() {
+		return append(dst, '-')
+	}
+	return strconv.AppendInt(dst, int64(ln.writer.firstByte.Sub(ln.writer.start)/time.Microsecond), 10)
+}
+
+// timeTaken - %T, %{s}T, %{ms}T, %{us}T
+// in the unit resolved by durationUnits, "-" for unknown units
+func (ln *line) timeTaken(dst []byte, unit time.Duration) []byte {
+	if unit == 0 {
+		return append(dst, '-')
+	}
+	return strconv.AppendInt(dst, int64(ln.duration()/unit), 10)
+}
+
+// durationUnits are the units of the %{unit}T directive
+var durationUnits = map[string]time.Duration{
+	"": time.Second, "s": time.Second, "ms": time.Millisecond, "us": time.Microsecond,
+}
+
+// condition restricts a directive to a set of final status codes, e.g. %400,501{User-agent}i or %!200,304{Referer}i
+type condition struct {
+	negate   bool
+	statuses []int
+}
+
+// match reports if the directive should be logged for status
+func (c *condition) match(status int) bool {
+	for _, s := range c.statuses {
+		if s == status {
+			return !c.negate
+		}
+	}
+	return c.negate
+}
+
+// splitCondition separates the status condition from a directive, returning the directive without it
+func splitCondition(s string) (string, *condition) {
+	if len(s) < 2 || s[0] != '%' {
+		return s, nil
+	}
+	end := 1
+	for end < len(s) && (s[end] == '!' || s[end] == ',' || (s[end] >= '0' && s[end] <= '9')) {
+		end++
+	}
+	if end == 1 {
+		return s, nil
+	}
+
+	c := new(condition)
+	list := s[1:end]
+	if list[0] == '!' {
+		c.negate = true
+		list = list[1:]
+	}
+	for _, code := range strings.Split(list, ",") {
+		if i, err := strconv.Atoi(code); err == nil {
+			c.statuses = append(c.statuses, i)
+		}
+	}
+	return "%" + s[end:], c
+}
+
+// unknownDirective returns what is logged for the unrecognized directive s
+func unknownDirective(mode UnknownDirective, s string) string {
+	switch mode {
+	case UnknownEcho:
+		return s
+	case UnknownMarker:
+		return "%!" + s[1:] + "(UNKNOWN)"
+	}
+	return ""
+}
+
+// flatten returns a function rendering the parsed format tokens into a log line
+func flatten(o *opt, tokens []token) func(w *responseWriter, r *http.Request) string {
+	render := compile(o, tokens)
+
 	return func(w *responseWriter, r *http.Request) string {
-		ln := new(line)
-		ln.withTime(o).withRequest(r).withResponse(w)
-
-		buf := new(bytes.Buffer)
-		for i, s := range a {
-			switch s {
-			case "":
-				buf.WriteString(b[i])
-			case "%h":
-				buf.WriteString(ln.remoteHostname())
-			case "%l":
-				buf.WriteString("-")
-			case "%u":
-				buf.WriteString(ln.username())
-			case "%t":
-				buf.WriteString(ln.timeFormatted("[02/01/2006:03:04:05 -0700]"))
-			case "%r":
-				buf.WriteString(ln.requestLine())
-			case "%s", "%>s":
-				buf.WriteString(ln.status())
-			case "%b":
-				buf.WriteString(ln.bytesWritten())
-			case "%D":
-				buf.WriteString(ln.timeElapsed())
-			default:
-				if len(s) > 4 && s[:2] == "%{" && s[len(s)-2] == '}' {
-					label := s[2 : len(s)-2]
-					switch s[len(s)-1] {
-					case 'i':
-						buf.WriteString(r.Header.Get(label))
-					case 't':
-						buf.WriteString(convertTimeFormat(ln.time, label))
-					}
+		ln, buf := newLine(o, w, r), getBuffer()
+		render(buf, ln)
+		s := buf.String()
+		putBuffer(buf)
+		ln.release()
+		return s
+	}
+}
+
+// compile returns a function rendering the parsed format tokens for the request
+// and response of ln into buf, so that several formats can share the values of one line
+func compile(o *opt, tokens []token) func(buf *bytes.Buffer, ln *line) {
+	pid := strconv.Itoa(os.Getpid())
+	var tid uint64
+	tc := newTimeCache(o)
+	decorate := decorators(o, tokens)
+	segments := compileSegments(tokens, o.Directives)
+	for i := range segments {
+		if seg := &segments[i]; seg.kind == kindRequestHeader || seg.kind == kindResponseHeader {
+			seg.arg = headerKey(seg.arg, o.HeaderUnderscores)
+		}
+	}
+
+	return func(buf *bytes.Buffer, ln *line) {
+		w, r := ln.writer, ln.request
+		for i := range segments {
+			seg := &segments[i]
+			if seg.kind == kindLiteral {
+				buf.WriteString(seg.literal)
+				continue
+			}
+			if seg.cond != nil && !seg.cond.match(w.finalStatus) {
+				buf.WriteString(o.EmptyValue)
+				continue
+			}
+			start := buf.Len()
+			switch seg.kind {
+			case kindRemoteHost:
+				buf.WriteString(o.Sanitize(ln.remoteHostname(o.TrustedProxies, o.Resolver)))
+			case kindRemoteIP:
+				buf.WriteString(o.Sanitize(ln.remoteIP(o.TrustedProxies)))
+			case kindLocalIP:
+				buf.WriteString(ln.localIP())
+			case kindServerName:
+				buf.WriteString(o.Sanitize(ln.serverName(o.ServerName)))
+			case kindRequestedServer:
+				buf.WriteString(o.Sanitize(ln.requestedServerName()))
+			case kindPort:
+				buf.WriteString(ln.port(seg.arg))
+			case kindPercent:
+				buf.WriteByte('%')
+			case kindRemoteLogname:
+				buf.WriteString(o.EmptyValue)
+			case kindUser:
+				buf.WriteString(o.Sanitize(ln.username(o.UserFunc)))
+			case kindTime:
+				buf.WriteString(ln.timeFormatted(o.TimeFormat, tc))
+			case kindTimeFormat:
+				buf.WriteString(convertTimeFormat(ln.time, seg.arg))
+			case kindRequestLine:
+				// written in parts, the spaces are never sanitized so the result is the same
+				buf.WriteString(o.Sanitize(ln.request.Method))
+				buf.WriteByte(' ')
+				buf.WriteString(o.Sanitize(ln.requestURI()))
+				buf.WriteByte(' ')
+				buf.WriteString(o.Sanitize(ln.request.Proto))
+			case kindMethod:
+				buf.WriteString(o.Sanitize(ln.method()))
+			case kindURLPath:
+				buf.WriteString(o.Sanitize(ln.urlPath()))
+			case kindQuery:
+				buf.WriteString(o.Sanitize(ln.queryString()))
+			case kindProtocol:
+				buf.WriteString(o.Sanitize(ln.protocol()))
+			case kindStatus:
+				buf.Write(strconv.AppendInt(buf.AvailableBuffer(), int64(w.status), 10))
+			case kindFinalStatus:
+				buf.Write(strconv.AppendInt(buf.AvailableBuffer(), int64(w.finalStatus), 10))
+			case kindBytesCLF:
+				buf.Write(ln.bytesWritten(buf.AvailableBuffer()))
+			case kindBytes:
+				buf.Write(ln.bytesWrittenNumeric(buf.AvailableBuffer()))
+			case kindBodyBytesRead:
+				buf.Write(ln.bodyBytesRead(buf.AvailableBuffer()))
+			case kindMicroseconds:
+				buf.Write(ln.timeElapsed(buf.AvailableBuffer()))
+			case kindDuration:
+				buf.Write(ln.timeTaken(buf.AvailableBuffer(), seg.unit))
+			case kindBytesReceived:
+				buf.Write(ln.bytesReceived(buf.AvailableBuffer()))
+			case kindBytesSent:
+				buf.Write(ln.bytesSent(buf.AvailableBuffer()))
+			case kindFilename:
+				buf.WriteString(o.Sanitize(ln.filename(o.FileResolver)))
+			case kindRequestID:
+				buf.WriteString(o.Sanitize(ln.requestID()))
+			case kindFirstByte:
+				buf.Write(ln.timeToFirstByte(buf.AvailableBuffer()))
+			case kindConnStatus:
+				buf.WriteString(ln.connectionStatus())
+			case kindPID:
+				buf.WriteString(pid)
+			case kindTID:
+				buf.WriteString(ln.workerID(&tid))
+			case kindRequestHeader:
+				buf.WriteString(o.Sanitize(ln.requestHeader(seg.arg, o.HeaderMissing)))
+			case kindResponseHeader:
+				buf.WriteString(o.Sanitize(ln.responseHeader(seg.arg, o.HeaderMissing)))
+			case kindEnv:
+				buf.WriteString(o.Sanitize(ln.variable(seg.arg)))
+			case kindNote:
+				buf.WriteString(o.Sanitize(ln.note(seg.arg)))
+			case kindForwarded:
+				buf.WriteString(o.Sanitize(ln.forwarded(o.TrustedProxies, seg.arg)))
+			case kindExtension:
+				buf.WriteString(o.Sanitize(ln.extension(seg.arg, o.TraceExtractor)))
+			case kindCustom:
+				buf.WriteString(o.Sanitize(seg.custom(w, r, seg.arg)))
+			case kindPlaceholder:
+				if d := seg.directive[len(seg.directive)-1]; d == 'i' || d == 'o' {
+					buf.WriteString(o.HeaderMissing)
+				} else {
+					buf.WriteByte('-')
 				}
+			default:
+				buf.WriteString(unknownDirective(o.Unknown, seg.directive))
+			}
+			// "-" is the value of the directives without a value, except for the connection status
+			if o.EmptyValue != "-" && buf.Len()-start == 1 && buf.Bytes()[start] == '-' && seg.kind != kindConnStatus {
+				buf.Truncate(start)
+				buf.WriteString(o.EmptyValue)
+			}
+			if decorate != nil && decorate[i] != nil {
+				v := decorate[i](string(buf.Bytes()[start:]))
+				buf.Truncate(start)
+				buf.WriteString(v)
 			}
 		}
-		return buf.String()
 	}
 }
 
@@ -297,75 +1561,241 @@ func flatten(o *opt, a, b []string) func(w *responseWriter, r *http.Request) str
 // This function more convenient to use when saving formatting to
 // a variable, then using with standard HTTP middleware
 func Format(format string) func(...optFunc) func(http.Handler) http.Handler {
+	// the format is parsed once, the tokens do not depend on the options
+	// and are shared by the middlewares of every call
+	tokens, _ := parseFormat(format, nil)
 	return func(opts ...optFunc) func(http.Handler) http.Handler {
-		return FormatWith(format, opts...)
+		return bindLogger(buildOpt(opts...), tokens).Wrap
 	}
 }
 
 // FormatWith accepts a format string using Apache formatting directives with
 // option functions and returns a function that can handle standard HTTP middleware.
+// Unknown directives and invalid options are ignored, use FormatWithStrict to have them reported.
 func FormatWith(format string, opts ...optFunc) func(http.Handler) http.Handler {
+	l, _ := newLogger(buildOpt(opts...), format, false)
+	return l.Wrap
+}
+
+// FormatWithStrict is like FormatWith, but returns an error describing the first
+// invalid option, or unknown or malformed directive in the format string.
+// New returns the same errors along with a Logger.
+func FormatWithStrict(format string, opts ...optFunc) (func(http.Handler) http.Handler, error) {
+	l, err := newLogger(buildOpt(opts...), format, true)
+	if err != nil {
+		return nil, err
+	}
+	return l.Wrap, nil
+}
+
+// buildOpt returns the default options with opts applied
+func buildOpt(opts ...optFunc) *opt {
 	options := newOpt()
 	for _, opt := range opts {
 		opt(options)
 	}
+	options.Colored = (options.ColorSet || options.DevLayout) && options.Color.colored(options.Output)
+	if options.BufferSize > 0 {
+		options.Output = newBufferedWriter(options)
+	}
+	return options
+}
 
-	var directives, betweens = make([]string, 0, 50), make([]string, 0, 50)
-	var cBuf *bytes.Buffer // current buffer
-	aBuf, bBuf := new(bytes.Buffer), new(bytes.Buffer)
-	cBuf = bBuf
+// record is the rendered lines of a request, it holds no reference to the request
+// or the response so that it can be written on another goroutine, see WithAsync
+type record struct {
+	ctx     context.Context // the request context, for the slog handler
+	status  int
+	line    string
+	hasLine bool // the line is written, it may be empty
+	slog    *slog.Record
+	entry   *LogEntry
+	slow    string // the terminated line of the slow log, if the request was slow
+}
 
-	var isDirective, isEnclosure bool
-	for i, r := range format {
-		switch r {
-		case '%':
-			if isDirective {
-				cBuf.WriteRune(r)
-				continue
-			}
-			isDirective = true
-			if i != 0 {
-				directives = append(directives, aBuf.String())
-				betweens = append(betweens, bBuf.String())
-				aBuf.Reset()
-				bBuf.Reset()
+// middleware returns the logging middleware writing the lines rendered by logFunc
+func middleware(options *opt, logFunc func(w *responseWriter, r *http.Request) string) func(http.Handler) http.Handler {
+	now := options.now
+	var preamble sync.Once
+
+	var startLog func(w *responseWriter, r *http.Request) string
+	if len(options.StartFormat) > 0 {
+		tokens, _ := parseFormat(options.StartFormat, options.Directives)
+		startLog = flatten(options, requestTokens(tokens, options.EmptyValue))
+	}
+
+	var progressLog func(w *responseWriter, r *http.Request) string
+	if options.InFlightInterval > 0 && options.Tokens != nil {
+		progressLog = flatten(options, progressTokens(options.Tokens, options.EmptyValue))
+	}
+
+	var slowLog func(w *responseWriter, r *http.Request) string
+	if options.SlowLog != nil {
+		slowLog = options.SlowLog.logFunc(options)
+	}
+
+	// render formats the lines kept by decide on the request goroutine, the record holds
+	// copies of the values of the request only so that it is written after the handler has returned
+	render := func(rw *responseWriter, r *http.Request) record {
+		rec := record{ctx: r.Context(), status: rw.finalStatus}
+		if rw.logSlow {
+			rec.slow = slowLog(rw, r)
+		}
+		if !rw.logLine {
+			return rec
+		}
+		// the line is rendered first so the entry tells whether it was truncated,
+		// slog renders it only when the level is enabled
+		var truncated bool
+		switch {
+		case options.EntryOnly:
+		case options.Slog != nil:
+			rec.slog = slogRecord(options, rw, r, logFunc)
+		default:
+			rec.line, truncated = truncateLine(logFunc(rw, r), options.MaxLineLength)
+			rec.hasLine = true
+		}
+		if options.EntryHandler != nil {
+			e := newEntry(options, rw, r)
+			e.Truncated = truncated
+			rec.entry = &e
+		}
+		return rec
+	}
+
+	// partial returns the record of a line s that is not the line of a finished request, such as
+	// a start line or the summary of WithRateLimit, written to the outputs of the finished lines
+	// but with no entry
+	partial := func(ctx context.Context, s string) record {
+		rec := record{ctx: ctx}
+		switch {
+		case options.EntryOnly:
+		case options.Slog != nil:
+			if options.Slog.Enabled(rec.ctx, options.SlogLevel) {
+				sr := slog.NewRecord(options.now(), options.SlogLevel, s, 0)
+				rec.slog = &sr
 			}
-			cBuf = aBuf
-		case '{':
-			isEnclosure = true
-		case '}':
-			isEnclosure = false
-		case '>':
-			// nothing - no change in status
 		default:
-			if isDirective && !isEnclosure && !unicode.IsLetter(r) {
-				isDirective = false
-				isEnclosure = false
-				if i != 0 {
-					directives = append(directives, aBuf.String())
-					betweens = append(betweens, bBuf.String())
-					aBuf.Reset()
-					bBuf.Reset()
-				}
-				cBuf = bBuf
+			rec.line, rec.hasLine = s, true
+		}
+		return rec
+	}
+
+	// emit writes the rendered lines to the outputs
+	emit := func(rec record) {
+		if len(rec.slow) > 0 {
+			options.SlowLog.write(options, rec.slow)
+		}
+		if rec.entry != nil {
+			options.EntryHandler(*rec.entry)
+		}
+		switch {
+		case rec.slog != nil:
+			options.Slog.Handler().Handle(rec.ctx, *rec.slog)
+		case !rec.hasLine:
+		case options.Syslog != nil:
+			options.Syslog.send(rec.status, rec.line)
+		default:
+			if options.Preamble != nil {
+				preamble.Do(func() { options.write([]byte(options.Preamble())) })
 			}
+			buf := options.terminated(rec.line)
+			options.writeLine(rec.status, buf.Bytes())
+			putBuffer(buf)
 		}
-		cBuf.WriteRune(r)
+	}
+	if options.AsyncSize > 0 {
+		options.Queue = newAsyncQueue(options, emit)
+		emit = options.Queue.send
 	}
 
-	directives = append(directives, aBuf.String())
-	betweens = append(betweens, bBuf.String())
-	aBuf.Reset()
-	bBuf.Reset()
+	// the lines about the log itself go where the lines go, in order
+	options.Notice = func(s string) {
+		if options.EntryOnly {
+			options.error(errors.New(s))
+			return
+		}
+		emit(partial(context.Background(), s))
+	}
 
-	logFunc := flatten(options, directives, betweens)
+	// decide makes the keep or drop decision of the lines of a request from its status,
+	// duration and request alone, so that nothing is formatted for the lines dropped
+	decide := func(rw *responseWriter, r *http.Request) {
+		mode := rw.vars.getMode()
+		if mode == logSuppressed {
+			return
+		}
+		rw.logSlow = options.SlowLog != nil && options.SlowLog.slow(rw)
+		if mode != logForced {
+			if options.Condition != nil && !options.Condition(rw.finalStatus, rw.end.Sub(rw.start), r) {
+				return
+			}
+			if !options.sample(rw, r) {
+				return
+			}
+		}
+		if options.RateLimit != nil {
+			ok, summary := options.RateLimit.allow(now())
+			if len(summary) > 0 {
+				options.Notice(summary)
+			}
+			if !ok {
+				return
+			}
+		}
+		rw.logLine = true
+	}
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			rw := &responseWriter{ResponseWriter: w}
+			rw := &responseWriter{ResponseWriter: w, now: now, hijackCounting: options.HijackCounting, lengthFallback: options.LengthFallback}
 			rw.startTime()
-			next.ServeHTTP(rw, r)
-			fmt.Fprintln(options.Output, logFunc(rw, r))
+			if options.Skip != nil && options.Skip(r) {
+				rw.skipped = true
+				next.ServeHTTP(rw, r)
+				return
+			}
+			r = withVars(r, options, &rw.vars)
+			rw.withCountingBody(r)
+			if options.EchoID && options.PropagateID {
+				rw.Header().Set(options.RequestIDHeader, RequestID(r.Context()))
+			}
+			if startLog != nil {
+				rw.end = rw.start
+				s, _ := truncateLine(startLog(rw, r), options.MaxLineLength)
+				emit(partial(r.Context(), s))
+			}
+			var progress *inFlight
+			if progressLog != nil {
+				progress = startInFlight(options, progressLog, func(s string) { emit(partial(r.Context(), s)) }, rw, r)
+				defer progress.stop()
+			}
+			var p any
+			var stack []byte
+			if options.RecoverPanics {
+				p, stack = serveRecover(next, rw, r)
+			} else {
+				next.ServeHTTP(rw, r)
+			}
+			if progress != nil {
+				progress.stop()
+			}
+			if p != nil {
+				options.recovered(rw, r, p, stack)
+			}
+			if r.Context().Err() == context.Canceled {
+				rw.aborted = true
+			}
+			rw.end = now()
+			if options.Collector != nil {
+				options.Collector.observe(rw, r)
+			}
+			if decide(rw, r); rw.logLine || rw.logSlow {
+				emit(render(rw, r))
+			}
+			if p != nil && !options.PanicResponse {
+				panic(p)
+			}
 		})
 	}
 }
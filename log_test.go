@@ -2,20 +2,23 @@ package accesslog
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
-// withTime sets the time to use when logging. This should be used only for testing
-func withTime(t time.Time) optFunc {
-	return func(o *opt) {
-		o.Time = t
-	}
-}
-
 func HandlerTesting(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
@@ -34,7 +37,7 @@ func TestLoggingMiddleware(t *testing.T) {
 	if err != nil {
 		t.Errorf("parse time error: %v", err)
 	}
-	aLog := FormatWith(ApacheCommonLogFormat, WithOutput(buf), withTime(tm))
+	aLog := FormatWith(ApacheCommonLogFormat, WithOutput(buf), WithTime(tm))
 	handler := aLog(http.HandlerFunc(HandlerTesting))
 
 	handler.ServeHTTP(rr, req)
@@ -56,6 +59,7 @@ func TestLoggingMiddlewareWithUser(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	req.RemoteAddr = "127.0.0.1:54321"
 	req.SetBasicAuth("Frank", "<none>")
 	rr := httptest.NewRecorder()
 	buf := new(bytes.Buffer)
@@ -63,12 +67,12 @@ func TestLoggingMiddlewareWithUser(t *testing.T) {
 	if err != nil {
 		t.Errorf("parse time error: %v", err)
 	}
-	aLog := ApacheCommonLog(WithOutput(buf), withTime(tm))
+	aLog := ApacheCommonLog(WithOutput(buf), WithTime(tm))
 	handler := aLog(http.HandlerFunc(HandlerTesting))
 
 	handler.ServeHTTP(rr, req)
 
-	want1 := `127.0.0.1 - Frank [03/02/2013:07:54:00 +0000] "GET /testing HTTP/1.1" 200 17` + "\n"
+	want1 := `127.0.0.1 - Frank [03/Feb/2013:19:54:00 +0000] "GET /testing HTTP/1.1" 200 17` + "\n"
 	if buf.String() != want1 {
 		t.Errorf("wrong log line: got %v expect %v", buf.String(), want1)
 	}
@@ -90,6 +94,7 @@ func TestLoggingMiddlewareCombined(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.RemoteAddr = "127.0.0.1:54321"
 
 	rr := httptest.NewRecorder()
 	buf := new(bytes.Buffer)
@@ -97,14 +102,14 @@ func TestLoggingMiddlewareCombined(t *testing.T) {
 	if err != nil {
 		t.Errorf("parse time error: %v", err)
 	}
-	aLog := ApacheCombinedLog(WithOutput(buf), withTime(tm))
+	aLog := ApacheCombinedLog(WithOutput(buf), WithTime(tm))
 	handler := aLog(http.HandlerFunc(HandlerTesting))
 	req.Header.Set("referer", "http://localhost/test")
 	req.Header.Set("user-agent", "Go testing")
 
 	handler.ServeHTTP(rr, req)
 
-	want1 := `127.0.0.1 - - [03/02/2013:07:54:00 +0000] "GET /testing HTTP/1.1" 200 17 "http://localhost/test" "Go testing"` + "\n"
+	want1 := `127.0.0.1 - - [03/Feb/2013:19:54:00 +0000] "GET /testing HTTP/1.1" 200 17 "http://localhost/test" "Go testing"` + "\n"
 	if buf.String() != want1 {
 		t.Errorf("wrong log line: got %v expect %v", buf.String(), want1)
 	}
@@ -132,7 +137,7 @@ func TestLoggingMiddlewareCustom(t *testing.T) {
 	if err != nil {
 		t.Errorf("parse time error: %v", err)
 	}
-	aLog := FormatWith("[%{%s %r}t] %b", WithOutput(buf), withTime(tm))
+	aLog := FormatWith("[%{%s %r}t] %b", WithOutput(buf), WithTime(tm))
 	handler := aLog(http.HandlerFunc(HandlerTesting))
 	req.Header.Set("referer", "http://localhost/test")
 	req.Header.Set("user-agent", "Go testing")
@@ -155,47 +160,1608 @@ func TestLoggingMiddlewareCustom(t *testing.T) {
 	}
 }
 
-func BenchmarkServeNone(b *testing.B) {
-	b.ReportAllocs()
+func TestLoggingMiddlewareRemoteIP(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		want       string
+	}{
+		{"192.0.2.10:54321", "192.0.2.10"},
+		{"[::1]:54321", "::1"},
+		{"192.0.2.10", "192.0.2.10"},
+		{"", "-"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = tt.remoteAddr
+
+		rr := httptest.NewRecorder()
+		buf := new(bytes.Buffer)
+		aLog := FormatWith(`%h %a "%r" %>s`, WithOutput(buf))
+		handler := aLog(http.HandlerFunc(HandlerTesting))
+		handler.ServeHTTP(rr, req)
+
+		want := tt.want + " " + tt.want + ` "GET /testing HTTP/1.1" 200` + "\n"
+		if buf.String() != want {
+			t.Errorf("wrong log line for %q: got %v expect %v", tt.remoteAddr, buf.String(), want)
+		}
+	}
+}
+
+func TestLoggingMiddlewareLocalIP(t *testing.T) {
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%A %a", WithOutput(buf))
+	ts := httptest.NewServer(aLog(http.HandlerFunc(HandlerTesting)))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	want := "127.0.0.1 127.0.0.1\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+}
+
+func TestLoggingMiddlewareLocalIPMissing(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	req, _ := http.NewRequest("GET", "/testing", nil)
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(HandlerTesting)
-	req.Header.Set("referer", "http://localhost/test")
-	req.Header.Set("user-agent", "Go testing")
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%A", WithOutput(buf))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+	handler.ServeHTTP(rr, req)
 
-	for i := 0; i < b.N; i++ {
+	want := "-\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+}
+
+func TestLoggingMiddlewarePort(t *testing.T) {
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%p %{canonical}p %{local}p %{remote}p", WithOutput(buf))
+	ts := httptest.NewServer(aLog(http.HandlerFunc(HandlerTesting)))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL+"/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "example.com:8080"
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	fields := strings.Fields(buf.String())
+	if len(fields) != 4 {
+		t.Fatalf("wrong log line: got %v", buf.String())
+	}
+	if fields[0] != "8080" || fields[1] != "8080" {
+		t.Errorf("wrong canonical port: got %v", buf.String())
+	}
+	if _, port, _ := net.SplitHostPort(ts.Listener.Addr().String()); fields[2] != port {
+		t.Errorf("wrong local port: got %v expect %v", fields[2], port)
+	}
+	if fields[3] == "-" || fields[3] == fields[2] {
+		t.Errorf("wrong remote port: got %v", fields[3])
+	}
+}
+
+func TestLoggingMiddlewarePortDefault(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://example.com/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%p %{local}p %{remote}p", WithOutput(buf))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+	handler.ServeHTTP(rr, req)
+
+	want := "80 - -\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+}
+
+func TestLoggingMiddlewareRequestParts(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"/testing?q=foo&page=2", "GET /testing?q=foo&page=2 HTTP/1.1 -> 200\n"},
+		{"/testing", "GET /testing HTTP/1.1 -> 200\n"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		buf := new(bytes.Buffer)
+		aLog := FormatWith("%m %U%q %H -> %>s", WithOutput(buf))
+		handler := aLog(http.HandlerFunc(HandlerTesting))
 		handler.ServeHTTP(rr, req)
+
+		if buf.String() != tt.want {
+			t.Errorf("wrong log line: got %v expect %v", buf.String(), tt.want)
+		}
 	}
 }
 
-func BenchmarkServe(b *testing.B) {
-	b.ReportAllocs()
+func TestLoggingMiddlewareServerName(t *testing.T) {
+	tests := []struct {
+		opts []optFunc
+		want string
+	}{
+		{nil, "example.com example.com:8443\n"},
+		{[]optFunc{WithServerName("www.example.com")}, "www.example.com example.com:8443\n"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "example.com:8443"
+
+		rr := httptest.NewRecorder()
+		buf := new(bytes.Buffer)
+		aLog := FormatWith("%v %V", append(tt.opts, WithOutput(buf))...)
+		handler := aLog(http.HandlerFunc(HandlerTesting))
+		handler.ServeHTTP(rr, req)
+
+		if buf.String() != tt.want {
+			t.Errorf("wrong log line: got %v expect %v", buf.String(), tt.want)
+		}
+	}
+}
+
+func TestLoggingMiddlewareVars(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	req, _ := http.NewRequest("GET", "/testing", nil)
 	rr := httptest.NewRecorder()
 	buf := new(bytes.Buffer)
-	tm, _ := time.Parse("Jan 2, 2006 at 3:04pm (MST)", "Feb 3, 2013 at 7:54pm (PST)")
-	aLog := FormatWith("[%{%s %r}t] %b %D", WithOutput(buf), withTime(tm))
+	aLog := FormatWith("%{tenant}e %{scope}e", WithOutput(buf))
+	handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetVar(r, "tenant", "acme")
+		if v := Var(r.Context(), "tenant"); v != "acme" {
+			t.Errorf("wrong var: got %v expect %v", v, "acme")
+		}
+		HandlerTesting(w, r)
+	}))
+	handler.ServeHTTP(rr, req)
+
+	want := "acme -\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+}
+
+func TestLoggingMiddlewareVarsContext(t *testing.T) {
+	type key struct{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "parent"))
+	req, err := http.NewRequestWithContext(ctx, "GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aLog := FormatWith("%{tenant}e", WithOutput(new(bytes.Buffer)))
+	handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the carrier of the vars wraps the context of the request
+		if v := r.Context().Value(key{}); v != "parent" {
+			t.Errorf("wrong context value: got %v expect %v", v, "parent")
+		}
+		child, stop := context.WithCancel(r.Context())
+		defer stop()
+		cancel()
+		select {
+		case <-child.Done():
+		case <-time.After(5 * time.Second):
+			t.Error("the cancellation of the request context was not propagated")
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func TestLoggingMiddlewarePooledLines(t *testing.T) {
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%a %r %{Referer}i %D", WithOutput(buf), WithNowFunc(func() time.Time { return time.Unix(0, 0) }))
 	handler := aLog(http.HandlerFunc(HandlerTesting))
-	req.Header.Set("referer", "http://localhost/test")
-	req.Header.Set("user-agent", "Go testing")
-	for i := 0; i < b.N; i++ {
+
+	// the values of a line must not leak into the next one rendered with the same pooled line
+	first := httptest.NewRequest("GET", "/first", nil)
+	first.RemoteAddr = "10.0.0.1:1234"
+	first.Header.Set("Referer", "http://example.com/")
+	handler.ServeHTTP(httptest.NewRecorder(), first)
+	second := httptest.NewRequest("POST", "/second", nil)
+	second.RemoteAddr = "10.0.0.2:1234"
+	handler.ServeHTTP(httptest.NewRecorder(), second)
+
+	want := "10.0.0.1 GET /first HTTP/1.1 http://example.com/ 0\n10.0.0.2 POST /second HTTP/1.1 - 0\n"
+	if buf.String() != want {
+		t.Errorf("wrong log lines: got %v expect %v", buf.String(), want)
+	}
+}
+
+func TestLoggingMiddlewareFields(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%{cache}n %{shard}n %{user}n", WithOutput(buf))
+	handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		AddField(r, "cache", "hit")
+		if v := Field(r.Context(), "cache"); v != "hit" {
+			t.Errorf("wrong field: got %v expect %v", v, "hit")
+		}
+		HandlerTesting(w, r)
+		AddField(r, "shard", "eu-1")
+	}))
+	handler.ServeHTTP(rr, req)
+
+	want := "hit eu-1 -\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+}
+
+func TestLoggingMiddlewareBodyBytesRead(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(w http.ResponseWriter, r *http.Request)
+		want    string
+	}{
+		{"unread", func(w http.ResponseWriter, r *http.Request) {}, "0\n"},
+		{"partial", func(w http.ResponseWriter, r *http.Request) {
+			io.ReadFull(r.Body, make([]byte, 4))
+		}, "4\n"},
+		{"all", func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+		}, "11\n"},
+		{"replaced", func(w http.ResponseWriter, r *http.Request) {
+			io.ReadFull(r.Body, make([]byte, 2))
+			r.Body = io.NopCloser(strings.NewReader("replacement"))
+			io.Copy(io.Discard, r.Body)
+		}, "2\n"},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("POST", "/testing", strings.NewReader("hello world"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		buf := new(bytes.Buffer)
+		var entry LogEntry
+		aLog := FormatWith("%{req}B", WithOutput(buf), WithEntryHandler(func(e LogEntry) { entry = e }))
+		handler := aLog(http.HandlerFunc(tt.handler))
 		handler.ServeHTTP(rr, req)
+
+		if buf.String() != tt.want {
+			t.Errorf("%s: wrong log line: got %v expect %v", tt.name, buf.String(), tt.want)
+		}
+		if got := strconv.FormatInt(entry.BytesRead, 10) + "\n"; got != tt.want {
+			t.Errorf("%s: wrong entry bytes read: got %v expect %v", tt.name, entry.BytesRead, tt.want)
+		}
 	}
 }
 
-func BenchmarkServeRebuild(b *testing.B) {
-	b.ReportAllocs()
+// writeRecorder records each call to Write
+type writeRecorder struct {
+	writes []string
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, string(p))
+	return len(p), nil
+}
+
+func TestLoggingMiddlewareLineTerminator(t *testing.T) {
+	tests := []struct {
+		opts []optFunc
+		want string
+	}{
+		{nil, "GET /testing\n"},
+		{[]optFunc{WithLineTerminator("\r\n")}, "GET /testing\r\n"},
+		{[]optFunc{WithLineTerminator("")}, "GET /testing"},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out := new(writeRecorder)
+		aLog := FormatWith("%m %U", append(tt.opts, WithOutput(out))...)
+		handler := aLog(http.HandlerFunc(HandlerTesting))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if len(out.writes) != 1 || out.writes[0] != tt.want {
+			t.Errorf("wrong log line: got %q expect %q", out.writes, tt.want)
+		}
+	}
+}
+
+func TestFormatShared(t *testing.T) {
+	// the middlewares of one Format value share its parsed format, bound concurrently to different options
+	shared := Format("%v %U %{tenant}z")
+	var wg sync.WaitGroup
+	bufs := make([]*bytes.Buffer, 8)
+	for i := range bufs {
+		bufs[i] = new(bytes.Buffer)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := "server" + strconv.Itoa(i)
+			aLog := shared(WithOutput(bufs[i]), WithServerName(name),
+				WithDirective('z', func(w ResponseInfo, r *http.Request, arg string) string { return arg + "-" + name }))
+			aLog(http.HandlerFunc(HandlerTesting)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/testing", nil))
+		}()
+	}
+	wg.Wait()
+
+	for i, buf := range bufs {
+		want := "server" + strconv.Itoa(i) + " /testing tenant-server" + strconv.Itoa(i) + "\n"
+		if buf.String() != want {
+			t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+		}
+	}
+}
+
+func TestTruncateLine(t *testing.T) {
+	tests := []struct {
+		s         string
+		max       int
+		want      string
+		truncated bool
+	}{
+		{"short", 0, "short", false},
+		{"short", 5, "short", false},
+		{"abcdefghijklmnopqrstuvwxyz", 20, "abcdef" + TruncatedMarker, true},
+		{"abcdeé" + strings.Repeat("x", 20), 20, "abcde" + TruncatedMarker, true},
+		{"abcdefghijklmnopqrstuvwxyz", 4, "...(", true},
+	}
+	for _, tt := range tests {
+		got, truncated := truncateLine(tt.s, tt.max)
+		if got != tt.want || truncated != tt.truncated {
+			t.Errorf("wrong truncated line: got %q %v expect %q %v", got, truncated, tt.want, tt.truncated)
+		}
+	}
+}
+
+func TestLoggingMiddlewareMaxLineLength(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Referer", strings.Repeat("\x01", 1000))
+
+	buf := new(bytes.Buffer)
+	var entry LogEntry
+	aLog := FormatWith("%U %{Referer}i", WithOutput(buf), WithMaxLineLength(40),
+		WithEntryHandler(func(e LogEntry) { entry = e }))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// the header is escaped before the line is cut
+	want := `/testing \x01\x01\x01\x01` + TruncatedMarker + "\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+	if !entry.Truncated {
+		t.Error("truncated line not flagged in the entry")
+	}
+}
+
+func TestLoggingMiddlewareEmptyValue(t *testing.T) {
+	tests := []struct {
+		opts []optFunc
+		want string
+	}{
+		{nil, "- - - - - - - /testing\n"},
+		{[]optFunc{WithEmptyValue("")}, "      - /testing\n"},
+		{[]optFunc{WithEmptyValue("null")}, "null null null null null null - /testing\n"},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Close = true
+
+		buf := new(bytes.Buffer)
+		aLog := FormatWith("%l %u %b %{X-Missing}i %{tls_protocol}x %404{User-Agent}i %X %U", append(tt.opts, WithOutput(buf))...)
+		handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if buf.String() != tt.want {
+			t.Errorf("wrong log line: got %q expect %q", buf.String(), tt.want)
+		}
+	}
+}
+
+func TestLoggingMiddlewarePresets(t *testing.T) {
+	tm, err := time.Parse("Jan 2, 2006 at 3:04pm (MST)", "Feb 3, 2013 at 7:54pm (PST)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// %I is the request line, the Referer, User-Agent and Host headers and the blank line,
+	// %O the status line, the blank line and the body
+	tests := []struct {
+		preset func(...optFunc) func(http.Handler) http.Handler
+		want   string
+	}{
+		{ApacheCombinedIOLog, `127.0.0.1 - - [03/Feb/2013:19:54:00 +0000] "GET /testing HTTP/1.1" 200 17 "http://localhost/test" "Go testing" 105 36`},
+		{ApacheVhostCombinedLog, `example.com:8080 127.0.0.1 - - [03/Feb/2013:19:54:00 +0000] "GET /testing HTTP/1.1" 200 36 "http://localhost/test" "Go testing"`},
+		{ApacheRefererLog, `http://localhost/test -> /testing`},
+		{ApacheAgentLog, `Go testing`},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "http://example.com:8080/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "127.0.0.1:54321"
+		req.Header.Set("Referer", "http://localhost/test")
+		req.Header.Set("User-Agent", "Go testing")
+
+		buf := new(bytes.Buffer)
+		handler := tt.preset(WithOutput(buf), WithTime(tm))(http.HandlerFunc(HandlerTesting))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if buf.String() != tt.want+"\n" {
+			t.Errorf("wrong log line: got %v expect %v", buf.String(), tt.want)
+		}
+	}
+}
+
+func TestLoggingMiddlewareTimeTaken(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	req, _ := http.NewRequest("GET", "/testing", nil)
 	rr := httptest.NewRecorder()
 	buf := new(bytes.Buffer)
-	tm, _ := time.Parse("Jan 2, 2006 at 3:04pm (MST)", "Feb 3, 2013 at 7:54pm (PST)")
-	aLog := FormatWith(ApacheCombinedLogFormat, WithOutput(buf), withTime(tm))
+	aLog := FormatWith("%T %{s}T %{ms}T %{us}T", WithOutput(buf))
+	handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		HandlerTesting(w, r)
+	}))
+	handler.ServeHTTP(rr, req)
+
+	fields := strings.Fields(buf.String())
+	if len(fields) != 4 {
+		t.Fatalf("wrong log line: got %v", buf.String())
+	}
+	if fields[0] != "0" || fields[1] != "0" {
+		t.Errorf("wrong seconds: got %v", buf.String())
+	}
+	ms, err := strconv.Atoi(fields[2])
+	if err != nil || ms < 20 {
+		t.Errorf("wrong milliseconds: got %v", fields[2])
+	}
+	us, err := strconv.Atoi(fields[3])
+	if err != nil || us < 20000 || us/1000 != ms {
+		t.Errorf("wrong microseconds: got %v", fields[3])
+	}
+}
+
+func TestLoggingMiddlewarePid(t *testing.T) {
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%P %{pid}P %{tid}P", WithOutput(buf))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+
+	for i := 1; i <= 2; i++ {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	pid := strconv.Itoa(os.Getpid())
+	want := pid + " " + pid + " 1\n" + pid + " " + pid + " 2\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+}
+
+func TestLoggingMiddlewareRequestID(t *testing.T) {
+	tests := []struct {
+		opts   []optFunc
+		header string
+		want   string
+	}{
+		{[]optFunc{WithIDGenerator(func(*http.Request) string { return "abc" })}, "", "abc"},
+		{[]optFunc{WithRequestIDHeader("X-Request-Id")}, "inbound-id", "inbound-id"},
+		{[]optFunc{WithRequestIDHeader("X-Request-Id"), WithIDGenerator(func(*http.Request) string { return "abc" })}, "", "abc"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tt.header) > 0 {
+			req.Header.Set("X-Request-Id", tt.header)
+		}
+
+		var fromHandler string
+		buf := new(bytes.Buffer)
+		aLog := FormatWith("%L", append(tt.opts, WithOutput(buf))...)
+		handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fromHandler = RequestID(r.Context())
+			HandlerTesting(w, r)
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if buf.String() != tt.want+"\n" {
+			t.Errorf("wrong log line: got %v expect %v", buf.String(), tt.want)
+		}
+		if fromHandler != tt.want {
+			t.Errorf("wrong request id in handler: got %v expect %v", fromHandler, tt.want)
+		}
+	}
+}
+
+func TestLoggingMiddlewareRequestIDDefault(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%L", WithOutput(buf))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if id := strings.TrimSpace(buf.String()); len(id) != 32 {
+		t.Errorf("wrong request id: got %v", id)
+	}
+}
+
+func TestLoggingMiddlewarePropagateRequestID(t *testing.T) {
+	gen := func() string { return "generated" }
+	tests := []struct {
+		opts   []optFunc
+		header string
+		want   string
+		echo   string
+	}{
+		{[]optFunc{WithRequestID("X-Request-Id", gen)}, "", "generated", ""},
+		{[]optFunc{WithRequestID("X-Request-Id", gen)}, "inbound-id", "inbound-id", ""},
+		{[]optFunc{WithRequestID("X-Request-Id", gen), WithRequestIDResponseHeader()}, "", "generated", "generated"},
+		{[]optFunc{WithRequestID("X-Request-Id", gen), WithRequestIDResponseHeader()}, "inbound-id", "inbound-id", "inbound-id"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tt.header) > 0 {
+			req.Header.Set("X-Request-Id", tt.header)
+		}
+
+		var fromHandler string
+		rr := httptest.NewRecorder()
+		buf := new(bytes.Buffer)
+		aLog := FormatWith("%L %{X-Request-Id}i", append(tt.opts, WithOutput(buf))...)
+		handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fromHandler = r.Header.Get("X-Request-Id")
+			HandlerTesting(w, r)
+		}))
+		handler.ServeHTTP(rr, req)
+
+		want := tt.want + " " + tt.want + "\n"
+		if buf.String() != want {
+			t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+		}
+		if fromHandler != tt.want {
+			t.Errorf("wrong request header in handler: got %v expect %v", fromHandler, tt.want)
+		}
+		if got := rr.Header().Get("X-Request-Id"); got != tt.echo {
+			t.Errorf("wrong response header: got %v expect %v", got, tt.echo)
+		}
+		if got := req.Header.Get("X-Request-Id"); got != tt.header {
+			t.Errorf("caller's request modified: got %v expect %v", got, tt.header)
+		}
+	}
+}
+
+func TestLoggingMiddlewareByteCounts(t *testing.T) {
+	req, err := http.NewRequest("POST", "/testing", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Test", "1")
+
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%I %O", WithOutput(buf))
+	handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		w.Header().Set("X-Test", "1")
+		HandlerTesting(w, r)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// "POST /testing HTTP/1.1\r\n" + "X-Test: 1\r\n" + "\r\n" + "hello"
+	// "HTTP/1.1 200 OK\r\n" + "X-Test: 1\r\n" + "\r\n" + `{"testing": true}`
+	want := "42 47\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+}
+
+func TestLoggingMiddlewareFilename(t *testing.T) {
+	resolver := WithFileResolver(func(r *http.Request) string {
+		return filepath.Join("/var/www", filepath.FromSlash(path.Clean(r.URL.Path)))
+	})
+	tests := []struct {
+		opts []optFunc
+		path string
+		want string
+	}{
+		{nil, "/testing", "-\n"},
+		{[]optFunc{resolver}, "/testing", "/var/www/testing\n"},
+		{[]optFunc{resolver}, "/a%0aFAKE", "/var/www/a\\x0aFAKE\n"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		aLog := FormatWith("%f", append(tt.opts, WithOutput(buf))...)
+		handler := aLog(http.HandlerFunc(HandlerTesting))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if buf.String() != tt.want {
+			t.Errorf("wrong log line: got %v expect %v", buf.String(), tt.want)
+		}
+	}
+}
+
+func TestLoggingMiddlewareTimeToFirstByte(t *testing.T) {
+	tests := []struct {
+		handler http.HandlerFunc
+		check   func(string) bool
+	}{
+		{func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(10 * time.Millisecond)
+			HandlerTesting(w, r)
+		}, func(s string) bool {
+			n, err := strconv.Atoi(s)
+			return err == nil && n >= 10000
+		}},
+		{func(w http.ResponseWriter, r *http.Request) {}, func(s string) bool {
+			return s == "-"
+		}},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		aLog := FormatWith("[%^FB]", WithOutput(buf))
+		handler := aLog(tt.handler)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		got := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(buf.String()), "["), "]")
+		if !tt.check(got) {
+			t.Errorf("wrong log line: got %v", buf.String())
+		}
+	}
+}
+
+func TestLoggingMiddlewareTimeFractions(t *testing.T) {
+	tm := time.Date(2013, time.February, 3, 19, 54, 0, 123456789, time.UTC)
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"%{sec}t", "1359921240"},
+		{"%{msec}t", "1359921240123"},
+		{"%{usec}t", "1359921240123456"},
+		{"%{%H:%M:%S}t.%{msec_frac}t", "19:54:00.123"},
+		{"%{%H:%M:%S}t.%{usec_frac}t", "19:54:00.123456"},
+		{"%{%d/%b/%Y:%H:%M:%S.%{msec_frac}t %Z}t", "03/Feb/2013:19:54:00.123 UTC"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		aLog := FormatWith(tt.format, WithOutput(buf), WithTime(tm))
+		handler := aLog(http.HandlerFunc(HandlerTesting))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if buf.String() != tt.want+"\n" {
+			t.Errorf("wrong log line for %q: got %v expect %v", tt.format, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestLoggingMiddlewareConditional(t *testing.T) {
+	tests := []struct {
+		status int
+		want   string
+	}{
+		{http.StatusOK, `- - 200`},
+		{http.StatusBadRequest, `agent agent 400`},
+		{http.StatusNotImplemented, `agent agent 501`},
+		{http.StatusNotFound, `- agent 404`},
+		{http.StatusNotModified, `- - 304`},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("user-agent", "agent")
+
+		buf := new(bytes.Buffer)
+		aLog := FormatWith(`%400,501{User-agent}i %!200,304{User-agent}i %>s`, WithOutput(buf))
+		handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if buf.String() != tt.want+"\n" {
+			t.Errorf("wrong log line: got %v expect %v", buf.String(), tt.want)
+		}
+	}
+}
+
+func TestLoggingMiddlewareUsername(t *testing.T) {
+	tests := []struct {
+		auth string
+		url  string
+		opts []optFunc
+		want string
+	}{
+		{"basic " + base64.StdEncoding.EncodeToString([]byte("Frank:<none>")), "/testing", nil, "Frank"},
+		{"Basic not-base64!", "/testing", nil, "-"},
+		{"Bearer abc", "/testing", nil, "-"},
+		{"", "http://Frank@example.com/testing", nil, "Frank"},
+		{"Bearer abc", "/testing", []optFunc{WithUserFunc(func(r *http.Request) string {
+			return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		})}, "abc"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tt.auth) > 0 {
+			req.Header.Set("Authorization", tt.auth)
+		}
+
+		buf := new(bytes.Buffer)
+		aLog := FormatWith("%u", append(tt.opts, WithOutput(buf))...)
+		handler := aLog(http.HandlerFunc(HandlerTesting))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if buf.String() != tt.want+"\n" {
+			t.Errorf("wrong log line for %q: got %v expect %v", tt.auth, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestLoggingMiddlewareFinalStatus(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%s %>s", WithOutput(buf))
+	override := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r)
+			w.WriteHeader(http.StatusInternalServerError)
+		})
+	}
+	handler := aLog(override(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	want := "200 500\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+}
+
+func TestLoggingMiddlewareElapsed(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%D", WithOutput(buf))
+	handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		HandlerTesting(w, r)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if us, err := strconv.Atoi(strings.TrimSpace(buf.String())); err != nil || us < 10000 {
+		t.Errorf("wrong log line: got %v expect at least 10000", buf.String())
+	}
+}
+
+func TestLoggingMiddlewareNoContent(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%>s %b %B", WithOutput(buf))
+	handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	want := "204 - 0\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+}
+
+func TestLoggingMiddlewareHead(t *testing.T) {
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%m %>s %b %B", WithOutput(buf))
+	ts := httptest.NewServer(aLog(http.HandlerFunc(HandlerTesting)))
+	defer ts.Close()
+
+	res, err := http.Head(ts.URL + "/testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	want := "HEAD 200 - 0\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+}
+
+func TestLoggingMiddlewareTimeFormat(t *testing.T) {
+	tm := time.Date(2013, time.February, 3, 7, 54, 0, 0, time.UTC)
+	tests := []struct {
+		opts []optFunc
+		want string
+	}{
+		{nil, "[03/Feb/2013:07:54:00 +0000]"},
+		{[]optFunc{WithTimeFormat(time.RFC3339)}, "2013-02-03T07:54:00Z"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		aLog := FormatWith("%t", append(tt.opts, WithOutput(buf), WithTime(tm))...)
+		handler := aLog(http.HandlerFunc(HandlerTesting))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if buf.String() != tt.want+"\n" {
+			t.Errorf("wrong log line: got %v expect %v", buf.String(), tt.want)
+		}
+	}
+}
+
+func TestLoggingMiddlewareTimeFormats(t *testing.T) {
+	tm := time.Date(2013, time.February, 3, 7, 54, 0, 0, time.UTC)
+	req, err := http.NewRequest("GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every time directive of the line is rendered with its own format
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%t %{%Y-%m-%d}t %{%H:%M}t %t %{%Y-%m-%d}t", WithOutput(buf), WithTime(tm))
+	aLog(http.HandlerFunc(HandlerTesting)).ServeHTTP(httptest.NewRecorder(), req)
+
+	want := "[03/Feb/2013:07:54:00 +0000] 2013-02-03 07:54 [03/Feb/2013:07:54:00 +0000] 2013-02-03\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+
+	// the memoized %t is not reused for another layout
+	ln := &line{time: tm}
+	for _, layout := range []string{time.RFC3339, time.Kitchen, time.RFC3339} {
+		if got, want := ln.timeFormatted(layout, nil), tm.Format(layout); got != want {
+			t.Errorf("wrong time for %q: got %v expect %v", layout, got, want)
+		}
+	}
+}
+
+func TestLoggingMiddlewareRequestLine(t *testing.T) {
+	tests := []struct {
+		method, uri string
+		want        string
+	}{
+		{"GET", "/search?q=foo&page=2", "GET /search?q=foo&page=2 HTTP/1.1"},
+		{"GET", "/caf%C3%A9/a%2Fb", "GET /caf%C3%A9/a%2Fb HTTP/1.1"},
+		{"OPTIONS", "*", "OPTIONS * HTTP/1.1"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.uri, nil)
+
+		buf := new(bytes.Buffer)
+		aLog := FormatWith("%r", WithOutput(buf))
+		handler := aLog(http.HandlerFunc(HandlerTesting))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if buf.String() != tt.want+"\n" {
+			t.Errorf("wrong log line: got %v expect %v", buf.String(), tt.want)
+		}
+	}
+}
+
+func TestLoggingMiddlewareMissingHeader(t *testing.T) {
+	tests := []struct {
+		opts    []optFunc
+		referer []string
+		want    string
+	}{
+		{nil, nil, `"-" "Go testing"`},
+		{nil, []string{""}, `"" "Go testing"`},
+		{[]optFunc{WithHeaderPlaceholder("")}, nil, `"" "Go testing"`},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.referer != nil {
+			req.Header["Referer"] = tt.referer
+		}
+		req.Header.Set("User-Agent", "Go testing")
+
+		buf := new(bytes.Buffer)
+		aLog := FormatWith(`"%{Referer}i" "%{User-agent}i"`, append(tt.opts, WithOutput(buf))...)
+		handler := aLog(http.HandlerFunc(HandlerTesting))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if buf.String() != tt.want+"\n" {
+			t.Errorf("wrong log line: got %v expect %v", buf.String(), tt.want)
+		}
+	}
+}
+
+func TestLoggingMiddlewareMultipleHeaders(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Via", "1.1 proxy-a")
+	req.Header.Add("Via", "1.1 proxy-b")
+
+	buf := new(bytes.Buffer)
+	aLog := FormatWith(`"%{via}i" "%{VIA}i" "%{cache-control}o" "%{X-Missing}o"`, WithOutput(buf))
+	handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Cache-Control", "no-cache")
+		w.Header().Add("Cache-Control", "no-store")
+		HandlerTesting(w, r)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	want := `"1.1 proxy-a, 1.1 proxy-b" "1.1 proxy-a, 1.1 proxy-b" "no-cache, no-store" "-"` + "\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+}
+
+func TestLoggingMiddlewareHeaderNames(t *testing.T) {
+	tests := []struct {
+		opts []optFunc
+		want string
+	}{
+		{nil, `"Go testing" "https://example.com" "-" "-"` + "\n"},
+		{[]optFunc{WithHeaderUnderscores()}, `"Go testing" "https://example.com" "10.0.0.1" "no-cache"` + "\n"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("User-Agent", "Go testing")
+		req.Header.Set("Referer", "https://example.com")
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+
+		buf := new(bytes.Buffer)
+		aLog := FormatWith(`"%{user-agent}i" "%{REFERER}i" "%{X_Forwarded_For}i" "%{cache_control}o"`, append(tt.opts, WithOutput(buf))...)
+		handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "no-cache")
+			HandlerTesting(w, r)
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if buf.String() != tt.want {
+			t.Errorf("wrong log line: got %v expect %v", buf.String(), tt.want)
+		}
+	}
+}
+
+func TestLoggingMiddlewarePercent(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"%%", "%"},
+		{"100%% %s", "100% 200"},
+		{"%% complete", "% complete"},
+		{"%%s", "%s"},
+		{"%s %", "200 %"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		aLog := FormatWith(tt.format, WithOutput(buf))
+		handler := aLog(http.HandlerFunc(HandlerTesting))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if buf.String() != tt.want+"\n" {
+			t.Errorf("wrong log line for %q: got %v expect %v", tt.format, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestLoggingMiddlewareUnknownDirective(t *testing.T) {
+	tests := []struct {
+		opts []optFunc
+		want string
+	}{
+		{nil, "200  \n"},
+		{[]optFunc{WithUnknownDirective(UnknownDrop)}, "200  \n"},
+		{[]optFunc{WithUnknownDirective(UnknownEcho)}, "200 %z %{foo}y\n"},
+		{[]optFunc{WithUnknownDirective(UnknownMarker)}, "200 %!z(UNKNOWN) %!{foo}y(UNKNOWN)\n"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		aLog := FormatWith("%s %z %{foo}y", append(tt.opts, WithOutput(buf))...)
+		handler := aLog(http.HandlerFunc(HandlerTesting))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if buf.String() != tt.want {
+			t.Errorf("wrong log line: got %q expect %q", buf.String(), tt.want)
+		}
+	}
+}
+
+func TestLoggingMiddlewareFormatEdges(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"prefix %s", "prefix 200"},
+		{"%s", "200"},
+		{"%s %{User-agent}i", "200 Go testing"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("User-Agent", "Go testing")
+
+		buf := new(bytes.Buffer)
+		aLog := FormatWith(tt.format, WithOutput(buf))
+		handler := aLog(http.HandlerFunc(HandlerTesting))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if buf.String() != tt.want+"\n" {
+			t.Errorf("wrong log line for %q: got %v expect %v", tt.format, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestConvertTimeFormat(t *testing.T) {
+	tm := time.Date(2013, time.February, 3, 7, 54, 0, 0, time.FixedZone("PST", -8*60*60))
+
+	// expected values are the output of C strftime for the same time
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"%z", "-0800"},
+		{"%k", " 7"},
+		{"%C", "20"},
+		{"%Y-%m-%d %H:%M:%S %z", "2013-02-03 07:54:00 -0800"},
+	}
+
+	for _, tt := range tests {
+		if got := convertTimeFormat(tm, tt.format); got != tt.want {
+			t.Errorf("wrong time for %q: got %q expect %q", tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestConvertTimeFormatWeeks(t *testing.T) {
+	// expected values are the output of C strftime for the same time
+	tests := []struct {
+		date string
+		want string
+	}{
+		{"2012-01-01", "01 00|Sun Jan  1 13:04:05 2012|01/01/12|13:04:05"},
+		{"2012-12-31", "53 53|Mon Dec 31 13:04:05 2012|12/31/12|13:04:05"},
+		{"2013-01-01", "00 00|Tue Jan  1 13:04:05 2013|01/01/13|13:04:05"},
+		{"2017-01-01", "01 00|Sun Jan  1 13:04:05 2017|01/01/17|13:04:05"},
+		{"2018-12-30", "52 52|Sun Dec 30 13:04:05 2018|12/30/18|13:04:05"},
+	}
+
+	for _, tt := range tests {
+		tm, err := time.Parse("2006-01-02 15:04:05", tt.date+" 13:04:05")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := convertTimeFormat(tm, "%U %W|%c|%x|%X"); got != tt.want {
+			t.Errorf("wrong time for %v: got %q expect %q", tt.date, got, tt.want)
+		}
+	}
+}
+
+func TestLoggingMiddlewareLocation(t *testing.T) {
+	tm := time.Date(2013, time.February, 3, 19, 54, 0, 0, time.FixedZone("PST", -8*60*60))
+	tests := []struct {
+		opts []optFunc
+		want string
+	}{
+		{nil, "[03/Feb/2013:19:54:00 -0800] 2013-02-03T19:54:00-0800"},
+		{[]optFunc{WithUTC()}, "[04/Feb/2013:03:54:00 +0000] 2013-02-04T03:54:00+0000"},
+		{[]optFunc{WithLocation(time.FixedZone("JST", 9*60*60))}, "[04/Feb/2013:12:54:00 +0900] 2013-02-04T12:54:00+0900"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		aLog := FormatWith("%t %{%Y-%m-%dT%H:%M:%S%z}t", append(tt.opts, WithOutput(buf), WithTime(tm))...)
+		handler := aLog(http.HandlerFunc(HandlerTesting))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if buf.String() != tt.want+"\n" {
+			t.Errorf("wrong log line: got %v expect %v", buf.String(), tt.want)
+		}
+	}
+}
+
+func TestLoggingMiddlewareNowFunc(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := time.Date(2013, time.February, 3, 19, 54, 0, 0, time.UTC)
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%t %D %^FB", WithOutput(buf), WithNowFunc(func() time.Time { return clock }))
+	handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clock = clock.Add(100 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+		clock = clock.Add(150 * time.Millisecond)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	want := "[03/Feb/2013:19:54:00 +0000] 250000 100000\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+}
+
+func TestTimeCache(t *testing.T) {
+	tc := newTimeCache(newOpt())
+	tm := time.Date(2013, time.February, 3, 19, 54, 0, 0, time.UTC)
+
+	tests := []struct {
+		tm   time.Time
+		want string
+	}{
+		{tm, "[03/Feb/2013:19:54:00 +0000]"},
+		{tm.Add(500 * time.Millisecond), "[03/Feb/2013:19:54:00 +0000]"},
+		{tm.Add(time.Second), "[03/Feb/2013:19:54:01 +0000]"},
+	}
+	for _, tt := range tests {
+		if got := tc.format(tt.tm); got != tt.want {
+			t.Errorf("wrong time: got %v expect %v", got, tt.want)
+		}
+	}
+
+	if newTimeCache(&opt{TimeFormat: "15:04:05.000"}) != nil {
+		t.Errorf("fractional second layouts must not be cached")
+	}
+	if newTimeCache(&opt{TimeFormat: CommonLogTimeFormat, Now: time.Now}) != nil {
+		t.Errorf("injected clocks must not be cached")
+	}
+}
+
+func TestLoggingMiddlewareConcurrentLines(t *testing.T) {
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%U %U %U", WithOutput(buf))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+
+	const requests = 500
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "/"+strconv.Itoa(i)+"/"+strings.Repeat("x", 512), nil)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for _, l := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		f := strings.Fields(l)
+		if len(f) != 3 || f[0] != f[1] || f[1] != f[2] || seen[f[0]] {
+			t.Fatalf("wrong log line: got %.80v", l)
+		}
+		seen[f[0]] = true
+	}
+	if len(seen) != requests {
+		t.Errorf("wrong number of lines: got %v expect %v", len(seen), requests)
+	}
+}
+
+func TestLoggingMiddlewareStartLine(t *testing.T) {
+	req, err := http.NewRequest("GET", "/upload", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.TLS = &tls.ConnectionState{Version: tls.VersionTLS13}
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	clock := time.Date(2013, time.February, 3, 19, 54, 0, 0, time.UTC)
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%t %L %r %>s %b %D", WithOutput(buf), WithUTC(), WithNowFunc(func() time.Time { return clock }),
+		WithIDGenerator(func(*http.Request) string { return "id-1" }),
+		WithRequestStartLine("start %t %L %h %r %>s %b %D %{Content-Type}o %404{Referer}i %{tls_protocol}x %{trace_id}x %{push}x"))
+	handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if buf.Len() == 0 {
+			t.Error("no start line written before the handler")
+		}
+		clock = clock.Add(time.Second)
+		HandlerTesting(w, r)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	want := "start [03/Feb/2013:19:54:00 +0000] id-1 10.0.0.1 GET /upload HTTP/1.1 - - - - - TLSv1.3 4bf92f3577b34da6a3ce929d0e0e4736 -\n" +
+		"[03/Feb/2013:19:54:01 +0000] id-1 GET /upload HTTP/1.1 200 17 1000000\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+}
+
+func TestLoggingMiddlewareStartLineOutputs(t *testing.T) {
+	out, errs := new(bytes.Buffer), new(bytes.Buffer)
+	tests := []struct {
+		opts []optFunc
+		want string // the lines of out and errs, separated by |
+	}{
+		{[]optFunc{WithEntryOnly(), WithEntryHandler(func(LogEntry) {})}, "|"},
+		{[]optFunc{WithStatusOutput(400, 599, errs)}, "start GET /missing\n|GET /missing 404\n"},
+		{[]optFunc{WithStatusOutput(0, 599, errs)}, "|start GET /missing\nGET /missing 404\n"},
+	}
+
+	for _, tt := range tests {
+		out.Reset()
+		errs.Reset()
+		req, err := http.NewRequest("GET", "/missing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aLog := FormatWith("%m %U %>s", append(tt.opts, WithOutput(out), WithRequestStartLine("start %m %U"))...)
+		aLog(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), req)
+
+		if got := out.String() + "|" + errs.String(); got != tt.want {
+			t.Errorf("wrong log lines: got %q expect %q", got, tt.want)
+		}
+	}
+}
+
+func TestLoggingMiddlewareInFlight(t *testing.T) {
+	req, err := http.NewRequest("GET", "/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(syncBuffer)
+	aLog := FormatWith("%r %>s %B %{Content-Type}o", WithOutput(buf), WithInFlightInterval(20*time.Millisecond))
+	handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: 1\n\n")
+		for deadline := time.Now().Add(5 * time.Second); strings.Count(buf.String(), "\n") < 2 && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	time.Sleep(50 * time.Millisecond)
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	progress := "GET /events HTTP/1.1 ... 9 -"
+	want := []string{progress, progress, "GET /events HTTP/1.1 200 9 text/event-stream"}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("wrong log lines: got %q expect %q", lines, want)
+	}
+}
+
+func TestLoggingMiddlewareInFlightSnapshot(t *testing.T) {
+	req, err := http.NewRequest("POST", "/upload", strings.NewReader("0123456789"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := func(w ResponseInfo, r *http.Request, arg string) string {
+		return w.(http.ResponseWriter).Header().Get(arg)
+	}
+	buf := new(syncBuffer)
+	aLog := FormatWith("%{req}B %{X-Stage}z", WithOutput(buf), WithDirective('z', header), WithInFlightInterval(10*time.Millisecond))
+	handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadFull(r.Body, make([]byte, 4))
+		w.Header().Set("X-Stage", "streaming")
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("X-Stage", "changed")
+		for deadline := time.Now().Add(5 * time.Second); !strings.Contains(buf.String(), "\n") && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if line, _, _ := strings.Cut(buf.String(), "\n"); line != "4 streaming" {
+		t.Errorf("wrong progress line: got %v expect %v", line, "4 streaming")
+	}
+
+	// entries only, no progress lines
+	out, entries := new(syncBuffer), new(syncBuffer)
+	aLog = FormatWith("%U", WithOutput(out), WithEntryOnly(), WithEntryHandler(func(e LogEntry) { entries.Write([]byte(e.Path)) }),
+		WithInFlightInterval(time.Millisecond))
+	aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/events", nil))
+	if out.String() != "" || entries.String() != "/events" {
+		t.Errorf("wrong log lines: got %q and entries %q", out.String(), entries.String())
+	}
+}
+
+func TestLoggingMiddlewareInFlightElapsed(t *testing.T) {
+	elapsed := func(w ResponseInfo, r *http.Request, arg string) string {
+		if w.Elapsed() > 0 {
+			return "elapsed"
+		}
+		return "none"
+	}
+	buf := new(syncBuffer)
+	aLog := FormatWith("%>s %z", WithOutput(buf), WithDirective('z', elapsed), WithInFlightInterval(10*time.Millisecond))
+	handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for deadline := time.Now().Add(5 * time.Second); !strings.Contains(buf.String(), "\n") && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/events", nil))
+
+	if line, _, _ := strings.Cut(buf.String(), "\n"); line != "... elapsed" {
+		t.Errorf("wrong progress line: got %v expect %v", line, "... elapsed")
+	}
+}
+
+func TestLoggingMiddlewareInFlightRequestChanged(t *testing.T) {
+	req := httptest.NewRequest("GET", "/events?n=1", nil)
+	req.Header.Set("X-Test", "start")
+
+	buf := new(syncBuffer)
+	aLog := FormatWith("%>s %U%q %{X-Test}i", WithOutput(buf), WithInFlightInterval(time.Millisecond))
+	handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; !strings.Contains(buf.String(), "\n") && i < 5000; i++ {
+			r.Header.Set("X-Test", strconv.Itoa(i))
+			r.Header.Set("X-Other", strconv.Itoa(i))
+			r.URL.RawQuery = "n=" + strconv.Itoa(i)
+			time.Sleep(100 * time.Microsecond)
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if line, _, _ := strings.Cut(buf.String(), "\n"); line != "... /events?n=1 start" {
+		t.Errorf("wrong progress line: got %v expect %v", line, "... /events?n=1 start")
+	}
+}
+
+// raceEnabled is set when the tests run with the race detector
+var raceEnabled bool
+
+// discardResponse is a ResponseWriter which does not allocate, to measure the logger alone
+type discardResponse struct {
+	header http.Header
+}
+
+func (d *discardResponse) Header() http.Header         { return d.header }
+func (d *discardResponse) Write(p []byte) (int, error) { return len(p), nil }
+func (d *discardResponse) WriteHeader(int)             {}
+
+func TestLoggingMiddlewareAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the allocations are not stable with the race detector")
+	}
+	req, err := http.NewRequest("GET", "/testing?q=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr, req.RequestURI = "127.0.0.1:1234", "/testing?q=1"
+	req.Header.Set("Referer", "http://localhost/test")
+	w := &discardResponse{header: make(http.Header)}
+	body := []byte("hello")
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	})
+
+	// the response writer, the request carrying the vars and the rendered line
+	const want = 3
+	for _, format := range []string{
+		"%>s %s %b %B %D %T %{ms}T %{us}T %I %O %{req}B %^FB",
+		"%h %l %u \"%r\" %>s %b \"%{Referer}i\"",
+	} {
+		handler := FormatWith(format, WithOutput(io.Discard))(next)
+		if n := testing.AllocsPerRun(100, func() { handler.ServeHTTP(w, req) }); n > want {
+			t.Errorf("wrong allocations for %q: got %v expect at most %v", format, n, want)
+		}
+	}
+}
+
+func BenchmarkServeNone(b *testing.B) {
+	b.ReportAllocs()
+
+	req, _ := http.NewRequest("GET", "/testing", nil)
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(HandlerTesting)
+	req.Header.Set("referer", "http://localhost/test")
+	req.Header.Set("user-agent", "Go testing")
+
+	for i := 0; i < b.N; i++ {
+		handler.ServeHTTP(rr, req)
+	}
+}
+
+func BenchmarkServe(b *testing.B) {
+	b.ReportAllocs()
+
+	req, _ := http.NewRequest("GET", "/testing", nil)
+	rr := httptest.NewRecorder()
+	buf := new(bytes.Buffer)
+	tm, _ := time.Parse("Jan 2, 2006 at 3:04pm (MST)", "Feb 3, 2013 at 7:54pm (PST)")
+	aLog := FormatWith("[%{%s %r}t] %b %D", WithOutput(buf), WithTime(tm))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+	req.Header.Set("referer", "http://localhost/test")
+	req.Header.Set("user-agent", "Go testing")
+	for i := 0; i < b.N; i++ {
+		handler.ServeHTTP(rr, req)
+	}
+}
+
+func BenchmarkServeRebuild(b *testing.B) {
+	b.ReportAllocs()
+
+	req, _ := http.NewRequest("GET", "/testing", nil)
+	rr := httptest.NewRecorder()
+	buf := new(bytes.Buffer)
+	tm, _ := time.Parse("Jan 2, 2006 at 3:04pm (MST)", "Feb 3, 2013 at 7:54pm (PST)")
+	aLog := FormatWith(ApacheCombinedLogFormat, WithOutput(buf), WithTime(tm))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+	req.Header.Set("referer", "http://localhost/test")
+	req.Header.Set("user-agent", "Go testing")
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		handler.ServeHTTP(rr, req)
+	}
+}
+
+func BenchmarkFormatBind(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		ApacheCombinedLog(WithOutput(io.Discard))
+	}
+}
+
+func BenchmarkServeSkip(b *testing.B) {
+	b.ReportAllocs()
+
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	rr := httptest.NewRecorder()
+	buf := new(bytes.Buffer)
+	aLog := FormatWith(ApacheCombinedLogFormat, WithOutput(buf), WithSkipPaths("/healthz"))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		handler.ServeHTTP(rr, req)
+	}
+}
+
+func BenchmarkServeSampled(b *testing.B) {
+	b.ReportAllocs()
+
+	req, _ := http.NewRequest("GET", "/testing", nil)
+	rr := httptest.NewRecorder()
+	aLog := FormatWith(ApacheCombinedLogFormat, WithOutput(io.Discard), WithSampling(0.01))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+	req.Header.Set("referer", "http://localhost/test")
+	req.Header.Set("user-agent", "Go testing")
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		handler.ServeHTTP(rr, req)
+	}
+}
+
+func BenchmarkServeCommon(b *testing.B) {
+	b.ReportAllocs()
+
+	req, _ := http.NewRequest("GET", "/testing", nil)
+	rr := httptest.NewRecorder()
+	buf := new(bytes.Buffer)
+	aLog := FormatWith(ApacheCommonLogFormat, WithOutput(buf))
 	handler := aLog(http.HandlerFunc(HandlerTesting))
-	req.Header.Set("referer", "http://localhost/test")
-	req.Header.Set("user-agent", "Go testing")
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
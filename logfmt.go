@@ -0,0 +1,75 @@
+package accesslog
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+)
+
+// FieldFormat is a named field of a structured log line with the format string
+// of its value, using Apache formatting directives, e.g. {"status", "%>s"}
+type FieldFormat struct {
+	Key    string
+	Format string
+}
+
+// DefaultLogfmtFields are the fields logged by LogfmtFormat for a typical request,
+// with the duration in microseconds.
+var DefaultLogfmtFields = []FieldFormat{
+	{"time", "%{%Y-%m-%dT%H:%M:%S%z}t"},
+	{"remote_host", "%h"},
+	{"method", "%m"},
+	{"path", "%U"},
+	{"status", "%>s"},
+	{"bytes", "%B"},
+	{"duration_us", "%D"},
+}
+
+// LogfmtFormat returns middleware logging one line of Heroku-style logfmt key=value pairs per request,
+// in the order of fields. Values containing spaces, '=', quotes, control characters or
+// invalid UTF-8 are quoted and escaped. Unknown directives are ignored.
+func LogfmtFormat(fields []FieldFormat, opts ...optFunc) func(http.Handler) http.Handler {
+	options := buildOpt(append([]optFunc{withoutSanitizing()}, opts...)...)
+
+	renders := make([]func(buf *bytes.Buffer, ln *line), len(fields))
+	for i, f := range fields {
+		tokens, _ := parseFormat(f.Format, options.Directives)
+		renders[i] = compile(options, tokens)
+	}
+
+	return middleware(options, func(w *responseWriter, r *http.Request) string {
+		ln := newLine(options, w, r)
+		defer ln.release()
+
+		buf, val := getBuffer(), getBuffer()
+		defer putBuffer(buf)
+		defer putBuffer(val)
+		for i, f := range fields {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			buf.WriteString(f.Key)
+			buf.WriteByte('=')
+
+			val.Reset()
+			renders[i](val, ln)
+			if needsQuoting(val.Bytes()) {
+				buf.WriteString(strconv.Quote(val.String()))
+			} else {
+				buf.Write(val.Bytes())
+			}
+		}
+		return buf.String()
+	})
+}
+
+// needsQuoting reports whether the logfmt value v has to be quoted
+func needsQuoting(v []byte) bool {
+	for _, b := range v {
+		if b <= ' ' || b == '=' || b == '"' || b == 0x7f {
+			return true
+		}
+	}
+	return !utf8.Valid(v)
+}
@@ -0,0 +1,43 @@
+package accesslog
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLogfmtFormat(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing?q=a%20b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("User-Agent", "agent \"quoted\"\n")
+
+	date := time.Date(2013, time.February, 3, 19, 54, 0, 0, time.UTC)
+	tests := []struct {
+		fields []FieldFormat
+		want   string
+	}{
+		{
+			DefaultLogfmtFields,
+			"time=2013-02-03T19:54:00+0000 remote_host=10.0.0.1 method=GET path=/testing status=200 bytes=17 duration_us=0\n",
+		},
+		{
+			[]FieldFormat{{"ua", "%{User-agent}i"}, {"query", "%q"}, {"req", "%r"}, {"empty", "%{X-Empty}e"}, {"none", ""}},
+			`ua="agent \"quoted\"\n" query="?q=a%20b" req="GET /testing?q=a%20b HTTP/1.1" empty=- none=` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		buf := new(bytes.Buffer)
+		aLog := LogfmtFormat(tt.fields, WithOutput(buf), WithTime(date), WithUTC())
+		aLog(http.HandlerFunc(HandlerTesting)).ServeHTTP(httptest.NewRecorder(), req)
+
+		if buf.String() != tt.want {
+			t.Errorf("wrong log line: got %v expect %v", buf.String(), tt.want)
+		}
+	}
+}
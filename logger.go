@@ -0,0 +1,66 @@
+package accesslog
+
+import (
+	"context"
+	"net/http"
+)
+
+// Option configures a Logger, it is the type of the With... option functions.
+type Option = optFunc
+
+// Logger is an access log middleware built from a format string with New.
+type Logger struct {
+	o  *opt
+	mw func(http.Handler) http.Handler
+}
+
+// New returns a Logger writing the lines of format, which uses Apache formatting directives,
+// or an error describing the first invalid option, or unknown or malformed directive.
+// The Logger maintains the counters returned by Stats, in the Collector set with WithCollector if any.
+func New(format string, opts ...Option) (*Logger, error) {
+	options := buildOpt(opts...)
+	if options.Collector == nil {
+		options.Collector = NewCollector()
+	}
+	return newLogger(options, format, true)
+}
+
+// newLogger builds the Logger of format, failing on invalid options and directives when strict is set
+func newLogger(options *opt, format string, strict bool) (*Logger, error) {
+	if strict && options.Err != nil {
+		return nil, options.Err
+	}
+	tokens, err := parseFormat(format, options.Directives)
+	if strict && err != nil {
+		return nil, err
+	}
+	return bindLogger(options, tokens), nil
+}
+
+// bindLogger builds the Logger of the parsed format tokens with options.
+// The tokens are only read, so that loggers built concurrently may share them.
+func bindLogger(options *opt, tokens []token) *Logger {
+	options.Tokens = tokens
+	return &Logger{o: options, mw: middleware(options, flatten(options, tokens))}
+}
+
+// Wrap returns next wrapped with the access log middleware.
+func (l *Logger) Wrap(next http.Handler) http.Handler {
+	return l.mw(next)
+}
+
+// WrapFunc returns fn wrapped with the access log middleware.
+func (l *Logger) WrapFunc(fn http.HandlerFunc) http.Handler {
+	return l.mw(fn)
+}
+
+// Close shuts the Logger down, see WithCloser for what it closes and the lines written.
+// It returns the context error if ctx is done first.
+func (l *Logger) Close(ctx context.Context) error {
+	return outputCloser{l.o}.Close(ctx)
+}
+
+// Stats returns a snapshot of the request counters of the Logger.
+func (l *Logger) Stats() Stats {
+	return l.o.Collector.Stats()
+}
@@ -0,0 +1,61 @@
+package accesslog
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l, err := New("%>s %U", WithOutput(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.Wrap(http.HandlerFunc(HandlerTesting)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/wrap", nil))
+	l.WrapFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/func", nil))
+
+	want := "200 /wrap\n404 /func\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+	if s := l.Stats(); s.Requests != 2 || s.Status[2] != 1 || s.Status[4] != 1 {
+		t.Errorf("wrong stats: got %v %v expect %v %v", s.Requests, s.Status, 2, "one 2xx and one 4xx")
+	}
+	if err := l.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	tests := []struct {
+		format string
+		opts   []Option
+	}{
+		{"%{Referer", nil},
+		{"%Y", nil},
+		{"%U", []Option{WithDirective('U', nil)}},
+	}
+	for _, tt := range tests {
+		if l, err := New(tt.format, tt.opts...); err == nil || l != nil {
+			t.Errorf("wrong result for %q: got %v %v expect an error", tt.format, l, err)
+		}
+	}
+}
+
+func TestNewCollector(t *testing.T) {
+	c := NewCollector()
+	l, err := New("%U", WithOutput(new(bytes.Buffer)), WithCollector(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Wrap(http.HandlerFunc(HandlerTesting)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if got := c.Stats().Requests; got != 1 || l.Stats().Requests != 1 {
+		t.Errorf("wrong requests: got %v %v expect %v", got, l.Stats().Requests, 1)
+	}
+}
@@ -0,0 +1,75 @@
+package accesslog
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostCacheSize is the number of client addresses kept by the reverse DNS cache
+const hostCacheSize = 1024
+
+// lookupAddr performs the reverse lookup, it is a variable so tests can replace it
+var lookupAddr = net.DefaultResolver.LookupAddr
+
+// hostResolver resolves client IPs to hostnames for the %h directive, keeping
+// the results (including failed lookups) in a LRU cache so repeated clients
+// don't trigger repeated DNS queries.
+type hostResolver struct {
+	timeout time.Duration
+
+	mu    sync.Mutex
+	size  int
+	order *list.List // of *hostEntry, most recently used at the front
+	items map[string]*list.Element
+}
+
+type hostEntry struct {
+	ip, host string
+}
+
+func newHostResolver(timeout time.Duration, size int) *hostResolver {
+	return &hostResolver{
+		timeout: timeout,
+		size:    size,
+		order:   list.New(),
+		items:   make(map[string]*list.Element),
+	}
+}
+
+// lookup returns the hostname of ip, or ip itself if the lookup fails or times out
+func (hr *hostResolver) lookup(ip string) string {
+	hr.mu.Lock()
+	if e, ok := hr.items[ip]; ok {
+		hr.order.MoveToFront(e)
+		host := e.Value.(*hostEntry).host
+		hr.mu.Unlock()
+		return host
+	}
+	hr.mu.Unlock()
+
+	host := ip
+	ctx, cancel := context.WithTimeout(context.Background(), hr.timeout)
+	names, err := lookupAddr(ctx, ip)
+	cancel()
+	if err == nil && len(names) > 0 {
+		host = strings.TrimSuffix(names[0], ".")
+	}
+
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	if e, ok := hr.items[ip]; ok {
+		hr.order.MoveToFront(e)
+		return host
+	}
+	hr.items[ip] = hr.order.PushFront(&hostEntry{ip: ip, host: host})
+	if hr.order.Len() > hr.size {
+		e := hr.order.Back()
+		hr.order.Remove(e)
+		delete(hr.items, e.Value.(*hostEntry).ip)
+	}
+	return host
+}
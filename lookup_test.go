@@ -0,0 +1,80 @@
+package accesslog
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLoggingMiddlewareHostnameLookups(t *testing.T) {
+	var calls int
+	lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		calls++
+		switch addr {
+		case "192.0.2.1":
+			return []string{"client.example.com."}, nil
+		case "192.0.2.3":
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return nil, errors.New("not found")
+	}
+	defer func() { lookupAddr = net.DefaultResolver.LookupAddr }()
+
+	tests := []struct {
+		remoteAddr string
+		want       string
+	}{
+		{"192.0.2.1:54321", "client.example.com"},
+		{"192.0.2.1:54322", "client.example.com"},
+		{"192.0.2.2:54321", "192.0.2.2"},
+		{"192.0.2.3:54321", "192.0.2.3"},
+	}
+
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%h", WithOutput(buf), WithHostnameLookups(10*time.Millisecond))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+
+	for _, tt := range tests {
+		buf.Reset()
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = tt.remoteAddr
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if buf.String() != tt.want+"\n" {
+			t.Errorf("wrong log line for %v: got %v expect %v", tt.remoteAddr, buf.String(), tt.want)
+		}
+	}
+
+	if calls != 3 {
+		t.Errorf("wrong number of lookups: got %v expect %v", calls, 3)
+	}
+}
+
+func TestHostResolverEviction(t *testing.T) {
+	lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		return []string{"host-" + addr}, nil
+	}
+	defer func() { lookupAddr = net.DefaultResolver.LookupAddr }()
+
+	hr := newHostResolver(time.Second, 2)
+	hr.lookup("192.0.2.1")
+	hr.lookup("192.0.2.2")
+	hr.lookup("192.0.2.1")
+	hr.lookup("192.0.2.3")
+
+	if _, ok := hr.items["192.0.2.2"]; ok {
+		t.Errorf("least recently used entry was not evicted")
+	}
+	if len(hr.items) != 2 {
+		t.Errorf("wrong cache size: got %v expect %v", len(hr.items), 2)
+	}
+}
@@ -0,0 +1,73 @@
+package accesslog
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+)
+
+// DefaultLTSVFields are the labels and directives of the Apache Combined Log Format,
+// with the labels recommended by the LTSV specification.
+var DefaultLTSVFields = []FieldFormat{
+	{"host", "%h"},
+	{"ident", "%l"},
+	{"user", "%u"},
+	{"time", "%t"},
+	{"req", "%r"},
+	{"status", "%>s"},
+	{"size", "%b"},
+	{"referer", "%{Referer}i"},
+	{"ua", "%{User-agent}i"},
+}
+
+// DefaultLTSV logs the DefaultLTSVFields in the Labeled Tab-Separated Values format
+var DefaultLTSV = func(opts ...optFunc) func(http.Handler) http.Handler {
+	return LTSVFormat(DefaultLTSVFields, opts...)
+}
+
+// ltsvReplacer replaces the characters separating LTSV fields and records
+var ltsvReplacer = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+
+// LTSVFormat returns middleware logging one Labeled Tab-Separated Values record per request,
+// e.g. host:127.0.0.1<TAB>method:GET<TAB>status:200, with the labels in the order of fields.
+// Tabs and newlines in values are replaced by spaces. Unknown directives are ignored.
+func LTSVFormat(fields []FieldFormat, opts ...optFunc) func(http.Handler) http.Handler {
+	options := buildOpt(append([]optFunc{withLTSVSanitizing()}, opts...)...)
+
+	renders := make([]func(buf *bytes.Buffer, ln *line), len(fields))
+	for i, f := range fields {
+		tokens, _ := parseFormat(f.Format, options.Directives)
+		renders[i] = compile(options, tokens)
+	}
+
+	return middleware(options, func(w *responseWriter, r *http.Request) string {
+		ln := newLine(options, w, r)
+		defer ln.release()
+
+		buf, val := getBuffer(), getBuffer()
+		defer putBuffer(buf)
+		defer putBuffer(val)
+		for i, f := range fields {
+			if i > 0 {
+				buf.WriteByte('\t')
+			}
+			buf.WriteString(f.Key)
+			buf.WriteByte(':')
+
+			val.Reset()
+			renders[i](val, ln)
+			ltsvReplacer.WriteString(buf, val.String())
+		}
+		return buf.String()
+	})
+}
+
+// withLTSVSanitizing replaces tabs and newlines in values taken from the request by spaces
+// before escaping the remaining control characters
+func withLTSVSanitizing() optFunc {
+	return func(o *opt) {
+		o.Sanitize = func(s string) string {
+			return escapeString(ltsvReplacer.Replace(s))
+		}
+	}
+}
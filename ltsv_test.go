@@ -0,0 +1,44 @@
+package accesslog
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLTSVFormat(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("User-Agent", "evil\tua:x\nhost:y\x01")
+
+	date := time.Date(2013, time.February, 3, 19, 54, 0, 0, time.UTC)
+	tests := []struct {
+		fields []FieldFormat
+		want   string
+	}{
+		{
+			DefaultLTSVFields,
+			"host:10.0.0.1\tident:-\tuser:-\ttime:[03/Feb/2013:19:54:00 +0000]\treq:GET /testing HTTP/1.1\t" +
+				"status:200\tsize:17\treferer:-\tua:evil ua:x host:y\\x01\n",
+		},
+		{
+			[]FieldFormat{{"method", "%m"}, {"line", "%m\t%U"}},
+			"method:GET\tline:GET /testing\n",
+		},
+	}
+
+	for _, tt := range tests {
+		buf := new(bytes.Buffer)
+		aLog := LTSVFormat(tt.fields, WithOutput(buf), WithTime(date), WithUTC())
+		aLog(http.HandlerFunc(HandlerTesting)).ServeHTTP(httptest.NewRecorder(), req)
+
+		if buf.String() != tt.want {
+			t.Errorf("wrong log line: got %v expect %v", buf.String(), tt.want)
+		}
+	}
+}
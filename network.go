@@ -0,0 +1,238 @@
+package accesslog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// errNetworkDropped is reported when a line is dropped because the network output is disconnected
+	errNetworkDropped = errors.New("accesslog: network output disconnected, line dropped")
+
+	// errNetworkDisconnected is returned when the buffered lines cannot be flushed
+	errNetworkDisconnected = errors.New("accesslog: network output disconnected")
+)
+
+// NetworkOption configures the output of WithNetworkOutput.
+type NetworkOption func(*networkWriter)
+
+// WithNetworkBuffer keeps up to lines log lines in memory while the network output is
+// disconnected, they are sent first once it reconnects. By default lines are dropped.
+func WithNetworkBuffer(lines int) NetworkOption {
+	return func(n *networkWriter) {
+		n.maxPending = lines
+	}
+}
+
+// WithNetworkBackoff sets the delays between reconnection attempts, starting at min and
+// doubling after each failure up to max. The defaults are 100ms and 30s.
+func WithNetworkBackoff(min, max time.Duration) NetworkOption {
+	return func(n *networkWriter) {
+		n.minBackoff, n.maxBackoff = min, max
+	}
+}
+
+// WithNetworkTimeout sets the timeout of connecting and of each write, 5s by default.
+func WithNetworkTimeout(timeout time.Duration) NetworkOption {
+	return func(n *networkWriter) {
+		n.timeout = timeout
+	}
+}
+
+// WithNetworkOutput sends the log lines to a log collector at addr over network, e.g. "tcp" or "udp".
+// The connection is made on the first line and made again after a write error, waiting longer
+// after each failed attempt. Lines logged while disconnected are dropped, or buffered with
+// WithNetworkBuffer, and the drops are reported to the error handler. Connecting and writing
+// happen on the request goroutine, bounded by WithNetworkTimeout, use WithAsync to keep them
+// off the requests. With "udp" each line is sent as a single datagram, fire-and-forget.
+func WithNetworkOutput(network, addr string, opts ...NetworkOption) optFunc {
+	return func(o *opt) {
+		n := &networkWriter{
+			o:          o,
+			network:    network,
+			addr:       addr,
+			minBackoff: 100 * time.Millisecond,
+			maxBackoff: 30 * time.Second,
+			timeout:    5 * time.Second,
+		}
+		for _, opt := range opts {
+			opt(n)
+		}
+		n.backoff = n.minBackoff
+		o.Output = n
+	}
+}
+
+// networkWriter writes lines to a connection, reconnecting with exponential backoff
+type networkWriter struct {
+	o             *opt
+	network, addr string
+
+	minBackoff, maxBackoff time.Duration
+	timeout                time.Duration
+	maxPending             int
+
+	mu      sync.Mutex
+	conn    net.Conn
+	pending [][]byte // lines written while disconnected
+	retry   time.Time
+	backoff time.Duration
+	closed  bool
+}
+
+// Write sends p, buffering or dropping it when the connection is down. Failures are
+// reported to the error handler and never returned, so the request is not affected.
+func (n *networkWriter) Write(p []byte) (int, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		n.o.error(errNetworkDropped)
+		return len(p), nil
+	}
+	if n.datagram() {
+		n.writeDatagrams(p)
+		return len(p), nil
+	}
+	if n.conn == nil && !time.Now().Before(n.retry) {
+		n.connect()
+	}
+	if n.conn == nil || !n.flushPending() || !n.send(p) {
+		n.queue(p)
+	}
+	return len(p), nil
+}
+
+// datagram returns whether the lines are sent as datagrams rather than a stream
+func (n *networkWriter) datagram() bool {
+	switch n.network {
+	case "udp", "udp4", "udp6", "unixgram":
+		return true
+	}
+	return false
+}
+
+// writeDatagrams sends each line of p as its own datagram, p holds several lines when buffered.
+// The lines are split after the line terminator, p is sent whole when there is none.
+func (n *networkWriter) writeDatagrams(p []byte) {
+	if n.conn == nil {
+		conn, err := net.DialTimeout(n.network, n.addr, n.timeout)
+		if err != nil {
+			n.o.error(fmt.Errorf("accesslog: network output: %w", err))
+			return
+		}
+		n.conn = conn
+	}
+	term := n.o.Terminator
+	for len(p) > 0 {
+		line := p
+		if i := bytes.Index(p, []byte(term)); i >= 0 && len(term) > 0 {
+			line, p = p[:i+len(term)], p[i+len(term):]
+		} else {
+			p = nil
+		}
+		if _, err := n.conn.Write(line); err != nil {
+			n.o.error(fmt.Errorf("accesslog: network output: %w", err))
+		}
+	}
+}
+
+// connect dials the collector, scheduling the next attempt on failure
+func (n *networkWriter) connect() {
+	conn, err := net.DialTimeout(n.network, n.addr, n.timeout)
+	if err != nil {
+		n.o.error(fmt.Errorf("accesslog: network output: %w", err))
+		n.fail()
+		return
+	}
+	n.conn = conn
+	n.backoff = n.minBackoff
+}
+
+// fail closes the connection, if any, and doubles the backoff up to its maximum
+func (n *networkWriter) fail() {
+	if n.conn != nil {
+		n.conn.Close()
+		n.conn = nil
+	}
+	n.retry = time.Now().Add(n.backoff)
+	n.backoff = min(2*n.backoff, n.maxBackoff)
+}
+
+// send writes p to the connection, closing it on error
+func (n *networkWriter) send(p []byte) bool {
+	if n.timeout > 0 {
+		n.conn.SetWriteDeadline(time.Now().Add(n.timeout))
+	}
+	if _, err := n.conn.Write(p); err != nil {
+		n.o.error(fmt.Errorf("accesslog: network output: %w", err))
+		n.fail()
+		return false
+	}
+	return true
+}
+
+// flushPending sends the lines buffered while disconnected
+func (n *networkWriter) flushPending() bool {
+	for len(n.pending) > 0 {
+		if !n.send(n.pending[0]) {
+			return false
+		}
+		n.pending[0] = nil
+		n.pending = n.pending[1:]
+	}
+	return true
+}
+
+// queue buffers a copy of p until the connection is back, dropping it when the buffer is full
+func (n *networkWriter) queue(p []byte) {
+	if len(n.pending) >= n.maxPending {
+		n.o.error(errNetworkDropped)
+		return
+	}
+	n.pending = append(n.pending, bytes.Clone(p))
+}
+
+// Flush sends the buffered lines, reconnecting without waiting for the backoff.
+func (n *networkWriter) Flush() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.pending) == 0 || n.closed {
+		return nil
+	}
+	if n.conn == nil {
+		n.connect()
+	}
+	if n.conn == nil || !n.flushPending() {
+		return errNetworkDisconnected
+	}
+	return nil
+}
+
+// Close sends the buffered lines, connecting once more if needed, and closes the connection.
+// Later lines are dropped.
+func (n *networkWriter) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.closed = true
+	if len(n.pending) > 0 && n.conn == nil {
+		n.connect()
+	}
+	var err error
+	if len(n.pending) > 0 && (n.conn == nil || !n.flushPending()) {
+		n.pending = nil
+		err = errNetworkDropped
+	}
+	if n.conn != nil {
+		if cerr := n.conn.Close(); err == nil {
+			err = cerr
+		}
+		n.conn = nil
+	}
+	return err
+}
+
+func (n *networkWriter) locksWrites() {}
@@ -0,0 +1,184 @@
+package accesslog
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collector accepts connections on addr and sends the lines it reads on lines,
+// stop closes the listener and the connections
+func collector(t *testing.T, addr string, lines chan<- string) (string, func()) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go func() {
+				s := bufio.NewScanner(conn)
+				for s.Scan() {
+					lines <- s.Text()
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), func() {
+		l.Close()
+		mu.Lock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+	}
+}
+
+// receive returns the next line read by the collector
+func receive(t *testing.T, lines <-chan string) string {
+	t.Helper()
+	select {
+	case l := <-lines:
+		return l
+	case <-time.After(5 * time.Second):
+		t.Fatal("no line received")
+	}
+	return ""
+}
+
+func TestNetworkOutputReconnect(t *testing.T) {
+	lines := make(chan string, 100)
+	addr, stop := collector(t, "127.0.0.1:0", lines)
+
+	errs := make(chan error, 100)
+	aLog := FormatWith("%U", WithNetworkOutput("tcp", addr, WithNetworkBuffer(100), WithNetworkBackoff(time.Millisecond, 5*time.Millisecond)),
+		WithErrorHandler(func(err error) { errs <- err }))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+	serve := func(path string) {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	serve("/a")
+	if got := receive(t, lines); got != "/a" {
+		t.Fatalf("wrong log line: got %v expect %v", got, "/a")
+	}
+
+	// stop the collector, the first lines may still be accepted by the kernel and lost
+	stop()
+	for i := 0; ; i++ {
+		serve("/b" + strconv.Itoa(i))
+		if len(errs) > 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("the write errors were not reported")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	serve("/c1")
+	serve("/c2")
+
+	_, stop = collector(t, addr, lines)
+	defer stop()
+	for len(lines) > 0 {
+		<-lines
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	serve("/z")
+
+	// the lines buffered while disconnected are sent first, in order
+	var got []string
+	for len(got) == 0 || got[len(got)-1] != "/z" {
+		got = append(got, receive(t, lines))
+	}
+	if n := len(got); n < 3 || got[n-3] != "/c1" || got[n-2] != "/c2" || !strings.HasPrefix(got[0], "/b") {
+		t.Errorf("wrong log lines after reconnecting: got %v", got)
+	}
+	for range len(errs) {
+		if err := <-errs; errors.Is(err, errNetworkDropped) {
+			t.Errorf("line dropped: %v", err)
+		}
+	}
+}
+
+func TestNetworkOutputDropped(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	errs := make(chan error, 10)
+	aLog := FormatWith("%U", WithNetworkOutput("tcp", addr, WithNetworkBuffer(1)),
+		WithErrorHandler(func(err error) { errs <- err }))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+	for i := 0; i < 2; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+
+	// the connection is refused, the first line is buffered and the second dropped
+	var dropped int
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if errors.Is(err, errNetworkDropped) {
+				dropped++
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no error reported")
+		}
+	}
+	if dropped != 1 {
+		t.Errorf("wrong dropped lines: got %v expect %v", dropped, 1)
+	}
+}
+
+func TestNetworkOutputUDP(t *testing.T) {
+	for _, term := range []string{"\n", "\r\n", "\x00"} {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pc.Close()
+
+		// lines buffered together are still sent as one datagram each
+		var f Flusher
+		aLog := FormatWith("%U", WithNetworkOutput("udp", pc.LocalAddr().String()), WithBufferedOutput(4096, 0), WithFlusher(&f),
+			WithLineTerminator(term))
+		handler := aLog(http.HandlerFunc(HandlerTesting))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/first", nil))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/second", nil))
+		if err := f.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 1024)
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for _, want := range []string{"/first" + term, "/second" + term} {
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf[:n]) != want {
+				t.Errorf("wrong datagram: got %q expect %q", buf[:n], want)
+			}
+		}
+	}
+}
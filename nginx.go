@@ -0,0 +1,251 @@
+package accesslog
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// NginxCombinedLogFormat is the nginx predefined combined log_format
+const NginxCombinedLogFormat = `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"`
+
+// NginxCombinedLog will log HTTP requests exactly as nginx does with its combined log format.
+func NginxCombinedLog(opts ...optFunc) func(http.Handler) http.Handler {
+	mw, _ := NginxFormat(NginxCombinedLogFormat, opts...)
+	return mw
+}
+
+// nginxDirectives maps the nginx variables to the directives implementing them
+var nginxDirectives = map[string]string{
+	"remote_addr":     "%a",
+	"remote_port":     "%{remote}p",
+	"remote_user":     "%u",
+	"time_local":      "%{%d/%b/%Y:%H:%M:%S %z}t",
+	"request":         "%r",
+	"request_method":  "%m",
+	"uri":             "%U",
+	"document_uri":    "%U",
+	"status":          "%>s",
+	"body_bytes_sent": "%B",
+	"bytes_sent":      "%O",
+	"request_length":  "%I",
+	"server_name":     "%v",
+	"server_addr":     "%A",
+	"server_port":     "%{local}p",
+	"server_protocol": "%H",
+	"request_id":      "%L",
+	"pid":             "%P",
+}
+
+// nginxFuncs implements the nginx variables that no directive matches
+var nginxFuncs = map[string]func(o *opt, ln *line) string{
+	"time_iso8601": func(o *opt, ln *line) string {
+		return ln.time.Format("2006-01-02T15:04:05-07:00")
+	},
+	"msec": func(o *opt, ln *line) string {
+		ms := ln.time.UnixMilli()
+		return fmt.Sprintf("%d.%03d", ms/1000, ms%1000)
+	},
+	"request_time": func(o *opt, ln *line) string {
+		return strconv.FormatFloat(ln.duration().Seconds(), 'f', 3, 64)
+	},
+	"request_uri": func(o *opt, ln *line) string {
+		return o.Sanitize(ln.requestURI())
+	},
+	"args": func(o *opt, ln *line) string {
+		return o.Sanitize(ln.rawQuery())
+	},
+	"query_string": func(o *opt, ln *line) string {
+		return o.Sanitize(ln.rawQuery())
+	},
+	"scheme": func(o *opt, ln *line) string {
+		if ln.request.TLS != nil {
+			return "https"
+		}
+		return "http"
+	},
+	"https": func(o *opt, ln *line) string {
+		if ln.request.TLS != nil {
+			return "on"
+		}
+		return ""
+	},
+	"host": func(o *opt, ln *line) string {
+		return o.Sanitize(strings.ToLower(hostOnly(ln.request.Host)))
+	},
+}
+
+// nginxUpstream are the variables of the nginx upstream module, there is no upstream
+var nginxUpstream = map[string]bool{
+	"upstream_addr":            true,
+	"upstream_status":          true,
+	"upstream_response_time":   true,
+	"upstream_connect_time":    true,
+	"upstream_header_time":     true,
+	"upstream_response_length": true,
+	"upstream_cache_status":    true,
+}
+
+// NginxFormat returns middleware logging the requests with an nginx log_format string, using the $var
+// and ${var} syntax. The common variables such as $remote_addr, $time_local, $request, $status,
+// $body_bytes_sent, $request_time, $http_name, $sent_http_name and $cookie_name are supported,
+// the upstream variables are logged as "-". Values are escaped as nginx does by default,
+// unless WithReplacement is set, and empty values are logged as "-".
+// It returns an error for unknown variables.
+func NginxFormat(format string, opts ...optFunc) (func(http.Handler) http.Handler, error) {
+	options := buildOpt(append([]optFunc{withNginxEscaping()}, opts...)...)
+	if options.Err != nil {
+		return nil, options.Err
+	}
+	segments, err := parseNginxFormat(options, format)
+	if err != nil {
+		return nil, err
+	}
+	return middleware(options, func(w *responseWriter, r *http.Request) string {
+		ln := newLine(options, w, r)
+		defer ln.release()
+
+		buf := getBuffer()
+		defer putBuffer(buf)
+		for _, seg := range segments {
+			seg(buf, ln)
+		}
+		return buf.String()
+	}), nil
+}
+
+// parseNginxFormat returns the functions rendering the literals and variables of format in turn
+func parseNginxFormat(o *opt, format string) ([]func(buf *bytes.Buffer, ln *line), error) {
+	var segments []func(buf *bytes.Buffer, ln *line)
+	for len(format) > 0 {
+		i := strings.IndexByte(format, '$')
+		if i < 0 {
+			i = len(format)
+		}
+		if i > 0 {
+			lit := format[:i]
+			segments = append(segments, func(buf *bytes.Buffer, ln *line) { buf.WriteString(lit) })
+			format = format[i:]
+			continue
+		}
+
+		var name string
+		if strings.HasPrefix(format, "${") {
+			end := strings.IndexByte(format, '}')
+			if end < 0 {
+				return nil, fmt.Errorf("accesslog: unclosed nginx variable %q", format)
+			}
+			name, format = format[2:end], format[end+1:]
+		} else {
+			n := 1
+			for n < len(format) && isNginxNameByte(format[n]) {
+				n++
+			}
+			name, format = format[1:n], format[n:]
+		}
+		seg, err := nginxVariable(o, name)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, seg)
+	}
+	return segments, nil
+}
+
+func isNginxNameByte(b byte) bool {
+	return b == '_' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9')
+}
+
+// nginxVariable returns the function rendering the nginx variable name
+func nginxVariable(o *opt, name string) (func(buf *bytes.Buffer, ln *line), error) {
+	directive, ok := nginxDirectives[name]
+	switch {
+	case ok:
+	case strings.HasPrefix(name, "http_"):
+		directive = "%{" + strings.ReplaceAll(name[len("http_"):], "_", "-") + "}i"
+	case strings.HasPrefix(name, "sent_http_"):
+		directive = "%{" + strings.ReplaceAll(name[len("sent_http_"):], "_", "-") + "}o"
+	case strings.HasPrefix(name, "cookie_"):
+		cookie := name[len("cookie_"):]
+		return func(buf *bytes.Buffer, ln *line) {
+			if c, err := ln.request.Cookie(cookie); err == nil && len(c.Value) > 0 {
+				v := c.Value
+				if ln.redact.header("Cookie") {
+					v = ln.redact.value(v)
+				}
+				buf.WriteString(o.Sanitize(v))
+				return
+			}
+			buf.WriteByte('-')
+		}, nil
+	case nginxUpstream[name]:
+		return func(buf *bytes.Buffer, ln *line) { buf.WriteByte('-') }, nil
+	case nginxFuncs[name] != nil:
+		fn := nginxFuncs[name]
+		return func(buf *bytes.Buffer, ln *line) {
+			v := fn(o, ln)
+			if len(v) == 0 {
+				v = "-"
+			}
+			buf.WriteString(v)
+		}, nil
+	default:
+		if len(name) == 0 {
+			return nil, fmt.Errorf("accesslog: empty nginx variable name")
+		}
+		return nil, fmt.Errorf("accesslog: unknown nginx variable $%s", name)
+	}
+
+	tokens, err := parseFormat(directive, o.Directives)
+	if err != nil {
+		return nil, err
+	}
+	render := compile(o, tokens)
+	return func(buf *bytes.Buffer, ln *line) {
+		start := buf.Len()
+		render(buf, ln)
+		if buf.Len() == start {
+			buf.WriteByte('-')
+		}
+	}, nil
+}
+
+// nginxEscape escapes s as nginx does by default: ", \ and the bytes
+// outside of printable ASCII are replaced with \xHH
+func nginxEscape(s string) string {
+	i := 0
+	for i < len(s) && !nginxEscaped(s[i]) {
+		i++
+	}
+	if i == len(s) {
+		return s
+	}
+	var sb strings.Builder
+	sb.Grow(len(s) + 8)
+	sb.WriteString(s[:i])
+	for ; i < len(s); i++ {
+		if b := s[i]; nginxEscaped(b) {
+			sb.WriteString(`\x`)
+			sb.WriteByte(upperHexDigits[b>>4])
+			sb.WriteByte(upperHexDigits[b&0x0f])
+		} else {
+			sb.WriteByte(b)
+		}
+	}
+	return sb.String()
+}
+
+const upperHexDigits = "0123456789ABCDEF"
+
+func nginxEscaped(b byte) bool {
+	return b < 0x20 || b > 0x7e || b == '"' || b == '\\'
+}
+
+// withNginxEscaping escapes the values taken from the request as nginx does
+func withNginxEscaping() optFunc {
+	return func(o *opt) {
+		o.Sanitize = nginxEscape
+	}
+}
@@ -0,0 +1,74 @@
+package accesslog
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNginxCombinedLog(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing?q=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "127.0.0.1:54321"
+	req.Header.Set("User-Agent", `Go "testing" é`)
+
+	tm, err := time.Parse("Jan 2, 2006 at 3:04pm (MST)", "Feb 3, 2013 at 7:54pm (PST)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	aLog := NginxCombinedLog(WithOutput(buf), WithTime(tm))
+	handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// as written by nginx for the same request
+	want := `127.0.0.1 - - [03/Feb/2013:19:54:00 +0000] "GET /testing?q=1 HTTP/1.1" 204 0 "-" "Go \x22testing\x22 \xC3\xA9"` + "\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+}
+
+func TestNginxFormat(t *testing.T) {
+	req, err := http.NewRequest("POST", "https://Example.com:8443/path/file?a=b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.RequestURI = "/path/file?a=b"
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+
+	clock := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	now := func() time.Time {
+		clock = clock.Add(50 * time.Millisecond)
+		return clock
+	}
+	buf := new(bytes.Buffer)
+	aLog, err := NginxFormat("$remote_addr:$remote_port ${request_method} $request_uri $args $host $cookie_session $cookie_missing "+
+		"$sent_http_x_cache $upstream_response_time $request_time $time_iso8601 $msec", WithOutput(buf), WithNowFunc(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Cache", "HIT")
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	want := "10.0.0.1:1234 POST /path/file?a=b a=b example.com abc - HIT - 0.050 2024-01-02T03:04:05+00:00 1704164645.100\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+}
+
+func TestNginxFormatErrors(t *testing.T) {
+	for _, format := range []string{"$unknown", "${remote_addr", "$http_host ${}", "cost $ 5"} {
+		if _, err := NginxFormat(format); err == nil {
+			t.Errorf("no error for %q", format)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package accesslog
+
+import (
+	"fmt"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// directiveNames are the directives supported without an argument
+var directiveNames = map[string]bool{
+	"%%": true, "%h": true, "%a": true, "%A": true, "%v": true, "%V": true,
+	"%p": true, "%l": true, "%u": true, "%t": true, "%r": true, "%m": true,
+	"%U": true, "%q": true, "%H": true, "%s": true, "%>s": true, "%b": true,
+	"%B": true, "%D": true, "%T": true, "%I": true, "%O": true, "%f": true,
+	"%L": true, "%^FB": true, "%P": true, "%X": true,
+}
+
+// enclosedDirectives are the directive letters supported with a %{...} argument
+const enclosedDirectives = "iotpenTFPxB"
+
+// checkDirective returns an error if s is not a supported directive,
+// built in or one of the custom directives
+func checkDirective(s string, offset int, custom map[byte]DirectiveFunc) error {
+	d, _ := splitCondition(s)
+	switch {
+	case d == "%":
+		return fmt.Errorf("incomplete directive at offset %d", offset)
+	case directiveNames[d]:
+		return nil
+	case isEnclosed(d) && (d[len(d)-1] == 'i' || d[len(d)-1] == 'o') && !isHeaderToken(d[2:len(d)-2]):
+		return fmt.Errorf("invalid header name %s at offset %d", s, offset)
+	case isEnclosed(d) && strings.IndexByte(enclosedDirectives, d[len(d)-1]) >= 0 && knownArgument(d):
+		return nil
+	case custom[d[len(d)-1]] != nil && (len(d) == 2 || isEnclosed(d)):
+		return nil
+	}
+	return fmt.Errorf("unknown directive %s at offset %d", s, offset)
+}
+
+// token is a piece of a parsed format, either literal text or a directive
+type token struct {
+	literal   string
+	directive string     // the directive without its condition, e.g. %{User-agent}i
+	cond      *condition // the status condition of the directive, if any
+}
+
+// parseFormat splits a format string into an ordered list of literal text and
+// directive tokens. The error describes the first unknown or malformed directive,
+// the tokens are usable regardless so that lenient callers can ignore it.
+// The letters of custom are accepted as directives besides the built-in ones.
+func parseFormat(format string, custom map[byte]DirectiveFunc) (tokens []token, err error) {
+	var lit int // start of the current literal text
+	for i := 0; i < len(format); {
+		if format[i] != '%' {
+			i++
+			continue
+		}
+		if lit < i {
+			tokens = append(tokens, token{literal: unescapeLiteral(format[lit:i])})
+		}
+
+		end, derr := scanDirective(format, i)
+		if derr == nil && missingLetter(format[i:end]) {
+			// kept as literal text, e.g. the %{Referer} of a format missing the i
+			if err == nil {
+				err = fmt.Errorf("missing directive letter after %s at offset %d", format[i:end], i)
+			}
+			tokens = append(tokens, token{literal: format[i:end]})
+			i, lit = end, end
+			continue
+		}
+		if derr == nil {
+			derr = checkDirective(format[i:end], i, custom)
+		}
+		if err == nil {
+			err = derr
+		}
+		tok := token{}
+		tok.directive, tok.cond = splitCondition(format[i:end])
+		tokens = append(tokens, tok)
+		i, lit = end, end
+	}
+	if lit < len(format) {
+		tokens = append(tokens, token{literal: unescapeLiteral(format[lit:])})
+	}
+
+	return tokens, err
+}
+
+// scanDirective returns the end offset of the directive starting with the '%' at start.
+// A directive is made of, in order: an optional status condition (%400,501 or %!200),
+// an optional '>', an optional %{...} argument which may nest further enclosures such as
+// %{%H:%M:%S.%{msec_frac}t}t, and the directive letter, or '^' and two letters as in %^FB.
+func scanDirective(format string, start int) (int, error) {
+	i := start + 1
+	if i < len(format) && format[i] == '%' {
+		return i + 1, nil
+	}
+
+	for i < len(format) && (format[i] == '!' || format[i] == ',' || isDigit(format[i])) {
+		i++
+	}
+	if i < len(format) && format[i] == '>' {
+		i++
+	}
+	if i < len(format) && format[i] == '{' {
+		var depth int
+		for ; i < len(format); i++ {
+			if format[i] == '{' {
+				depth++
+			} else if format[i] == '}' {
+				if depth--; depth == 0 {
+					break
+				}
+			}
+		}
+		if i == len(format) {
+			return i, fmt.Errorf("unterminated %%{...} at offset %d", start)
+		}
+		i++
+	}
+
+	switch {
+	case i+2 < len(format) && format[i] == '^' && isLetter(format[i+1]) && isLetter(format[i+2]):
+		i += 3
+	case i < len(format) && isLetter(format[i]):
+		i++
+	}
+	return i, nil
+}
+
+// knownArgument reports whether the argument of the enclosed directive d is supported,
+// %{...}B and %{...}P only take a few
+func knownArgument(d string) bool {
+	switch arg := d[2 : len(d)-2]; d[len(d)-1] {
+	case 'B':
+		return arg == "" || arg == "req"
+	case 'P':
+		return arg == "" || arg == "pid" || arg == "tid"
+	}
+	return true
+}
+
+// isEnclosed reports whether the directive d has a %{...} argument and a letter,
+// the argument may be empty as in %{}i
+func isEnclosed(d string) bool {
+	return len(d) > 3 && d[1] == '{' && d[len(d)-2] == '}'
+}
+
+// missingLetter reports whether the directive s ends with its %{...} argument, without a letter
+func missingLetter(s string) bool {
+	d, _ := splitCondition(s)
+	return len(d) > 2 && d[1] == '{' && d[len(d)-1] == '}'
+}
+
+// isHeaderToken reports whether name is a valid header field name, an RFC 7230 token.
+// The empty name of %{}i is accepted, it is rendered as a placeholder.
+func isHeaderToken(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; !isLetter(c) && !isDigit(c) && strings.IndexByte("!#$%&'*+-.^_`|~", c) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// headerKey returns the canonical form of the header name of a %{...}i or %{...}o directive,
+// e.g. User-Agent for user-agent, with the underscores replaced by hyphens if underscores is set
+func headerKey(name string, underscores bool) string {
+	if underscores {
+		name = strings.ReplaceAll(name, "_", "-")
+	}
+	return textproto.CanonicalMIMEHeaderKey(name)
+}
+
+func isDigit(b byte) bool {
+	return '0' <= b && b <= '9'
+}
+
+func isLetter(b byte) bool {
+	return ('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z')
+}
+
+// directiveKind identifies the directive rendered by a segment
+type directiveKind uint8
+
+const (
+	kindLiteral directiveKind = iota
+	kindUnknown
+	kindCustom
+	kindRemoteHost      // %h
+	kindRemoteIP        // %a
+	kindLocalIP         // %A
+	kindServerName      // %v
+	kindRequestedServer // %V
+	kindPort            // %p, %{...}p
+	kindPercent         // %%
+	kindRemoteLogname   // %l
+	kindUser            // %u
+	kindTime            // %t
+	kindTimeFormat      // %{...}t
+	kindRequestLine     // %r
+	kindMethod          // %m
+	kindURLPath         // %U
+	kindQuery           // %q
+	kindProtocol        // %H
+	kindStatus          // %s
+	kindFinalStatus     // %>s
+	kindBytesCLF        // %b
+	kindBytes           // %B
+	kindBodyBytesRead   // %{req}B
+	kindMicroseconds    // %D
+	kindDuration        // %T, %{...}T
+	kindBytesReceived   // %I
+	kindBytesSent       // %O
+	kindFilename        // %f
+	kindRequestID       // %L
+	kindFirstByte       // %^FB
+	kindConnStatus      // %X
+	kindPID             // %P, %{pid}P
+	kindTID             // %{tid}P
+	kindRequestHeader   // %{...}i
+	kindResponseHeader  // %{...}o
+	kindEnv             // %{...}e
+	kindNote            // %{...}n
+	kindForwarded       // %{...}F
+	kindExtension       // %{...}x
+	kindPlaceholder     // %{}i and the other directives with an empty argument
+)
+
+// directiveKinds are the kinds of the directives without an argument
+var directiveKinds = map[string]directiveKind{
+	"%h": kindRemoteHost, "%a": kindRemoteIP, "%A": kindLocalIP, "%v": kindServerName,
+	"%V": kindRequestedServer, "%p": kindPort, "%%": kindPercent, "%": kindPercent,
+	"%l": kindRemoteLogname, "%u": kindUser, "%t": kindTime, "%r": kindRequestLine,
+	"%m": kindMethod, "%U": kindURLPath, "%q": kindQuery, "%H": kindProtocol,
+	"%s": kindStatus, "%>s": kindFinalStatus, "%b": kindBytesCLF, "%B": kindBytes,
+	"%D": kindMicroseconds, "%T": kindDuration, "%I": kindBytesReceived, "%O": kindBytesSent,
+	"%f": kindFilename, "%L": kindRequestID, "%^FB": kindFirstByte, "%X": kindConnStatus,
+	"%P": kindPID,
+}
+
+// enclosedKinds are the kinds of the directive letters taking a %{...} argument
+var enclosedKinds = map[byte]directiveKind{
+	'i': kindRequestHeader, 'o': kindResponseHeader, 't': kindTimeFormat, 'p': kindPort,
+	'e': kindEnv, 'n': kindNote, 'T': kindDuration, 'F': kindForwarded, 'x': kindExtension,
+}
+
+// segment is a token compiled for rendering: literal text or a typed directive with its argument
+type segment struct {
+	kind      directiveKind
+	literal   string        // the text of kindLiteral
+	directive string        // the directive as written, e.g. %{User-agent}i
+	arg       string        // the %{...} argument
+	unit      time.Duration // the unit of kindDuration, zero if unknown
+	cond      *condition
+	custom    DirectiveFunc
+}
+
+// compileSegments resolves the directives of tokens once, so that rendering a line
+// does not compare directive strings. The custom directives take precedence over the
+// built-in ones taking an argument, not over those without.
+func compileSegments(tokens []token, custom map[byte]DirectiveFunc) []segment {
+	segments := make([]segment, len(tokens))
+	for i, tok := range tokens {
+		s := tok.directive
+		seg := segment{directive: s, cond: tok.cond}
+		enclosed := isEnclosed(s)
+		if enclosed {
+			seg.arg = s[2 : len(s)-2]
+		}
+		switch kind, ok := directiveKinds[s]; {
+		case len(s) == 0:
+			seg.kind, seg.literal = kindLiteral, tok.literal
+		case ok:
+			seg.kind = kind
+		case custom[s[len(s)-1]] != nil && (len(s) == 2 || enclosed):
+			seg.kind, seg.custom = kindCustom, custom[s[len(s)-1]]
+		case !enclosed:
+			seg.kind = kindUnknown
+		case len(seg.arg) == 0 && strings.IndexByte(enclosedDirectives, s[len(s)-1]) >= 0:
+			seg.kind = kindPlaceholder
+		case enclosedKinds[s[len(s)-1]] != 0:
+			seg.kind = enclosedKinds[s[len(s)-1]]
+		case s[len(s)-1] == 'B' && seg.arg == "req":
+			seg.kind = kindBodyBytesRead
+		case s[len(s)-1] == 'P' && seg.arg == "pid":
+			seg.kind = kindPID
+		case s[len(s)-1] == 'P' && seg.arg == "tid":
+			seg.kind = kindTID
+		default:
+			seg.kind = kindUnknown
+		}
+		if seg.kind == kindDuration {
+			seg.unit = durationUnits[seg.arg]
+		}
+		segments[i] = seg
+	}
+	return segments
+}
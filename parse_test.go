@@ -0,0 +1,191 @@
+package accesslog
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFormatWithStrict(t *testing.T) {
+	tests := []struct {
+		format string
+		err    string
+	}{
+		{ApacheCommonLogFormat, ""},
+		{ApacheCombinedIOLogFormat, ""},
+		{"%400,501{User-agent}i %{%Y-%m-%d}t %^FB 100%%", ""},
+		{"%h %l %u %z %s", "unknown directive %z at offset 9"},
+		{"%h %{Referer}y", "unknown directive %{Referer}y at offset 3"},
+		{"%{cpu}P %{res}B", "unknown directive %{cpu}P at offset 0"},
+		{"%h %>s %{Referer}", "missing directive letter after %{Referer} at offset 7"},
+		{"%{}i %{}o %{}x", ""},
+		{"%{user-agent}i %{X_Forwarded_For}i %{REFERER}o", ""},
+		{"%h %{User agent}i", "invalid header name %{User agent}i at offset 3"},
+		{"%400{Referer:}o", "invalid header name %400{Referer:}o at offset 0"},
+		{"%h %>s %b %D %{Referer", "unterminated %{...} at offset 13"},
+		{"%h %", "incomplete directive at offset 3"},
+	}
+
+	for _, tt := range tests {
+		_, err := FormatWithStrict(tt.format)
+		switch {
+		case len(tt.err) == 0 && err != nil:
+			t.Errorf("unexpected error for %q: %v", tt.format, err)
+		case len(tt.err) > 0 && (err == nil || err.Error() != tt.err):
+			t.Errorf("wrong error for %q: got %v expect %v", tt.format, err, tt.err)
+		}
+	}
+}
+
+// lit and dir build expected tokens for the parser tests
+func lit(s string) token { return token{literal: s} }
+func dir(s string) token { return token{directive: s} }
+
+func TestParseFormat(t *testing.T) {
+	tests := []struct {
+		format string
+		tokens []token
+	}{
+		{"%{%Y-%m-%dT%H:%M:%S}t %s", []token{dir("%{%Y-%m-%dT%H:%M:%S}t"), lit(" "), dir("%s")}},
+		{"%{%d/%b/%Y:%H:%M:%S.%{msec_frac}t %z}t", []token{dir("%{%d/%b/%Y:%H:%M:%S.%{msec_frac}t %z}t")}},
+		{"{literal} %h {%u}", []token{lit("{literal} "), dir("%h"), lit(" {"), dir("%u"), lit("}")}},
+		{"%hfoo%{X}i}bar", []token{dir("%h"), lit("foo"), dir("%{X}i"), lit("}bar")}},
+		{"%>s %^FB", []token{dir("%>s"), lit(" "), dir("%^FB")}},
+		{"prefix %s", []token{lit("prefix "), dir("%s")}},
+		{"%s", []token{dir("%s")}},
+		{"%h \"%{User-agent}i", []token{dir("%h"), lit(" \""), dir("%{User-agent}i")}},
+		{"%s%b", []token{dir("%s"), dir("%b")}},
+		{"", nil},
+	}
+
+	for _, tt := range tests {
+		tokens, err := parseFormat(tt.format, nil)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", tt.format, err)
+		}
+		if !reflect.DeepEqual(tokens, tt.tokens) {
+			t.Errorf("wrong tokens for %q: got %+v expect %+v", tt.format, tokens, tt.tokens)
+		}
+	}
+}
+
+func TestParseFormatCondition(t *testing.T) {
+	tokens, err := parseFormat("%!200,304{Referer}i", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []token{{directive: "%{Referer}i", cond: &condition{negate: true, statuses: []int{200, 304}}}}
+	if !reflect.DeepEqual(tokens, want) {
+		t.Errorf("wrong tokens: got %+v expect %+v", tokens, want)
+	}
+}
+
+func TestCompileSegments(t *testing.T) {
+	custom := map[byte]DirectiveFunc{
+		'i': func(w ResponseInfo, r *http.Request, arg string) string { return arg },
+		'h': func(w ResponseInfo, r *http.Request, arg string) string { return arg },
+	}
+	tokens, _ := parseFormat("%h %>s %{Referer}i %{sec}t %{req}B %{tid}P %{cpu}P %{x}B %z 100%%", custom)
+	want := []directiveKind{
+		kindRemoteHost, kindLiteral, kindFinalStatus, kindLiteral, kindCustom, kindLiteral, kindTimeFormat, kindLiteral,
+		kindBodyBytesRead, kindLiteral, kindTID, kindLiteral, kindUnknown, kindLiteral, kindUnknown, kindLiteral, kindUnknown,
+		kindLiteral, kindPercent,
+	}
+
+	segments := compileSegments(tokens, custom)
+	if len(segments) != len(want) {
+		t.Fatalf("wrong segments: got %+v", segments)
+	}
+	for i, seg := range segments {
+		if seg.kind != want[i] {
+			t.Errorf("wrong kind of %q: got %v expect %v", tokens[i].directive+tokens[i].literal, seg.kind, want[i])
+		}
+	}
+	if seg := segments[4]; seg.arg != "Referer" || seg.custom == nil {
+		t.Errorf("wrong segment: got %+v", seg)
+	}
+}
+
+func TestShortEnclosures(t *testing.T) {
+	req := httptest.NewRequest("GET", "/testing", nil)
+	req.Header.Set("A", "1")
+
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%{}i|%{a}i|%{}o|%{}t|%{}x|%{Referer}|%{X}", WithOutput(buf), WithHeaderPlaceholder("?"))
+	aLog(http.HandlerFunc(HandlerTesting)).ServeHTTP(httptest.NewRecorder(), req)
+
+	// empty labels render the placeholder, the enclosures without a letter are literal text
+	want := "?|1|?|-|-|%{Referer}|%{X}\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+}
+
+// checkFormat checks that format is parsed and rendered without losing any part of it
+func checkFormat(t *testing.T, format string) {
+	tokens, err := parseFormat(format, nil)
+
+	// every byte of the format is in a token, unless rewritten by escapes or conditions
+	if !strings.ContainsAny(format, `\!,0123456789`) {
+		var sb strings.Builder
+		for _, tok := range tokens {
+			sb.WriteString(tok.literal)
+			sb.WriteString(tok.directive)
+		}
+		if sb.String() != format {
+			t.Errorf("wrong tokens for %q: got %q", format, sb.String())
+		}
+	}
+
+	// the formats accepted in strict mode only have known directives
+	if err == nil {
+		for _, seg := range compileSegments(tokens, nil) {
+			if seg.kind == kindUnknown {
+				t.Errorf("unknown directive %q accepted in %q", seg.directive, format)
+			}
+		}
+	}
+
+	// the literal text is written in order, without being taken into the directives around it
+	buf := new(bytes.Buffer)
+	aLog := FormatWith(format, WithOutput(buf), WithLineTerminator(""))
+	aLog(http.HandlerFunc(HandlerTesting)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	out := buf.String()
+	for _, tok := range tokens {
+		if len(tok.literal) == 0 {
+			continue
+		}
+		i := strings.Index(out, tok.literal)
+		if i < 0 {
+			t.Errorf("literal %q of %q missing from %q", tok.literal, format, buf.String())
+			return
+		}
+		out = out[i+len(tok.literal):]
+	}
+}
+
+func TestFormatRandom(t *testing.T) {
+	const alphabet = "%%%{{}}>^iotxBPaHs -"
+	rnd := rand.New(rand.NewPCG(1, 2))
+	for range 5000 {
+		b := make([]byte, rnd.IntN(12))
+		for i := range b {
+			b[i] = alphabet[rnd.IntN(len(alphabet))]
+		}
+		checkFormat(t, string(b))
+	}
+}
+
+func FuzzFormat(f *testing.F) {
+	for _, format := range []string{ApacheCombinedIOLogFormat, "%{}i", "%{a}i", "%{X}", "%{Referer", "%h %>s %{Referer}",
+		"%400,501{User-agent}i", "%{%d/%b/%Y:%H:%M:%S.%{msec_frac}t %z}t", "%^FB%", "100%% \\n"} {
+		f.Add(format)
+	}
+	f.Fuzz(func(t *testing.T, format string) {
+		checkFormat(t, format)
+	})
+}
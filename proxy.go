@@ -0,0 +1,156 @@
+package accesslog
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies is the set of networks whose forwarding headers are honored
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses CIDR ranges or single IP addresses, skipping anything invalid
+func parseTrustedProxies(cidrs ...string) trustedProxies {
+	var tp trustedProxies
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				continue
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			tp = append(tp, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		if _, n, err := net.ParseCIDR(cidr); err == nil {
+			tp = append(tp, n)
+		}
+	}
+	return tp
+}
+
+// contains reports if ip is inside one of the trusted networks
+func (tp trustedProxies) contains(ip net.IP) bool {
+	for _, n := range tp {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIP parses an address that may carry a port or IPv6 brackets
+func parseIP(addr string) net.IP {
+	return net.ParseIP(hostOnly(strings.TrimSpace(addr)))
+}
+
+// clientIP returns the address of the client that sent r. When the direct peer is
+// a trusted proxy the Forwarded and X-Forwarded-For headers are walked from right to left,
+// skipping trusted hops, falling back to X-Real-IP and then the peer address itself.
+func (tp trustedProxies) clientIP(r *http.Request) string {
+	peer := hostOnly(r.RemoteAddr)
+	if len(tp) == 0 || !tp.trustedPeer(r) {
+		return peer
+	}
+
+	if elems := parseForwarded(r.Header.Values("Forwarded")); len(elems) > 0 {
+		if i := tp.forwardedClient(elems); i >= 0 {
+			return forwardedFor(elems[i])
+		}
+	}
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := parseIP(hops[i])
+			if ip == nil {
+				break
+			}
+			if !tp.contains(ip) {
+				return ip.String()
+			}
+		}
+	}
+	if ip := parseIP(r.Header.Get("X-Real-IP")); ip != nil {
+		return ip.String()
+	}
+	return peer
+}
+
+// trustedPeer reports if the direct peer of r is a trusted proxy
+func (tp trustedProxies) trustedPeer(r *http.Request) bool {
+	ip := net.ParseIP(hostOnly(r.RemoteAddr))
+	return ip != nil && tp.contains(ip)
+}
+
+// forwardedElement is one comma separated element of a RFC 7239 Forwarded header,
+// holding its lowercased parameter names and unquoted values
+type forwardedElement map[string]string
+
+// parseForwarded parses the values of the Forwarded headers into elements, in order
+func parseForwarded(values []string) []forwardedElement {
+	var elems []forwardedElement
+	for _, v := range values {
+		for _, el := range strings.Split(v, ",") {
+			fe := make(forwardedElement)
+			for _, pair := range strings.Split(el, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 {
+					continue
+				}
+				val := kv[1]
+				if len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"' {
+					val = strings.Replace(val[1:len(val)-1], `\`, "", -1)
+				}
+				fe[strings.ToLower(kv[0])] = val
+			}
+			elems = append(elems, fe)
+		}
+	}
+	return elems
+}
+
+// forwardedFor returns the node of the for parameter without its port, which is either
+// an IP address or an obfuscated identifier such as "_hidden" or "unknown"
+func forwardedFor(fe forwardedElement) string {
+	node := fe["for"]
+	if ip := parseIP(node); ip != nil {
+		return ip.String()
+	}
+	return node
+}
+
+// forwardedClient walks the Forwarded elements from right to left and returns the index of
+// the first one whose for parameter is not a trusted proxy, or -1 if there is none or it is malformed.
+func (tp trustedProxies) forwardedClient(elems []forwardedElement) int {
+	for i := len(elems) - 1; i >= 0; i-- {
+		node, ok := elems[i]["for"]
+		if !ok || len(node) == 0 {
+			return -1
+		}
+		if ip := parseIP(node); ip != nil && tp.contains(ip) {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+// forwardedParam returns a parameter (proto, host, by or for) of the Forwarded element
+// describing the client, or an empty string if the header can't be trusted or has no such parameter.
+func (tp trustedProxies) forwardedParam(r *http.Request, name string) string {
+	if !tp.trustedPeer(r) {
+		return ""
+	}
+	elems := parseForwarded(r.Header.Values("Forwarded"))
+	i := tp.forwardedClient(elems)
+	if i < 0 {
+		return ""
+	}
+	if name == "for" {
+		return forwardedFor(elems[i])
+	}
+	return elems[i][strings.ToLower(name)]
+}
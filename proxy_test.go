@@ -0,0 +1,88 @@
+package accesslog
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLoggingMiddlewareTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		realIP     string
+		want       string
+	}{
+		{"untrusted peer", "203.0.113.9:1234", []string{"192.0.2.1"}, "", "203.0.113.9"},
+		{"single hop", "10.0.0.1:1234", []string{"192.0.2.1"}, "", "192.0.2.1"},
+		{"multiple hops", "10.0.0.1:1234", []string{"198.51.100.7, 192.0.2.1, 10.0.0.2"}, "", "192.0.2.1"},
+		{"multiple headers", "10.0.0.1:1234", []string{"198.51.100.7", "192.0.2.1, 10.0.0.2"}, "", "192.0.2.1"},
+		{"spoofed", "10.0.0.1:1234", []string{"10.0.0.5, 192.0.2.1"}, "", "192.0.2.1"},
+		{"ipv6", "[fd00::1]:1234", []string{"2001:db8::1, fd00::2"}, "", "2001:db8::1"},
+		{"ipv6 with port", "[fd00::1]:1234", []string{"[2001:db8::1]:4711"}, "", "2001:db8::1"},
+		{"malformed", "10.0.0.1:1234", []string{"garbage"}, "192.0.2.2", "192.0.2.2"},
+		{"malformed no fallback", "10.0.0.1:1234", []string{"garbage"}, "also garbage", "10.0.0.1"},
+		{"all trusted", "10.0.0.1:1234", []string{"10.0.0.3"}, "", "10.0.0.1"},
+		{"real ip", "10.0.0.1:1234", nil, "192.0.2.3", "192.0.2.3"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = tt.remoteAddr
+		for _, v := range tt.xff {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+		if len(tt.realIP) > 0 {
+			req.Header.Set("X-Real-IP", tt.realIP)
+		}
+
+		buf := new(bytes.Buffer)
+		aLog := FormatWith("%h %a", WithOutput(buf), WithTrustedProxies("10.0.0.0/8", "fd00::/8", "not a cidr"))
+		handler := aLog(http.HandlerFunc(HandlerTesting))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		want := tt.want + " " + tt.want + "\n"
+		if buf.String() != want {
+			t.Errorf("%s: wrong log line: got %v expect %v", tt.name, buf.String(), want)
+		}
+	}
+}
+
+func TestLoggingMiddlewareForwarded(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"ipv4", "10.0.0.1:1234", "for=192.0.2.60;proto=https;by=203.0.113.43", "192.0.2.60 192.0.2.60 https 203.0.113.43"},
+		{"quoted ipv6", "10.0.0.1:1234", `for="[2001:db8::1]:4711";proto=http`, "2001:db8::1 2001:db8::1 http -"},
+		{"obfuscated", "10.0.0.1:1234", "for=_hidden;proto=https", "_hidden _hidden https -"},
+		{"trusted hops", "10.0.0.1:1234", "for=192.0.2.43;proto=https, for=10.0.0.2;proto=http", "192.0.2.43 192.0.2.43 https -"},
+		{"untrusted peer", "203.0.113.9:1234", "for=192.0.2.60;proto=https", "203.0.113.9 203.0.113.9 - -"},
+		{"malformed", "10.0.0.1:1234", "proto=https", "10.0.0.1 10.0.0.1 - -"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = tt.remoteAddr
+		req.Header.Set("Forwarded", tt.forwarded)
+
+		buf := new(bytes.Buffer)
+		aLog := FormatWith("%h %a %{proto}F %{by}F", WithOutput(buf), WithTrustedProxies("10.0.0.0/8"))
+		handler := aLog(http.HandlerFunc(HandlerTesting))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if buf.String() != tt.want+"\n" {
+			t.Errorf("%s: wrong log line: got %v expect %v", tt.name, buf.String(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build race
+
+package accesslog
+
+func init() {
+	// the race detector drops items put in a sync.Pool at random
+	raceEnabled = true
+}
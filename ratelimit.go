@@ -0,0 +1,83 @@
+package accesslog
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitSummaryInterval is the minimum interval between the summaries of suppressed lines
+const rateLimitSummaryInterval = 10 * time.Second
+
+// WithRateLimit limits the log output to linesPerSecond lines, with bursts of up to burst lines.
+// Lines over the limit are suppressed, and a summary such as
+// "accesslog: 1523 lines suppressed in last 10s" is written before the next line logged,
+// at most every 10 seconds, and by the Close of WithCloser for the lines suppressed since the last one.
+// The summary goes where the lines go, as the message of a record with WithSlog,
+// and to the error handler with WithEntryOnly.
+func WithRateLimit(linesPerSecond int, burst int) optFunc {
+	return func(o *opt) {
+		if burst < 1 {
+			burst = 1
+		}
+		o.RateLimit = &rateLimiter{rate: float64(linesPerSecond), burst: float64(burst), tokens: float64(burst)}
+	}
+}
+
+// rateLimiter is a token bucket counting the lines it suppresses
+type rateLimiter struct {
+	rate, burst float64
+
+	mu         sync.Mutex
+	tokens     float64
+	last       time.Time // of the last refill
+	suppressed int
+	since      time.Time // the start of the current summary period
+}
+
+// allow reports whether a line can be logged at now, with the summary of the lines
+// suppressed before it when one is due
+func (l *rateLimiter) allow(now time.Time) (ok bool, summary string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	if l.since.IsZero() {
+		l.since = now
+	}
+
+	if l.tokens < 1 {
+		l.suppressed++
+		return false, ""
+	}
+	l.tokens--
+	if now.Sub(l.since) >= rateLimitSummaryInterval {
+		summary = l.summary(now)
+	}
+	return true, summary
+}
+
+// pending returns the summary of the lines suppressed since the last one at now, if any
+func (l *rateLimiter) pending(now time.Time) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.summary(now)
+}
+
+// summary returns the summary of the lines suppressed and starts a new period,
+// or "" if none was, l.mu must be held
+func (l *rateLimiter) summary(now time.Time) string {
+	if l.suppressed == 0 {
+		return ""
+	}
+	s := "accesslog: " + strconv.Itoa(l.suppressed) + " lines suppressed in last " +
+		now.Sub(l.since).Round(time.Second).String()
+	l.suppressed, l.since = 0, now
+	return s
+}
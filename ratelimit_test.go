@@ -0,0 +1,102 @@
+package accesslog
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// serveN serves n requests for path with handler
+func serveN(t *testing.T, handler http.Handler, path string, n int) {
+	for i := 0; i < n; i++ {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+func TestWithRateLimit(t *testing.T) {
+	clock := time.Date(2013, time.February, 3, 19, 54, 0, 0, time.UTC)
+	buf := new(bytes.Buffer)
+	var closer Closer
+	aLog := FormatWith("%U", WithOutput(buf), WithRateLimit(1, 2), WithNowFunc(func() time.Time { return clock }), WithCloser(&closer))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+
+	serveN(t, handler, "/burst", 5)
+	clock = clock.Add(time.Second)
+	serveN(t, handler, "/second", 3)
+	clock = clock.Add(10 * time.Second)
+	serveN(t, handler, "/later", 1)
+	serveN(t, handler, "/last", 3)
+	clock = clock.Add(time.Second)
+	if err := closer.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "/burst\n/burst\n/second\n" +
+		"accesslog: 5 lines suppressed in last 11s\n/later\n/last\n" +
+		"accesslog: 2 lines suppressed in last 1s\n"
+	if buf.String() != want {
+		t.Errorf("wrong log lines: got %q expect %q", buf.String(), want)
+	}
+}
+
+func TestWithRateLimitAsync(t *testing.T) {
+	clock := time.Date(2013, time.February, 3, 19, 54, 0, 0, time.UTC)
+	buf := new(syncBuffer)
+	release := make(chan struct{})
+	var closer Closer
+	aLog := FormatWith("%U", WithOutput(buf), WithRateLimit(1, 1), WithNowFunc(func() time.Time { return clock }),
+		WithAsync(16, DropNone), WithCloser(&closer), WithEntryHandler(func(e LogEntry) { <-release }))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+
+	// the queued lines are blocked until the summary is logged
+	serveN(t, handler, "/x", 3)
+	clock = clock.Add(10 * time.Second)
+	serveN(t, handler, "/y", 1)
+	close(release)
+	if err := closer.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "/x\naccesslog: 2 lines suppressed in last 10s\n/y\n"
+	if buf.String() != want {
+		t.Errorf("wrong log lines: got %q expect %q", buf.String(), want)
+	}
+}
+
+func TestWithRateLimitSlog(t *testing.T) {
+	clock := time.Date(2013, time.February, 3, 19, 54, 0, 0, time.UTC)
+	out, buf := new(bytes.Buffer), new(bytes.Buffer)
+	logger := slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	var errs []error
+	var closer Closer
+	aLog := FormatWith("%U", WithOutput(out), WithSlog(logger, slog.LevelInfo), WithRateLimit(1, 1),
+		WithNowFunc(func() time.Time { return clock }), WithErrorHandler(func(err error) { errs = append(errs, err) }), WithCloser(&closer))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+
+	serveN(t, handler, "/x", 3)
+	if err := closer.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.Len() > 0 || len(errs) > 0 {
+		t.Errorf("unexpected log line %q or errors %v", out.String(), errs)
+	}
+	if want := `level=INFO msg="accesslog: 2 lines suppressed in last 0s"`; !bytes.Contains(buf.Bytes(), []byte(want)) {
+		t.Errorf("wrong records: got %v expect %v", buf.String(), want)
+	}
+}
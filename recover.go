@@ -0,0 +1,52 @@
+package accesslog
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// WithRecoverPanics logs the requests whose handler panics, which are otherwise never logged,
+// with the final status 500, the panic message in %{panic}e and the stack of the goroutine
+// where the handler panicked in %{stack}e. The panic is then raised again for the server,
+// unless WithPanicResponse is set, and the stack printed by the server starts in the middleware
+// rather than at the panic. Off by default.
+func WithRecoverPanics(enabled bool) optFunc {
+	return func(o *opt) {
+		o.RecoverPanics = enabled
+	}
+}
+
+// WithPanicResponse stops the panics recovered with WithRecoverPanics, replying
+// 500 Internal Server Error when nothing was written yet.
+func WithPanicResponse() optFunc {
+	return func(o *opt) {
+		o.PanicResponse = true
+	}
+}
+
+// serveRecover serves the request, returning the value of the panic of the handler, if any,
+// and the stack where it panicked
+func serveRecover(next http.Handler, w http.ResponseWriter, r *http.Request) (p any, stack []byte) {
+	defer func() {
+		if p = recover(); p != nil {
+			// the frames of the panic are still on the stack while deferred calls run
+			stack = debug.Stack()
+		}
+	}()
+	next.ServeHTTP(w, r)
+	return nil, nil
+}
+
+// recovered records the panic p of the handler for the log line, replying 500 when
+// the panic stops here and nothing was written yet
+func (o *opt) recovered(rw *responseWriter, r *http.Request, p any, stack []byte) {
+	SetVar(r, "panic", fmt.Sprint(p))
+	SetVar(r, "stack", string(stack))
+	if o.PanicResponse && rw.status == 0 && !rw.hijacked {
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	rw.latchStatus(http.StatusInternalServerError)
+	rw.finalStatus = http.StatusInternalServerError
+}
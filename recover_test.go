@@ -0,0 +1,73 @@
+package accesslog
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWithRecoverPanics(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []optFunc
+		write    bool
+		repanic  bool
+		want     string
+		wantCode int
+	}{
+		{"repanic", []optFunc{WithRecoverPanics(true)}, false, true, "500 500 boom\n", 200},
+		{"repanic after write", []optFunc{WithRecoverPanics(true)}, true, true, "200 500 boom\n", 200},
+		{"response", []optFunc{WithRecoverPanics(true), WithPanicResponse()}, false, false, "500 500 boom\n", 500},
+		{"response after write", []optFunc{WithRecoverPanics(true), WithPanicResponse()}, true, false, "200 500 boom\n", 200},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		aLog := FormatWith("%s %>s %{panic}e", append(tt.opts, WithOutput(buf))...)
+		handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tt.write {
+				io.WriteString(w, "partial")
+			}
+			panic("boom")
+		}))
+
+		rr := httptest.NewRecorder()
+		func() {
+			defer func() {
+				if p := recover(); (p != nil) != tt.repanic {
+					t.Errorf("%s: wrong panic: got %v", tt.name, p)
+				}
+			}()
+			handler.ServeHTTP(rr, req)
+		}()
+
+		if buf.String() != tt.want {
+			t.Errorf("%s: wrong log line: got %q expect %q", tt.name, buf.String(), tt.want)
+		}
+		if rr.Code != tt.wantCode {
+			t.Errorf("%s: wrong status: got %v expect %v", tt.name, rr.Code, tt.wantCode)
+		}
+	}
+}
+
+// panicHandler is a named handler, so that the stack of its panic can be recognized
+func panicHandler(w http.ResponseWriter, r *http.Request) {
+	panic("boom")
+}
+
+func TestWithRecoverPanicsStack(t *testing.T) {
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%{stack}e", WithOutput(buf), WithRecoverPanics(true), WithPanicResponse())
+	aLog(http.HandlerFunc(panicHandler)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if !strings.Contains(buf.String(), "panicHandler") {
+		t.Errorf("wrong log line: got %q expect the stack of panicHandler", buf.String())
+	}
+}
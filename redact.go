@@ -0,0 +1,119 @@
+package accesslog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+// RedactedValue replaces the values of the headers and query parameters set with
+// WithRedactHeaders and WithRedactQueryParams
+const RedactedValue = "[REDACTED]"
+
+// redactor replaces the values of sensitive request headers and query parameters
+type redactor struct {
+	headers map[string]bool // canonical header names
+	params  map[string]bool // unescaped query parameter names
+	hash    bool
+}
+
+// WithRedactHeaders replaces the values of the request and response headers names with
+// RedactedValue, or their hash with WithRedactHash, e.g. WithRedactHeaders("Authorization", "Cookie").
+// The values are replaced in the %{...}i and %{...}o directives, the nginx $http_..., $sent_http_...
+// and $cookie_... variables, and the Header of the LogEntry.
+func WithRedactHeaders(names ...string) optFunc {
+	return func(o *opt) {
+		rd := o.redactor()
+		for _, name := range names {
+			rd.headers[textproto.CanonicalMIMEHeaderKey(name)] = true
+		}
+	}
+}
+
+// WithRedactQueryParams replaces the values of the query parameters names with RedactedValue,
+// or their hash with WithRedactHash, e.g. WithRedactQueryParams("token", "key") logs
+// /login?user=bob&token=[REDACTED]. The values are replaced in the %r and %q directives,
+// the Query of the LogEntry and the request URI and query of the other formats.
+// The %U directive is the path, it has no query.
+func WithRedactQueryParams(names ...string) optFunc {
+	return func(o *opt) {
+		rd := o.redactor()
+		for _, name := range names {
+			rd.params[name] = true
+		}
+	}
+}
+
+// WithRedactHash replaces the redacted values with a prefix of their SHA-256 hash instead of
+// RedactedValue, e.g. sha256:2c26b46b68ff, so that requests with the same value can be correlated.
+func WithRedactHash() optFunc {
+	return func(o *opt) {
+		o.redactor().hash = true
+	}
+}
+
+// redactor returns the redactor of the options, creating it if needed
+func (o *opt) redactor() *redactor {
+	if o.Redactor == nil {
+		o.Redactor = &redactor{headers: map[string]bool{}, params: map[string]bool{}}
+	}
+	return o.Redactor
+}
+
+// value returns the replacement of the sensitive value v
+func (rd *redactor) value(v string) string {
+	if !rd.hash {
+		return RedactedValue
+	}
+	sum := sha256.Sum256([]byte(v))
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
+
+// header reports whether the values of the header name, in canonical form, are redacted
+func (rd *redactor) header(name string) bool {
+	return rd != nil && rd.headers[name]
+}
+
+// headerValue is headerValue with the value replaced if the header is redacted
+func (rd *redactor) headerValue(h http.Header, name, missing string) string {
+	v := headerValue(h, name, missing)
+	if !rd.header(name) || len(h[name]) == 0 {
+		return v
+	}
+	return rd.value(v)
+}
+
+// query returns the raw query with the values of the redacted parameters replaced,
+// the other parameters are kept as they are, in order
+func (rd *redactor) query(raw string) string {
+	if rd == nil || len(rd.params) == 0 || len(raw) == 0 {
+		return raw
+	}
+	var sb strings.Builder
+	for i, param := range strings.Split(raw, "&") {
+		if i > 0 {
+			sb.WriteByte('&')
+		}
+		key, val, ok := strings.Cut(param, "=")
+		if name, err := url.QueryUnescape(key); ok && len(val) > 0 && (rd.params[key] || err == nil && rd.params[name]) {
+			sb.WriteString(key)
+			sb.WriteByte('=')
+			sb.WriteString(rd.value(val))
+			continue
+		}
+		sb.WriteString(param)
+	}
+	return sb.String()
+}
+
+// uri returns the request URI with the query redacted
+func (rd *redactor) uri(uri string) string {
+	path, raw, ok := strings.Cut(uri, "?")
+	if !ok || rd == nil || len(rd.params) == 0 {
+		return uri
+	}
+	return path + "?" + rd.query(raw)
+}
@@ -0,0 +1,95 @@
+package accesslog
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// redactRequest returns a request carrying a token in its query and headers
+func redactRequest(t *testing.T) *http.Request {
+	req, err := http.NewRequest("GET", "/login?user=bob&token=abc&api%5Fkey=k&token=", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("User-Agent", "Go testing")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	return req
+}
+
+// redactHandler sets a session cookie in the response
+func redactHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Set-Cookie", "session=abc\x01")
+	HandlerTesting(w, r)
+}
+
+func TestWithRedact(t *testing.T) {
+	tests := []struct {
+		opts []optFunc
+		want string
+	}{
+		{
+			nil,
+			`GET /login?user=bob&token=abc&api%5Fkey=k&token= HTTP/1.1|/login|?user=bob&token=abc&api%5Fkey=k&token=|` +
+				`Bearer secret|session=abc\x01|-|Go testing`,
+		},
+		{
+			[]optFunc{WithRedactHeaders("authorization", "Set-Cookie", "X-Missing"), WithRedactQueryParams("token", "api_key")},
+			`GET /login?user=bob&token=[REDACTED]&api%5Fkey=[REDACTED]&token= HTTP/1.1|/login|` +
+				`?user=bob&token=[REDACTED]&api%5Fkey=[REDACTED]&token=|[REDACTED]|[REDACTED]|-|Go testing`,
+		},
+		{
+			[]optFunc{WithRedactHeaders("Authorization"), WithRedactQueryParams("token"), WithRedactHash()},
+			`GET /login?user=bob&token=sha256:ba7816bf8f01&api%5Fkey=k&token= HTTP/1.1|/login|` +
+				`?user=bob&token=sha256:ba7816bf8f01&api%5Fkey=k&token=|sha256:bffde2041334|session=abc\x01|-|Go testing`,
+		},
+	}
+
+	for _, tt := range tests {
+		buf := new(bytes.Buffer)
+		aLog := FormatWith("%r|%U|%q|%{Authorization}i|%{Set-Cookie}o|%{X-Missing}i|%{User-Agent}i", append(tt.opts, WithOutput(buf))...)
+		aLog(http.HandlerFunc(redactHandler)).ServeHTTP(httptest.NewRecorder(), redactRequest(t))
+
+		if buf.String() != tt.want+"\n" {
+			t.Errorf("wrong log line: got %v expect %v", buf.String(), tt.want)
+		}
+	}
+}
+
+func TestWithRedactSinks(t *testing.T) {
+	opts := []optFunc{WithRedactHeaders("Authorization", "Cookie"), WithRedactQueryParams("token")}
+
+	buf := new(bytes.Buffer)
+	aLog := JSONFormat(map[string]string{"auth": "%{Authorization}i", "query": "%q"}, append(opts, WithOutput(buf))...)
+	aLog(http.HandlerFunc(HandlerTesting)).ServeHTTP(httptest.NewRecorder(), redactRequest(t))
+	want := `{"auth":"[REDACTED]","query":"?user=bob&token=[REDACTED]&api%5Fkey=k&token="}` + "\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+
+	buf.Reset()
+	nLog, err := NginxFormat("$args $http_authorization $cookie_session", append(opts, WithOutput(buf))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nLog(http.HandlerFunc(HandlerTesting)).ServeHTTP(httptest.NewRecorder(), redactRequest(t))
+	want = "user=bob&token=[REDACTED]&api%5Fkey=k&token= [REDACTED] [REDACTED]\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+
+	var entry LogEntry
+	eLog := FormatWith("%r", append(opts, WithEntryOnly(), WithEntryHeaders("authorization", "User-Agent"),
+		WithEntryHandler(func(e LogEntry) { entry = e }))...)
+	eLog(http.HandlerFunc(HandlerTesting)).ServeHTTP(httptest.NewRecorder(), redactRequest(t))
+	if want := "user=bob&token=[REDACTED]&api%5Fkey=k&token="; entry.Query != want {
+		t.Errorf("wrong entry query: got %v expect %v", entry.Query, want)
+	}
+	wantHeader := http.Header{"Authorization": {"[REDACTED]"}, "User-Agent": {"Go testing"}}
+	if !reflect.DeepEqual(entry.Header, wantHeader) {
+		t.Errorf("wrong entry headers: got %v expect %v", entry.Header, wantHeader)
+	}
+}
@@ -0,0 +1,33 @@
+package accesslog
+
+import "errors"
+
+// Reopener is implemented by outputs that can reopen their file, such as the outputs
+// of WithFile and WithFilePattern.
+type Reopener interface {
+	Reopen() error
+}
+
+// errNotReopenable is returned when reopening an output that is not a file opened by the middleware
+var errNotReopenable = errors.New("accesslog: output can not be reopened")
+
+// outputReopener reopens the output of the options, whichever output option was applied last
+type outputReopener struct {
+	o *opt
+}
+
+func (r outputReopener) Reopen() error {
+	if out, ok := r.o.Output.(Reopener); ok {
+		return out.Reopen()
+	}
+	r.o.error(errNotReopenable)
+	return errNotReopenable
+}
+
+// WithReopener sets *r to a handle reopening the log file of the middleware, e.g. to be passed
+// to HandleSIGHUP. Reopening outputs other than those of WithFile and WithFilePattern fails.
+func WithReopener(r *Reopener) optFunc {
+	return func(o *opt) {
+		*r = outputReopener{o}
+	}
+}
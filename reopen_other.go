@@ -0,0 +1,9 @@
+//go:build !unix
+
+package accesslog
+
+// HandleSIGHUP does nothing on this platform, which has no SIGHUP,
+// the reopeners can still be called directly.
+func HandleSIGHUP(reopeners ...Reopener) (stop func()) {
+	return func() {}
+}
@@ -0,0 +1,115 @@
+package accesslog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+
+	tests := []struct {
+		name string
+		opt  optFunc
+	}{
+		{"file", WithFile(path, 0, 0)},
+		{"pattern", WithFilePattern(path)},
+	}
+
+	for _, tt := range tests {
+		var reopener Reopener
+		aLog := FormatWith("%U", tt.opt, WithReopener(&reopener), WithErrorHandler(func(err error) { t.Error(err) }))
+		handler := aLog(http.HandlerFunc(HandlerTesting))
+
+		serve := func(path string) {
+			req, err := http.NewRequest("GET", path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		serve("/before")
+		if err := os.Rename(path, path+".1"); err != nil {
+			t.Fatal(err)
+		}
+		serve("/renamed")
+		if err := reopener.Reopen(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		serve("/after")
+
+		for name, want := range map[string]string{path + ".1": "/before\n/renamed\n", path: "/after\n"} {
+			b, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != want {
+				t.Errorf("%s: wrong log file %s: got %q expect %q", tt.name, name, b, want)
+			}
+		}
+		os.Remove(path)
+	}
+}
+
+func TestReopenPreamble(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	clock := time.Date(2013, time.February, 3, 19, 54, 0, 0, time.UTC)
+
+	for _, opt := range []optFunc{WithFile(path, 0, 0), WithFilePattern(path)} {
+		var reopener Reopener
+		aLog := W3CFormat("cs-uri-stem")(opt, WithReopener(&reopener), WithNowFunc(func() time.Time { return clock }),
+			WithErrorHandler(func(err error) { t.Error(err) }))
+		handler := aLog(http.HandlerFunc(HandlerTesting))
+		serve := func(path string) {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		}
+
+		serve("/before")
+		if err := os.Rename(path, path+".1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := reopener.Reopen(); err != nil {
+			t.Fatal(err)
+		}
+		serve("/after")
+		// reopening a file which was not renamed keeps appending to it
+		if err := reopener.Reopen(); err != nil {
+			t.Fatal(err)
+		}
+		serve("/again")
+
+		preamble := "#Version: 1.0\n#Date: 2013-02-03 19:54:00\n#Fields: cs-uri-stem\n"
+		for name, want := range map[string]string{path + ".1": preamble + "/before\n", path: preamble + "/after\n/again\n"} {
+			b, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != want {
+				t.Errorf("wrong log file %s: got %q expect %q", name, b, want)
+			}
+		}
+		os.Remove(path)
+	}
+}
+
+func TestReopenOutput(t *testing.T) {
+	var reopener Reopener
+	reported := make(chan error, 1)
+	FormatWith("%U", WithOutput(os.Stderr), WithReopener(&reopener), WithErrorHandler(func(err error) { reported <- err }))
+	if err := reopener.Reopen(); err != errNotReopenable {
+		t.Errorf("wrong error: got %v expect %v", err, errNotReopenable)
+	}
+	if err := <-reported; err != errNotReopenable {
+		t.Errorf("wrong reported error: got %v expect %v", err, errNotReopenable)
+	}
+}
+
+type reopenFunc func() error
+
+func (f reopenFunc) Reopen() error { return f() }
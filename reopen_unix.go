@@ -0,0 +1,34 @@
+//go:build unix
+
+package accesslog
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// HandleSIGHUP reopens the log files of reopeners whenever the process receives SIGHUP,
+// as expected by logrotate. Failures are reported to the error handlers of the middleware.
+// The returned function stops handling the signal.
+func HandleSIGHUP(reopeners ...Reopener) (stop func()) {
+	c := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-c:
+				for _, r := range reopeners {
+					r.Reopen()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
+}
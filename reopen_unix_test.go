@@ -0,0 +1,32 @@
+//go:build unix
+
+package accesslog
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHandleSIGHUP(t *testing.T) {
+	reopened := make(chan bool, 1)
+	stop := HandleSIGHUP(reopenFunc(func() error {
+		reopened <- true
+		return nil
+	}))
+	defer stop()
+
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Signal(syscall.SIGHUP); err != nil {
+		t.Skip(err)
+	}
+	select {
+	case <-reopened:
+	case <-time.After(5 * time.Second):
+		t.Error("not reopened on SIGHUP")
+	}
+}
@@ -0,0 +1,53 @@
+package accesslog
+
+import (
+	"io"
+	"sync"
+)
+
+// WithStatusOutput writes the lines of responses with a final status between min and max,
+// inclusive, to w instead of the output, e.g. WithStatusOutput(400, 599, errorLog).
+// It can be repeated, a line is written to every output whose range matches
+// and to the output only when none does, unless WithStatusOutputCopies is set.
+func WithStatusOutput(min, max int, w io.Writer) optFunc {
+	return func(o *opt) {
+		o.StatusOutputs = append(o.StatusOutputs, &statusOutput{min: min, max: max, w: w})
+	}
+}
+
+// WithStatusOutputCopies writes all lines to the output, the outputs of
+// WithStatusOutput receive copies of the lines of their status range.
+func WithStatusOutputCopies() optFunc {
+	return func(o *opt) {
+		o.StatusCopies = true
+	}
+}
+
+// statusOutput is the output of the lines of a range of statuses
+type statusOutput struct {
+	min, max int
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// writeLine writes the line p of a response with status to the outputs of its status range,
+// or the output if there is none, with a single Write call on each
+func (o *opt) writeLine(status int, p []byte) {
+	var routed bool
+	for _, so := range o.StatusOutputs {
+		if status < so.min || status > so.max {
+			continue
+		}
+		routed = true
+		so.mu.Lock()
+		_, err := so.w.Write(p)
+		so.mu.Unlock()
+		if err != nil {
+			o.error(err)
+		}
+	}
+	if !routed || o.StatusCopies {
+		o.write(p)
+	}
+}
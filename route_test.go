@@ -0,0 +1,62 @@
+package accesslog
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithStatusOutput(t *testing.T) {
+	tests := []struct {
+		status        int
+		copies        bool
+		out, err, srv string
+	}{
+		{http.StatusOK, false, "200\n", "", ""},
+		{http.StatusNotFound, false, "", "404\n", ""},
+		{http.StatusBadGateway, false, "", "502\n", "502\n"},
+		{http.StatusOK, true, "200\n", "", ""},
+		{http.StatusBadGateway, true, "502\n", "502\n", "502\n"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, errs, srv := new(bytes.Buffer), new(bytes.Buffer), new(bytes.Buffer)
+		opts := []optFunc{WithOutput(out), WithStatusOutput(400, 599, errs), WithStatusOutput(500, 599, srv)}
+		if tt.copies {
+			opts = append(opts, WithStatusOutputCopies())
+		}
+		aLog := FormatWith("%>s", opts...)
+		aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+		})).ServeHTTP(httptest.NewRecorder(), req)
+
+		for _, got := range []struct {
+			buf  *bytes.Buffer
+			want string
+		}{{out, tt.out}, {errs, tt.err}, {srv, tt.srv}} {
+			if got.buf.String() != got.want {
+				t.Errorf("wrong log line for %v: got %q expect %q", tt.status, got.buf.String(), got.want)
+			}
+		}
+	}
+}
+
+func TestWithStatusOutputSingleWrite(t *testing.T) {
+	out, errs := new(writeRecorder), new(writeRecorder)
+	aLog := FormatWith("%>s %U", WithOutput(out), WithStatusOutput(400, 599, errs), WithStatusOutputCopies(), WithLineTerminator("\r\n"))
+	aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/missing", nil))
+
+	// the line and its terminator are written with a single call on each output
+	for _, w := range []*writeRecorder{out, errs} {
+		if len(w.writes) != 1 || w.writes[0] != "404 /missing\r\n" {
+			t.Errorf("wrong writes: got %q expect %q", w.writes, "404 /missing\r\n")
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package accesslog
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// WithSampling logs a random sample of the requests at rate, between 0 and 1, e.g. 0.01
+// logs 1% of them. The decision is made once the handler has returned, so that
+// WithSampleExempt can exempt responses by status.
+func WithSampling(rate float64) optFunc {
+	return func(o *opt) {
+		o.Sampler = newSampler(rate)
+	}
+}
+
+// WithSampleExempt sets the function deciding which requests are always logged when sampling,
+// e.g. func(status int, r *http.Request) bool { return status >= 400 }.
+func WithSampleExempt(fn func(status int, r *http.Request) bool) optFunc {
+	return func(o *opt) {
+		o.SampleExempt = fn
+	}
+}
+
+// WithSuppressedCounter counts the requests left out of the log by sampling in n.
+func WithSuppressedCounter(n *atomic.Uint64) optFunc {
+	return func(o *opt) {
+		o.Suppressed = n
+	}
+}
+
+// sampler is a lock-free splitmix64 generator deciding which requests are logged
+type sampler struct {
+	threshold uint64 // requests are logged when the next value is below it
+	all       bool
+	state     atomic.Uint64
+}
+
+func newSampler(rate float64) *sampler {
+	s := new(sampler)
+	switch {
+	case rate >= 1:
+		s.all = true
+	case rate > 0:
+		s.threshold = uint64(rate * (1 << 63) * 2)
+	}
+	s.state.Store(uint64(time.Now().UnixNano()))
+	return s
+}
+
+// keep reports whether the next request is sampled
+func (s *sampler) keep() bool {
+	if s.all {
+		return true
+	}
+	z := s.state.Add(0x9e3779b97f4a7c15)
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z^(z>>31) < s.threshold
+}
+
+// sample reports whether the request is logged when sampling, counting those that are not
+func (o *opt) sample(w *responseWriter, r *http.Request) bool {
+	if o.Sampler == nil || o.SampleExempt != nil && o.SampleExempt(w.finalStatus, r) || o.Sampler.keep() {
+		return true
+	}
+	if o.Suppressed != nil {
+		o.Suppressed.Add(1)
+	}
+	return false
+}
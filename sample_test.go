@@ -0,0 +1,80 @@
+package accesslog
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWithSampling(t *testing.T) {
+	tests := []struct {
+		rate     float64
+		status   int
+		min, max int // expected lines out of 1000
+	}{
+		{1, http.StatusOK, 1000, 1000},
+		{0, http.StatusOK, 0, 0},
+		{0.1, http.StatusOK, 50, 150},
+		{0, http.StatusInternalServerError, 1000, 1000},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		var suppressed atomic.Uint64
+		aLog := FormatWith("%>s", WithOutput(buf), WithSampling(tt.rate), WithSuppressedCounter(&suppressed),
+			WithSampleExempt(func(status int, r *http.Request) bool { return status >= 400 }))
+		handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+		}))
+		for i := 0; i < 1000; i++ {
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		lines := strings.Count(buf.String(), "\n")
+		if lines < tt.min || lines > tt.max {
+			t.Errorf("wrong number of lines at rate %v: got %v expect %v to %v", tt.rate, lines, tt.min, tt.max)
+		}
+		if n := suppressed.Load(); int(n) != 1000-lines {
+			t.Errorf("wrong suppressed count at rate %v: got %v expect %v", tt.rate, n, 1000-lines)
+		}
+	}
+}
+
+func TestWithSamplingDeferred(t *testing.T) {
+	var formatted, dropped atomic.Uint64
+	count := WithDirective('z', func(w ResponseInfo, r *http.Request, arg string) string {
+		formatted.Add(1)
+		return "z"
+	})
+	var flush Flusher
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%z %>s", WithOutput(buf), count, WithSampling(0), WithAsync(1, DropNewest), WithFlusher(&flush),
+		WithErrorHandler(func(err error) { dropped.Add(1) }),
+		WithSampleExempt(func(status int, r *http.Request) bool { return status >= 500 }))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+	for i := 0; i < 100; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/testing", nil))
+	}
+	aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/testing", nil))
+	flush.Flush()
+
+	// the lines sampled out are neither formatted nor queued, so none fills the queue
+	if n := formatted.Load(); n != 1 {
+		t.Errorf("wrong formatted lines: got %v expect %v", n, 1)
+	}
+	if n := dropped.Load(); n != 0 {
+		t.Errorf("wrong dropped lines: got %v expect %v", n, 0)
+	}
+	if buf.String() != "z 502\n" {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), "z 502\n")
+	}
+}
@@ -0,0 +1,47 @@
+package accesslog
+
+import (
+	"net/http"
+	"time"
+)
+
+// WithSkip leaves the requests for which fn returns true out of the log, e.g. health checks.
+// They are still passed through the middleware, so InfoFrom works for them, but nothing
+// is formatted or written. It can be repeated, a request is skipped when any function returns true.
+func WithSkip(fn func(*http.Request) bool) optFunc {
+	return func(o *opt) {
+		if prev := o.Skip; prev != nil {
+			o.Skip = func(r *http.Request) bool { return prev(r) || fn(r) }
+			return
+		}
+		o.Skip = fn
+	}
+}
+
+// WithSkipPaths leaves the requests for the given URL paths out of the log, e.g. "/healthz" and "/metrics".
+func WithSkipPaths(paths ...string) optFunc {
+	skip := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		skip[p] = true
+	}
+	return WithSkip(func(r *http.Request) bool {
+		return skip[r.URL.Path]
+	})
+}
+
+// WithCondition only logs the requests for which fn returns true, e.g. errors and slow requests with
+// func(status int, d time.Duration, r *http.Request) bool { return status >= 400 || d > 500*time.Millisecond }.
+// Unlike WithSkip it is called once the handler has returned, with the final status and the
+// duration logged by %D, and nothing is formatted for the requests it rejects.
+// It can be repeated, a request is logged when all functions return true.
+func WithCondition(fn func(status int, d time.Duration, r *http.Request) bool) optFunc {
+	return func(o *opt) {
+		if prev := o.Condition; prev != nil {
+			o.Condition = func(status int, d time.Duration, r *http.Request) bool {
+				return prev(status, d, r) && fn(status, d, r)
+			}
+			return
+		}
+		o.Condition = fn
+	}
+}
@@ -0,0 +1,113 @@
+package accesslog
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithSkip(t *testing.T) {
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%U", WithOutput(buf), WithSkipPaths("/healthz", "/metrics"),
+		WithSkip(func(r *http.Request) bool { return r.Header.Get("X-Internal") == "1" }))
+	handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := InfoFrom(w); !ok {
+			t.Error("no response info found")
+		}
+		HandlerTesting(w, r)
+	}))
+
+	for _, path := range []string{"/healthz", "/testing", "/metrics", "/internal", "/healthz/deep"} {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(path, "/internal") {
+			req.Header.Set("X-Internal", "1")
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Body.String() != `{"testing": true}` {
+			t.Errorf("wrong response for %v: got %v", path, rr.Body.String())
+		}
+	}
+
+	want := "/testing\n/healthz/deep\n"
+	if buf.String() != want {
+		t.Errorf("wrong log lines: got %q expect %q", buf.String(), want)
+	}
+}
+
+func TestWithCondition(t *testing.T) {
+	clock := time.Date(2013, time.February, 3, 19, 54, 0, 0, time.UTC)
+	buf := new(bytes.Buffer)
+	errorsOrSlow := WithCondition(func(status int, d time.Duration, r *http.Request) bool {
+		return status >= 400 || d >= 500*time.Millisecond
+	})
+	notAdmin := WithCondition(func(status int, d time.Duration, r *http.Request) bool {
+		return r.URL.Path != "/admin"
+	})
+	aLog := FormatWith("%>s %D %U", WithOutput(buf), WithNowFunc(func() time.Time { return clock }), errorsOrSlow, notAdmin)
+
+	tests := []struct {
+		path   string
+		status int
+		took   time.Duration
+	}{
+		{"/fast", http.StatusOK, time.Millisecond},
+		{"/missing", http.StatusNotFound, time.Millisecond},
+		{"/slow", http.StatusOK, 500 * time.Millisecond},
+		{"/admin", http.StatusInternalServerError, time.Millisecond},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			clock = clock.Add(tt.took)
+		})).ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	want := "404 1000 /missing\n200 500000 /slow\n"
+	if buf.String() != want {
+		t.Errorf("wrong log lines: got %q expect %q", buf.String(), want)
+	}
+}
+
+func TestSuppress(t *testing.T) {
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%>s %U", WithOutput(buf), WithSampling(0),
+		WithCondition(func(status int, d time.Duration, r *http.Request) bool { return status >= 400 }))
+
+	tests := []struct {
+		path   string
+		status int
+		mark   func(r *http.Request)
+	}{
+		{"/plain", http.StatusNotFound, func(r *http.Request) {}},
+		{"/suppressed", http.StatusNotFound, Suppress},
+		{"/forced", http.StatusOK, ForceLog},
+		{"/unsuppressed", http.StatusOK, func(r *http.Request) { ForceLog(r); Unsuppress(r) }},
+		{"/suppressed-forced", http.StatusNotFound, func(r *http.Request) { ForceLog(r); Suppress(r) }},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tt.mark(r)
+			w.WriteHeader(tt.status)
+		})).ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	want := "200 /forced\n"
+	if buf.String() != want {
+		t.Errorf("wrong log lines: got %q expect %q", buf.String(), want)
+	}
+}
@@ -0,0 +1,65 @@
+package accesslog
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// WithSlog emits each request as a record of logger at level instead of writing a line
+// to the output. The message is the formatted log line and the record has typed
+// attributes: method, path, remote_addr, status, bytes, duration and request_id,
+// when the request has an ID, e.g. logged by %L in the format or received with WithRequestIDHeader.
+func WithSlog(logger *slog.Logger, level slog.Level) optFunc {
+	return func(o *opt) {
+		o.Slog = logger
+		o.SlogLevel = level
+	}
+}
+
+// WithSlogStatusLevels emits the records of responses with a 5xx status at the Error level and
+// those with a 4xx status at the Warn level, when they are above the level set with WithSlog.
+func WithSlogStatusLevels() optFunc {
+	return func(o *opt) {
+		o.SlogStatusLevels = true
+	}
+}
+
+// slogLevel returns the level of the record for a response with status
+func (o *opt) slogLevel(status int) slog.Level {
+	level := o.SlogLevel
+	if !o.SlogStatusLevels {
+		return level
+	}
+	switch {
+	case status >= 500 && level < slog.LevelError:
+		return slog.LevelError
+	case status >= 400 && status < 500 && level < slog.LevelWarn:
+		return slog.LevelWarn
+	}
+	return level
+}
+
+// slogRecord returns the record of the request, with the line rendered by logFunc as its message,
+// or nil if its level is not enabled. The record is handled later, possibly on another goroutine.
+func slogRecord(o *opt, w *responseWriter, r *http.Request, logFunc func(w *responseWriter, r *http.Request) string) *slog.Record {
+	level := o.slogLevel(w.finalStatus)
+	if !o.Slog.Enabled(r.Context(), level) {
+		return nil
+	}
+	// the message is rendered first, so the entry has the request ID if %L generated it
+	msg, _ := truncateLine(logFunc(w, r), o.MaxLineLength)
+	e := newEntry(o, w, r)
+	rec := slog.NewRecord(o.now(), level, msg, 0)
+	rec.AddAttrs(
+		slog.String("method", e.Method),
+		slog.String("path", e.Path),
+		slog.String("remote_addr", e.RemoteAddr),
+		slog.Int("status", e.Status),
+		slog.Int64("bytes", int64(e.Bytes)),
+		slog.Duration("duration", e.Duration),
+	)
+	if len(e.RequestID) > 0 {
+		rec.AddAttrs(slog.String("request_id", e.RequestID))
+	}
+	return &rec
+}
@@ -0,0 +1,89 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWithSlog(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Request-Id", "id-1")
+
+	clock := time.Date(2013, time.February, 3, 19, 54, 0, 0, time.UTC)
+	statusHandler := func(status int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			w.Write([]byte("body"))
+			clock = clock.Add(time.Millisecond)
+		})
+	}
+
+	tests := []struct {
+		status int
+		opts   []optFunc
+		want   map[string]any
+	}{
+		{http.StatusOK, nil, map[string]any{"level": "INFO", "msg": "GET /testing HTTP/1.1", "status": 200.0}},
+		{http.StatusNotFound, nil, map[string]any{"level": "INFO", "msg": "GET /testing HTTP/1.1", "status": 404.0}},
+		{http.StatusNotFound, []optFunc{WithSlogStatusLevels()}, map[string]any{"level": "WARN", "msg": "GET /testing HTTP/1.1", "status": 404.0}},
+		{http.StatusBadGateway, []optFunc{WithSlogStatusLevels()}, map[string]any{"level": "ERROR", "msg": "GET /testing HTTP/1.1", "status": 502.0}},
+	}
+
+	for _, tt := range tests {
+		out, buf := new(bytes.Buffer), new(bytes.Buffer)
+		logger := slog.New(slog.NewJSONHandler(buf, nil))
+		opts := append([]optFunc{
+			WithOutput(out),
+			WithNowFunc(func() time.Time { return clock }),
+			WithIDGenerator(func(*http.Request) string { return "generated" }),
+			WithRequestIDHeader("X-Request-Id"),
+			WithSlog(logger, slog.LevelInfo),
+		}, tt.opts...)
+		FormatWith("%r", opts...)(statusHandler(tt.status)).ServeHTTP(httptest.NewRecorder(), req)
+
+		if out.Len() > 0 {
+			t.Errorf("unexpected log line: %v", out.String())
+		}
+		var got map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+			t.Fatalf("invalid record %q: %v", buf.String(), err)
+		}
+		for k, v := range map[string]any{
+			"method": "GET", "path": "/testing", "remote_addr": "10.0.0.1",
+			"bytes": 4.0, "duration": float64(time.Millisecond), "request_id": "id-1",
+			"time": clock.Format(time.RFC3339Nano),
+		} {
+			tt.want[k] = v
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("wrong record: got %v expect %v", got, tt.want)
+		}
+	}
+}
+
+func TestWithSlogStartLine(t *testing.T) {
+	out, buf := new(bytes.Buffer), new(bytes.Buffer)
+	logger := slog.New(slog.NewTextHandler(buf, nil))
+	clock := time.Date(2013, time.February, 3, 19, 54, 0, 0, time.UTC)
+	aLog := FormatWith("%r", WithOutput(out), WithSlog(logger, slog.LevelInfo), WithRequestStartLine("start %r"),
+		WithNowFunc(func() time.Time { return clock }))
+	aLog(http.HandlerFunc(HandlerTesting)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/testing", nil))
+
+	if out.Len() > 0 {
+		t.Errorf("unexpected log line: %v", out.String())
+	}
+	want := `time=2013-02-03T19:54:00.000Z level=INFO msg="start GET /testing HTTP/1.1"` + "\n"
+	if line, _, _ := bytes.Cut(buf.Bytes(), []byte("\n")); string(line)+"\n" != want {
+		t.Errorf("wrong start record: got %v expect %v", buf.String(), want)
+	}
+}
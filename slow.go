@@ -0,0 +1,51 @@
+package accesslog
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WithSlowLog also writes the requests taking threshold or longer to w, in its own format,
+// like a slow query log. Only the lines of slow requests are formatted, and the duration
+// compared is the one logged by %D.
+func WithSlowLog(threshold time.Duration, w io.Writer, format string) optFunc {
+	return func(o *opt) {
+		o.SlowLog = &slowLog{threshold: threshold, w: w, format: format}
+	}
+}
+
+// slowLog is the output of the lines of slow requests
+type slowLog struct {
+	threshold time.Duration
+	format    string
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// slow reports whether the request of w is slow enough to be logged
+func (sl *slowLog) slow(w *responseWriter) bool {
+	return w.end.Sub(w.start) >= sl.threshold
+}
+
+// logFunc returns the function rendering the terminated lines of slow requests, see slow
+func (sl *slowLog) logFunc(o *opt) func(w *responseWriter, r *http.Request) string {
+	tokens, _ := parseFormat(sl.format, o.Directives)
+	logFunc := flatten(o, tokens)
+	return func(w *responseWriter, r *http.Request) string {
+		s, _ := truncateLine(logFunc(w, r), o.MaxLineLength)
+		return s + o.Terminator
+	}
+}
+
+// write writes the line s rendered by the function of logFunc
+func (sl *slowLog) write(o *opt, s string) {
+	sl.mu.Lock()
+	_, err := io.WriteString(sl.w, s)
+	sl.mu.Unlock()
+	if err != nil {
+		o.error(err)
+	}
+}
@@ -0,0 +1,42 @@
+package accesslog
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWithSlowLog(t *testing.T) {
+	tests := []struct {
+		took time.Duration
+		want string
+	}{
+		{499 * time.Millisecond, ""},
+		{500 * time.Millisecond, "500000 GET /testing HTTP/1.1\n"},
+		{2 * time.Second, "2000000 GET /testing HTTP/1.1\n"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock := time.Date(2013, time.February, 3, 19, 54, 0, 0, time.UTC)
+		out, slow := new(bytes.Buffer), new(bytes.Buffer)
+		aLog := FormatWith("%D", WithOutput(out), WithNowFunc(func() time.Time { return clock }),
+			WithSlowLog(500*time.Millisecond, slow, "%D %r"))
+		aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clock = clock.Add(tt.took)
+		})).ServeHTTP(httptest.NewRecorder(), req)
+
+		if slow.String() != tt.want {
+			t.Errorf("wrong slow log line: got %q expect %q", slow.String(), tt.want)
+		}
+		if want := strconv.FormatInt(tt.took.Microseconds(), 10) + "\n"; out.String() != want {
+			t.Errorf("wrong log line: got %q expect %q", out.String(), want)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package accesslog
+
+import "strings"
+
+// responseDirectives are the directives that depend on the response
+var responseDirectives = map[string]bool{
+	"%s": true, "%>s": true, "%b": true, "%B": true, "%D": true, "%T": true, "%I": true,
+	"%O": true, "%X": true, "%^FB": true, "%{push}x": true,
+}
+
+// WithRequestStartLine also writes a line in format to the output when a request enters
+// the middleware, for long running requests such as uploads and streams. Only directives
+// about the request are logged, such as %h, %r, %t, %L, %{tls_protocol}x and %{trace_id}x,
+// those about the response are logged as "-". The request ID of %L is the same in both lines.
+// Start lines go where the lines of finished requests go: a slog record with no attributes
+// with WithSlog, syslog with WithSyslog, the output unless a range of WithStatusOutput
+// includes the status 0, and none with WithEntryOnly. No LogEntry is passed for them.
+func WithRequestStartLine(format string) optFunc {
+	return func(o *opt) {
+		o.StartFormat = format
+	}
+}
+
+// requestTokens returns tokens with the directives about the response replaced by empty
+func requestTokens(tokens []token, empty string) []token {
+	req := make([]token, len(tokens))
+	for i, tok := range tokens {
+		d := tok.directive
+		switch {
+		case len(d) == 0:
+		case tok.cond != nil, responseDirectives[d],
+			strings.HasPrefix(d, "%{") && strings.IndexByte("oT", d[len(d)-1]) >= 0:
+			tok = token{literal: empty}
+		}
+		req[i] = tok
+	}
+	return req
+}
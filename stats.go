@@ -0,0 +1,131 @@
+package accesslog
+
+import (
+	"expvar"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBounds are the upper bounds of the latency histogram buckets of Stats,
+// the last bucket counts the requests slower than the last bound. The bounds are copied
+// by NewCollector, changing them only affects the Collectors created afterwards.
+var LatencyBounds = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Stats is a snapshot of the counters of a Collector.
+type Stats struct {
+	Requests uint64
+
+	// Status counts the requests by status class, Status[1] for 1xx to Status[5] for 5xx,
+	// Status[0] counts the invalid statuses
+	Status [6]uint64
+
+	// Bytes is the number of response body bytes, as %B
+	Bytes uint64
+
+	// Latency counts the requests by duration, Latency[i] for durations up to LatencyBounds[i],
+	// the last element for durations above the last bound
+	Latency       []uint64
+	LatencyBounds []time.Duration // the bounds of the Collector, see the variable LatencyBounds
+	LatencySum    time.Duration
+}
+
+// Collector maintains request counters for the middlewares it is set on with WithCollector.
+// Requests left out of the log by WithSkip are not counted, while those left out by
+// sampling, WithCondition or Suppress are.
+type Collector struct {
+	// mu is read-locked by the requests updating the counters, so they never wait on
+	// each other, and locked by Stats so the snapshot is consistent
+	mu sync.RWMutex
+
+	requests   atomic.Uint64
+	status     [6]atomic.Uint64
+	bytes      atomic.Uint64
+	bounds     []time.Duration // a copy of LatencyBounds, as the Collector was created
+	latency    []atomic.Uint64
+	latencySum atomic.Int64
+}
+
+// NewCollector returns a Collector with all counters at zero.
+func NewCollector() *Collector {
+	bounds := append([]time.Duration(nil), LatencyBounds...)
+	return &Collector{bounds: bounds, latency: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+// WithCollector updates the counters of c for each request.
+// A Collector can be shared by several middlewares.
+func WithCollector(c *Collector) optFunc {
+	return func(o *opt) {
+		o.Collector = c
+	}
+}
+
+// observe counts the request of w once the handler has returned
+func (c *Collector) observe(w *responseWriter, r *http.Request) {
+	ln := line{request: r, writer: w}
+	status := w.finalStatus
+	if status == 0 {
+		status = http.StatusOK
+	}
+	class := status / 100
+	if class < 1 || class > 5 {
+		class = 0
+	}
+	d := w.end.Sub(w.start)
+	bucket := len(c.bounds)
+	for i, bound := range c.bounds {
+		if d <= bound {
+			bucket = i
+			break
+		}
+	}
+
+	c.mu.RLock()
+	c.requests.Add(1)
+	c.status[class].Add(1)
+	c.bytes.Add(uint64(ln.bodyBytes()))
+	c.latency[bucket].Add(1)
+	c.latencySum.Add(int64(d))
+	c.mu.RUnlock()
+}
+
+// Stats returns a snapshot of the counters.
+func (c *Collector) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := Stats{
+		Requests:      c.requests.Load(),
+		Bytes:         c.bytes.Load(),
+		Latency:       make([]uint64, len(c.latency)),
+		LatencyBounds: append([]time.Duration(nil), c.bounds...),
+		LatencySum:    time.Duration(c.latencySum.Load()),
+	}
+	for i := range c.status {
+		s.Status[i] = c.status[i].Load()
+	}
+	for i := range c.latency {
+		s.Latency[i] = c.latency[i].Load()
+	}
+	return s
+}
+
+// Publish exports the Stats of c as the expvar variable name, served as JSON at /debug/vars
+// by the expvar package. Like expvar.Publish, it panics if name is already in use.
+func (c *Collector) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() any {
+		return c.Stats()
+	}))
+}
@@ -0,0 +1,138 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"expvar"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCollectorStats(t *testing.T) {
+	// every call to now advances the clock by 20ms, it is called at the start of the request,
+	// on the first byte written and when the handler returns so each request takes 40ms
+	var mu sync.Mutex
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		clock = clock.Add(20 * time.Millisecond)
+		return clock
+	}
+
+	c := NewCollector()
+	aLog := FormatWith("%>s", WithOutput(io.Discard), WithNowFunc(now), WithCollector(c),
+		WithSkipPaths("/health"), WithSampling(0))
+	handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(r.URL.Query().Get("status"))
+		if status > 0 {
+			w.WriteHeader(status)
+		}
+		io.WriteString(w, "hello")
+	}))
+
+	for _, target := range []string{"/", "/?status=201", "/?status=404", "/?status=500", "/?status=503", "/health"} {
+		for i := 0; i < 10; i++ {
+			req := httptest.NewRequest("GET", target, nil)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+	}
+
+	s := c.Stats()
+	want := [6]uint64{0, 0, 20, 0, 10, 20}
+	if s.Requests != 50 || s.Status != want || s.Bytes != 250 {
+		t.Errorf("wrong stats: got %v %v %v expect %v %v %v", s.Requests, s.Status, s.Bytes, 50, want, 250)
+	}
+	if s.Latency[3] != 50 || s.LatencySum != 2*time.Second {
+		t.Errorf("wrong latency: got %v %v expect %v %v", s.Latency, s.LatencySum, "50 in the 50ms bucket", 2*time.Second)
+	}
+}
+
+func TestCollectorLatencyBounds(t *testing.T) {
+	c := NewCollector()
+	defer func(bounds []time.Duration) { LatencyBounds = bounds }(LatencyBounds)
+	LatencyBounds = append(LatencyBounds, time.Minute)
+
+	aLog := FormatWith("%>s", WithOutput(io.Discard), WithCollector(c))
+	aLog(http.HandlerFunc(HandlerTesting)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if s := c.Stats(); s.Requests != 1 || len(s.Latency) != len(s.LatencyBounds)+1 || len(s.LatencyBounds) != len(LatencyBounds)-1 {
+		t.Errorf("wrong latency buckets: got %v for bounds %v", s.Latency, s.LatencyBounds)
+	}
+}
+
+func TestCollectorConcurrentStats(t *testing.T) {
+	c := NewCollector()
+	handler := FormatWith("%>s", WithOutput(io.Discard), WithCollector(c))(http.HandlerFunc(HandlerTesting))
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// every snapshot taken while requests are counted must be consistent
+	for {
+		s := c.Stats()
+		var latency uint64
+		for _, n := range s.Latency {
+			latency += n
+		}
+		if s.Status[2] != s.Requests || latency != s.Requests {
+			t.Fatalf("inconsistent stats: got %v requests, %v 2xx, %v in the histogram", s.Requests, s.Status[2], latency)
+		}
+		select {
+		case <-done:
+			if s := c.Stats(); s.Requests != 1600 {
+				t.Errorf("wrong requests: got %v expect %v", s.Requests, 1600)
+			}
+			return
+		default:
+		}
+	}
+}
+
+// published makes the expvar names unique when the tests are run several times
+var published int
+
+func TestCollectorPublish(t *testing.T) {
+	published++
+	name := "accesslog_test_" + strconv.Itoa(published)
+	c := NewCollector()
+	c.Publish(name)
+	handler := FormatWith("%>s", WithOutput(io.Discard), WithCollector(c))(http.HandlerFunc(HandlerTesting))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	var s Stats
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Requests != 1 || s.Status[2] != 1 {
+		t.Errorf("wrong published stats: got %v %v expect %v %v", s.Requests, s.Status[2], 1, 1)
+	}
+}
+
+func BenchmarkCollector(b *testing.B) {
+	c := NewCollector()
+	rw := &responseWriter{finalStatus: 200, byteCount: 10}
+	r := httptest.NewRequest("GET", "/", nil)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.observe(rw, r)
+		}
+	})
+}
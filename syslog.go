@@ -0,0 +1,125 @@
+//go:build !windows && !plan9
+
+package accesslog
+
+import (
+	"errors"
+	"log/syslog"
+	"sync"
+)
+
+// syslogQueueSize is the number of lines waiting to be sent before new ones are dropped
+const syslogQueueSize = 1024
+
+// errSyslogDropped is reported when a line is dropped because the syslog queue is full
+var errSyslogDropped = errors.New("accesslog: syslog queue full, line dropped")
+
+// WithSyslog sends the log lines to the syslog daemon at addr over network ("udp", "tcp"),
+// or to the local syslog daemon when both are empty, with the given tag. The severity is
+// derived from the final status: Info for 1xx to 3xx, Warning for 4xx and Err for 5xx.
+// Lines are sent from a background goroutine so an unreachable daemon does not block requests,
+// lines are dropped when it falls behind and failures are reported to the error handler.
+func WithSyslog(network, addr, tag string) optFunc {
+	return func(o *opt) {
+		o.Syslog = &syslogWriter{network: network, addr: addr, tag: tag, errorf: o.error}
+	}
+}
+
+type syslogLine struct {
+	status int
+	line   string
+}
+
+// syslogWriter sends lines to syslog, connecting on first use and after failures
+type syslogWriter struct {
+	network, addr, tag string
+	errorf             func(error)
+
+	start  sync.Once
+	lines  chan syslogLine
+	exited chan struct{}
+	w      *syslog.Writer
+
+	// mu is locked by close, lines are sent synchronously once closed is set,
+	// serialized by syncMu
+	mu     sync.RWMutex
+	closed bool
+	syncMu sync.Mutex
+}
+
+// send queues the line of a response with status, dropping it when the queue is full
+func (s *syslogWriter) send(status int, line string) {
+	s.start.Do(func() {
+		s.lines = make(chan syslogLine, syslogQueueSize)
+		s.exited = make(chan struct{})
+		go s.run()
+	})
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		s.syncMu.Lock()
+		s.deliver(syslogLine{status, line})
+		s.syncMu.Unlock()
+		return
+	}
+	select {
+	case s.lines <- syslogLine{status, line}:
+	default:
+		s.errorf(errSyslogDropped)
+	}
+}
+
+func (s *syslogWriter) run() {
+	defer close(s.exited)
+	for l := range s.lines {
+		s.deliver(l)
+	}
+}
+
+// deliver sends l, connecting first if needed
+func (s *syslogWriter) deliver(l syslogLine) {
+	if s.w == nil {
+		w, err := syslog.Dial(s.network, s.addr, syslog.LOG_USER|syslog.LOG_INFO, s.tag)
+		if err != nil {
+			s.errorf(err)
+			return
+		}
+		s.w = w
+	}
+	if err := s.write(l); err != nil {
+		s.errorf(err)
+		s.w.Close()
+		s.w = nil
+	}
+}
+
+// close sends the queued lines and closes the connection, later lines are sent synchronously
+func (s *syslogWriter) close() error {
+	s.start.Do(func() {})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.lines != nil {
+		close(s.lines)
+		<-s.exited
+	}
+	if s.w == nil {
+		return nil
+	}
+	err := s.w.Close()
+	s.w = nil
+	return err
+}
+
+func (s *syslogWriter) write(l syslogLine) error {
+	switch {
+	case l.status >= 500:
+		return s.w.Err(l.line)
+	case l.status >= 400:
+		return s.w.Warning(l.line)
+	}
+	return s.w.Info(l.line)
+}
@@ -0,0 +1,21 @@
+//go:build windows || plan9
+
+package accesslog
+
+import "errors"
+
+// WithSyslog is not supported on this platform, FormatWithStrict reports it as an error
+// and the log lines are written to the output.
+func WithSyslog(network, addr, tag string) optFunc {
+	return func(o *opt) {
+		if o.Err == nil {
+			o.Err = errors.New("accesslog: syslog is not supported on this platform")
+		}
+	}
+}
+
+type syslogWriter struct{}
+
+func (s *syslogWriter) send(status int, line string) {}
+
+func (s *syslogWriter) close() error { return nil }
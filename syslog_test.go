@@ -0,0 +1,55 @@
+//go:build !windows && !plan9
+
+package accesslog
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithSyslog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+
+	aLog := FormatWith("%>s %U", WithSyslog("udp", conn.LocalAddr().String(), "access"),
+		WithErrorHandler(func(err error) { t.Error(err) }))
+
+	tests := []struct {
+		status   int
+		priority string // LOG_USER with the severity of the status
+	}{
+		{http.StatusOK, "<14>"},
+		{http.StatusNotFound, "<12>"},
+		{http.StatusInternalServerError, "<11>"},
+	}
+
+	buf := make([]byte, 1024)
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+		})).ServeHTTP(httptest.NewRecorder(), req)
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := string(buf[:n])
+		if !strings.HasPrefix(msg, tt.priority) || !strings.Contains(msg, " access[") ||
+			!strings.HasSuffix(msg, ": "+strconv.Itoa(tt.status)+" /testing\n") {
+			t.Errorf("wrong syslog message: got %q", msg)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package accesslog
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// WithOutputs writes each log line to every one of outputs, e.g. os.Stdout and a file.
+// Unlike io.MultiWriter a failing output does not affect the others, its errors are
+// reported to the error handler. The outputs are written one after the other, in order,
+// so a slow output delays the lines of the outputs after it and the request; each output
+// has its own lock, so the lines of other requests can be written to the outputs before it
+// meanwhile. List the fast outputs first, and use WithAsync to keep the writes off the requests.
+func WithOutputs(outputs ...io.Writer) optFunc {
+	return func(o *opt) {
+		t := &teeWriter{o: o, sinks: make([]*sink, len(outputs))}
+		for i, w := range outputs {
+			t.sinks[i] = &sink{w: w}
+		}
+		o.Output = t
+	}
+}
+
+// teeWriter writes to several outputs independently
+type teeWriter struct {
+	o     *opt
+	sinks []*sink
+}
+
+type sink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Write writes p to every output, failures are reported and never returned
+func (t *teeWriter) Write(p []byte) (int, error) {
+	for i, s := range t.sinks {
+		s.mu.Lock()
+		_, err := s.w.Write(p)
+		s.mu.Unlock()
+		if err != nil {
+			t.o.error(fmt.Errorf("accesslog: output %d: %w", i, err))
+		}
+	}
+	return len(p), nil
+}
+
+func (t *teeWriter) locksWrites() {}
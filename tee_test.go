@@ -0,0 +1,29 @@
+package accesslog
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithOutputs(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, file := new(bytes.Buffer), new(bytes.Buffer)
+	reported := make(chan error, 1)
+	aLog := FormatWith("%U", WithOutputs(stdout, failingWriter{}, file), WithErrorHandler(func(err error) { reported <- err }))
+	aLog(http.HandlerFunc(HandlerTesting)).ServeHTTP(httptest.NewRecorder(), req)
+
+	for _, buf := range []*bytes.Buffer{stdout, file} {
+		if buf.String() != "/testing\n" {
+			t.Errorf("wrong log line: got %v expect %v", buf.String(), "/testing\n")
+		}
+	}
+	if err := <-reported; err.Error() != "accesslog: output 1: disk full" {
+		t.Errorf("wrong error: got %v expect %v", err, "accesslog: output 1: disk full")
+	}
+}
@@ -0,0 +1,74 @@
+package accesslog
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// tlsVersions maps the TLS versions to the names logged by Apache's %{SSL_PROTOCOL}x
+var tlsVersions = map[uint16]string{
+	tls.VersionSSL30: "SSLv3",
+	tls.VersionTLS10: "TLSv1",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// tlsVariable returns the value of the TLS connection state variable name,
+// and false if name is not a TLS variable. It is "-" for plaintext requests.
+func tlsVariable(r *http.Request, name string) (string, bool) {
+	switch name {
+	case "tls_protocol", "SSL_PROTOCOL", "tls_cipher", "SSL_CIPHER", "tls_alpn", "tls_sni",
+		"tls_client_s_dn", "tls_client_serial", "tls_client_fingerprint":
+	default:
+		return "", false
+	}
+	cs := r.TLS
+	if cs == nil {
+		return "-", true
+	}
+	var v string
+	switch name {
+	case "tls_protocol", "SSL_PROTOCOL":
+		var ok bool
+		if v, ok = tlsVersions[cs.Version]; !ok {
+			v = tls.VersionName(cs.Version)
+		}
+	case "tls_cipher", "SSL_CIPHER":
+		v = tls.CipherSuiteName(cs.CipherSuite)
+	case "tls_alpn":
+		v = cs.NegotiatedProtocol
+	case "tls_sni":
+		v = cs.ServerName
+	case "tls_client_s_dn", "tls_client_serial", "tls_client_fingerprint":
+		v = clientCertVariable(cs, name)
+	}
+	if len(v) == 0 {
+		return "-", true
+	}
+	return v, true
+}
+
+// clientCertVariable returns the identity of the client certificate, or an empty string
+// if the client did not present one
+func clientCertVariable(cs *tls.ConnectionState, name string) string {
+	if len(cs.PeerCertificates) == 0 {
+		return ""
+	}
+	cert := cs.PeerCertificates[0]
+	switch name {
+	case "tls_client_s_dn":
+		// RDNSequence.String renders the most specific attribute first, as RFC 2253
+		return cert.Subject.ToRDNSequence().String()
+	case "tls_client_serial":
+		// upper case hex, as Apache's SSL_CLIENT_M_SERIAL
+		return strings.ToUpper(cert.SerialNumber.Text(16))
+	case "tls_client_fingerprint":
+		sum := sha256.Sum256(cert.Raw)
+		return hex.EncodeToString(sum[:])
+	}
+	return ""
+}
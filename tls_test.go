@@ -0,0 +1,139 @@
+package accesslog
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTLSVariables(t *testing.T) {
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%{tls_protocol}x %{SSL_CIPHER}x %{tls_alpn}x %{tls_sni}x", WithOutput(buf))
+	var state *tls.ConnectionState
+	ts := httptest.NewUnstartedServer(aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state = r.TLS
+	})))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	// the test certificate is valid for example.com, which the client sends as SNI
+	tr := ts.Client().Transport.(*http.Transport).Clone()
+	tr.TLSClientConfig.ServerName = "example.com"
+	tr.TLSClientConfig.MinVersion = tls.VersionTLS13
+	client := &http.Client{Transport: tr}
+	defer tr.CloseIdleConnections()
+
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	want := "TLSv1.3 " + tls.CipherSuiteName(state.CipherSuite) + " h2 example.com\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+}
+
+func TestTLSVariablesPlaintext(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%{tls_protocol}x %{tls_cipher}x %{tls_alpn}x %{tls_sni}x", WithOutput(buf))
+	handler := aLog(http.HandlerFunc(HandlerTesting))
+	handler.ServeHTTP(rr, req)
+
+	want := "- - - -\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+}
+
+func TestTLSVariablesSanitized(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.TLS = &tls.ConnectionState{Version: tls.VersionTLS13, ServerName: "example.com\n127.0.0.1 - - FAKE"}
+
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%{tls_sni}x", WithOutput(buf))
+	aLog(http.HandlerFunc(HandlerTesting)).ServeHTTP(httptest.NewRecorder(), req)
+
+	want := `example.com\x0a127.0.0.1 - - FAKE` + "\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(0x1a2b3c),
+		Subject: pkix.Name{
+			Country:      []string{"FR"},
+			Organization: []string{"Example"},
+			CommonName:   "client",
+		},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%{tls_client_s_dn}x|%{tls_client_serial}x|%{tls_client_fingerprint}x", WithOutput(buf))
+	ts := httptest.NewUnstartedServer(aLog(http.HandlerFunc(HandlerTesting)))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	tests := []struct {
+		name  string
+		certs []tls.Certificate
+		want  string
+	}{
+		{"none", nil, "-|-|-\n"},
+		{"self-signed", []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+			"CN=client,O=Example,C=FR|1A2B3C|" + fmt.Sprintf("%x", sha256.Sum256(der)) + "\n"},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		tr := ts.Client().Transport.(*http.Transport).Clone()
+		tr.TLSClientConfig.Certificates = tt.certs
+		client := &http.Client{Transport: tr}
+
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		tr.CloseIdleConnections()
+
+		if buf.String() != tt.want {
+			t.Errorf("%s: wrong log line: got %v expect %v", tt.name, buf.String(), tt.want)
+		}
+	}
+}
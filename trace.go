@@ -0,0 +1,71 @@
+package accesslog
+
+import "context"
+
+// WithTraceExtractor sets the function returning the trace and span IDs logged by
+// %{trace_id}x and %{span_id}x, e.g. from the active OpenTelemetry span of the request context.
+// The inbound traceparent header is used when it is not set or returns an empty trace ID.
+func WithTraceExtractor(fn func(context.Context) (traceID, spanID string)) optFunc {
+	return func(o *opt) {
+		o.TraceExtractor = fn
+	}
+}
+
+// traceContext - %{trace_id}x, %{span_id}x
+func (ln *line) traceContext(extract func(context.Context) (string, string)) (string, string) {
+	if len(ln.traceID) == 0 {
+		ln.traceID, ln.spanID = "-", "-"
+		var traceID, spanID string
+		if extract != nil {
+			traceID, spanID = extract(ln.request.Context())
+		}
+		if len(traceID) == 0 {
+			traceID, spanID, _ = parseTraceparent(ln.request.Header.Get("Traceparent"))
+		}
+		if len(traceID) > 0 {
+			ln.traceID = traceID
+		}
+		if len(spanID) > 0 {
+			ln.spanID = spanID
+		}
+	}
+	return ln.traceID, ln.spanID
+}
+
+// parseTraceparent returns the trace and parent span IDs of a W3C Trace Context
+// traceparent header, e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+// Headers of a future version may carry more fields after the flags.
+func parseTraceparent(h string) (traceID, spanID string, ok bool) {
+	if len(h) < 55 || (len(h) > 55 && (h[:2] == "00" || h[55] != '-')) {
+		return "", "", false
+	}
+	if h[2] != '-' || h[35] != '-' || h[52] != '-' {
+		return "", "", false
+	}
+	version, traceID, spanID, flags := h[:2], h[3:35], h[36:52], h[53:55]
+	if version == "ff" || !isLowerHex(version) || !isLowerHex(flags) {
+		return "", "", false
+	}
+	if !isLowerHex(traceID) || isZeros(traceID) || !isLowerHex(spanID) || isZeros(spanID) {
+		return "", "", false
+	}
+	return traceID, spanID, true
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func isZeros(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] != '0' {
+			return false
+		}
+	}
+	return true
+}
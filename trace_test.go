@@ -0,0 +1,78 @@
+package accesslog
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header  string
+		traceID string
+		spanID  string
+		ok      bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", true},
+		{"", "", "", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", "", "", false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01extra", "", "", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "", "", false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", "", "", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "", "", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", "", "", false},
+		{"00_4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "", "", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0g", "", "", false},
+	}
+	for _, tt := range tests {
+		traceID, spanID, ok := parseTraceparent(tt.header)
+		if traceID != tt.traceID || spanID != tt.spanID || ok != tt.ok {
+			t.Errorf("wrong traceparent %q: got %v %v %v expect %v %v %v", tt.header, traceID, spanID, ok, tt.traceID, tt.spanID, tt.ok)
+		}
+	}
+}
+
+func TestLoggingMiddlewareTraceContext(t *testing.T) {
+	extractor := func(ctx context.Context) (string, string) {
+		if v, ok := ctx.Value(contextKey(-1)).(string); ok {
+			return v, "span"
+		}
+		return "", ""
+	}
+	tests := []struct {
+		header string
+		active string
+		opts   []optFunc
+		want   string
+	}{
+		{"", "", nil, "- -\n"},
+		{"garbage", "", nil, "- -\n"},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "", nil, "4bf92f3577b34da6a3ce929d0e0e4736 00f067aa0ba902b7\n"},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "trace", []optFunc{WithTraceExtractor(extractor)}, "trace span\n"},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "", []optFunc{WithTraceExtractor(extractor)}, "4bf92f3577b34da6a3ce929d0e0e4736 00f067aa0ba902b7\n"},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tt.header) > 0 {
+			req.Header.Set("traceparent", tt.header)
+		}
+		if len(tt.active) > 0 {
+			req = req.WithContext(context.WithValue(req.Context(), contextKey(-1), tt.active))
+		}
+
+		buf := new(bytes.Buffer)
+		aLog := FormatWith("%{trace_id}x %{span_id}x", append(tt.opts, WithOutput(buf))...)
+		handler := aLog(http.HandlerFunc(HandlerTesting))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if buf.String() != tt.want {
+			t.Errorf("wrong log line: got %v expect %v", buf.String(), tt.want)
+		}
+	}
+}
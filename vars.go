@@ -0,0 +1,229 @@
+package accesslog
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+)
+
+// contextKey is the type used for the keys this package stores in a request context
+type contextKey int
+
+const (
+	varsContextKey contextKey = iota
+)
+
+// vars is the per-request carrier for values logged by the %{...}e, %{...}n and %L directives.
+// It is installed in the request context by the middleware so that values set
+// by handlers further down the chain are visible when the log line is written.
+// It is itself the context of the request, wrapping the original one, which saves
+// the allocation of a context.WithValue on every request.
+type vars struct {
+	context.Context
+
+	mu sync.Mutex
+	m  map[string]string
+
+	// fields are the notes added by handlers with AddField
+	fields map[string]string
+
+	// mode is set by Suppress and ForceLog
+	mode logMode
+
+	// id is the request ID, generated on first use by newID
+	id    string
+	req   *http.Request
+	newID func(*http.Request) string
+}
+
+// Value returns v for varsContextKey and the values of the wrapped context otherwise
+func (v *vars) Value(key any) any {
+	if key == varsContextKey {
+		return v
+	}
+	return v.Context.Value(key)
+}
+
+func (v *vars) set(key, value string) {
+	v.mu.Lock()
+	if v.m == nil {
+		v.m = make(map[string]string)
+	}
+	v.m[key] = value
+	v.mu.Unlock()
+}
+
+func (v *vars) get(key string) (string, bool) {
+	v.mu.Lock()
+	val, ok := v.m[key]
+	v.mu.Unlock()
+	return val, ok
+}
+
+func (v *vars) setField(key, value string) {
+	v.mu.Lock()
+	if v.fields == nil {
+		v.fields = make(map[string]string)
+	}
+	v.fields[key] = value
+	v.mu.Unlock()
+}
+
+func (v *vars) field(key string) (string, bool) {
+	v.mu.Lock()
+	val, ok := v.fields[key]
+	v.mu.Unlock()
+	return val, ok
+}
+
+// copyFields returns a copy of the fields, or nil if none were added
+func (v *vars) copyFields() map[string]string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.fields) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(v.fields))
+	for key, val := range v.fields {
+		m[key] = val
+	}
+	return m
+}
+
+// existingID returns the request ID if it was received, propagated or generated already, or ""
+func (v *vars) existingID() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.id
+}
+
+func (v *vars) requestID() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.id) == 0 {
+		v.id = v.newID(v.req)
+	}
+	return v.id
+}
+
+// logMode is whether a request was opted out of, or forced into, the log
+type logMode int
+
+const (
+	logDefault logMode = iota
+	logSuppressed
+	logForced
+)
+
+func (v *vars) setMode(m logMode) {
+	v.mu.Lock()
+	v.mode = m
+	v.mu.Unlock()
+}
+
+func (v *vars) getMode() logMode {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.mode
+}
+
+// withVars returns a shallow copy of r carrying the zero vars carrier v as its context,
+// and the generated request ID in its header with WithRequestID
+func withVars(r *http.Request, o *opt, v *vars) *http.Request {
+	v.Context, v.req, v.newID = r.Context(), r, o.IDGenerator
+	if len(o.RequestIDHeader) > 0 {
+		v.id = r.Header.Get(o.RequestIDHeader)
+	}
+	r2 := r.WithContext(v)
+	if o.PropagateID && len(v.id) == 0 {
+		// the header is copied so the generated ID is not added to the caller's request
+		v.id = o.IDGenerator(r)
+		r2.Header = r.Header.Clone()
+		if r2.Header == nil {
+			r2.Header = make(http.Header)
+		}
+		r2.Header.Set(o.RequestIDHeader, v.id)
+	}
+	return r2
+}
+
+// newRequestID returns a random 16-byte hex encoded ID
+func newRequestID(*http.Request) string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "-"
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// SetVar stores a value under key for the request so it can be logged with
+// the %{key}e directive. It does nothing if the request was not passed
+// through the access log middleware.
+func SetVar(r *http.Request, key, value string) {
+	if v, ok := r.Context().Value(varsContextKey).(*vars); ok {
+		v.set(key, value)
+	}
+}
+
+// Var returns the value stored under key with SetVar, or an empty string if it is not set.
+func Var(ctx context.Context, key string) string {
+	if v, ok := ctx.Value(varsContextKey).(*vars); ok {
+		val, _ := v.get(key)
+		return val
+	}
+	return ""
+}
+
+// AddField adds a custom field for the request, such as a cache result or the resolved user ID,
+// so it can be logged with the %{key}n directive, like an Apache note. Fields can be added
+// at any time before the handler returns, even after the response is written.
+// It does nothing if the request was not passed through the access log middleware.
+func AddField(r *http.Request, key, value string) {
+	if v, ok := r.Context().Value(varsContextKey).(*vars); ok {
+		v.setField(key, value)
+	}
+}
+
+// Field returns the value of the field added with AddField, or an empty string if it is not set.
+func Field(ctx context.Context, key string) string {
+	if v, ok := ctx.Value(varsContextKey).(*vars); ok {
+		val, _ := v.field(key)
+		return val
+	}
+	return ""
+}
+
+// Suppress leaves the request out of the log, like Apache's env=!dontlog, e.g. for internal
+// calls marked by an authentication middleware. It overrides an earlier ForceLog.
+// It does nothing if the request was not passed through the access log middleware.
+func Suppress(r *http.Request) {
+	setMode(r, logSuppressed)
+}
+
+// Unsuppress undoes Suppress and ForceLog, the request is logged as usual.
+func Unsuppress(r *http.Request) {
+	setMode(r, logDefault)
+}
+
+// ForceLog logs the request regardless of sampling and WithCondition.
+// It overrides an earlier Suppress.
+func ForceLog(r *http.Request) {
+	setMode(r, logForced)
+}
+
+func setMode(r *http.Request, m logMode) {
+	if v, ok := r.Context().Value(varsContextKey).(*vars); ok {
+		v.setMode(m)
+	}
+}
+
+// RequestID returns the unique ID of the request logged by the %L directive,
+// or an empty string if the request was not passed through the access log middleware.
+func RequestID(ctx context.Context) string {
+	if v, ok := ctx.Value(varsContextKey).(*vars); ok {
+		return v.requestID()
+	}
+	return ""
+}
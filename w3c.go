@@ -0,0 +1,94 @@
+package accesslog
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+)
+
+// w3cFields are the directives of the W3C Extended Log File Format fields
+var w3cFields = map[string]string{
+	"date":           "%{%Y-%m-%d}t",
+	"time":           "%{%H:%M:%S}t",
+	"c-ip":           "%a",
+	"c-port":         "%{remote}p",
+	"s-ip":           "%A",
+	"s-port":         "%{local}p",
+	"s-sitename":     "%v",
+	"s-computername": "%v",
+	"cs-host":        "%V",
+	"cs-method":      "%m",
+	"cs-uri":         "%U%q",
+	"cs-uri-stem":    "%U",
+	"cs-version":     "%H",
+	"cs-username":    "%u",
+	"sc-status":      "%>s",
+	"sc-bytes":       "%O",
+	"cs-bytes":       "%I",
+	"time-taken":     "%{ms}T",
+	"x-request-id":   "%L",
+}
+
+// W3CFormat returns the W3C Extended Log File Format with the given fields, e.g.
+// "date", "time", "c-ip", "cs-method", "cs-uri-stem", "sc-status" and "time-taken" (in milliseconds).
+// Headers are logged with the cs(Header) and sc(Header) fields, e.g. cs(User-Agent).
+// The #Version, #Date and #Fields directives are written before the first line and at the start
+// of the new files of WithFile and WithFilePattern, once they are rotated or reopened,
+// unavailable and unknown fields are logged as "-", spaces in values as "+" and times in UTC.
+func W3CFormat(fields ...string) func(...optFunc) func(http.Handler) http.Handler {
+	return func(opts ...optFunc) func(http.Handler) http.Handler {
+		options := buildOpt(append(opts, WithUTC())...)
+		options.Preamble = func() string {
+			return "#Version: 1.0\n#Date: " + options.now().UTC().Format("2006-01-02 15:04:05") +
+				"\n#Fields: " + strings.Join(fields, " ") + "\n"
+		}
+
+		renders := make([]func(buf *bytes.Buffer, ln *line), len(fields))
+		for i, name := range fields {
+			renders[i] = w3cField(options, name)
+		}
+
+		return middleware(options, func(w *responseWriter, r *http.Request) string {
+			ln := newLine(options, w, r)
+			defer ln.release()
+
+			buf, val := getBuffer(), getBuffer()
+			defer putBuffer(buf)
+			defer putBuffer(val)
+			for i, render := range renders {
+				if i > 0 {
+					buf.WriteByte(' ')
+				}
+				val.Reset()
+				render(val, ln)
+				switch v := val.String(); v {
+				case "":
+					buf.WriteString("-")
+				default:
+					buf.WriteString(strings.ReplaceAll(v, " ", "+"))
+				}
+			}
+			return buf.String()
+		})
+	}
+}
+
+// w3cField returns the function rendering the W3C field name
+func w3cField(o *opt, name string) func(buf *bytes.Buffer, ln *line) {
+	format, ok := w3cFields[name]
+	switch {
+	case ok:
+	case name == "cs-uri-query":
+		return func(buf *bytes.Buffer, ln *line) {
+			buf.WriteString(o.Sanitize(ln.rawQuery()))
+		}
+	case strings.HasPrefix(name, "cs(") && strings.HasSuffix(name, ")"):
+		format = "%{" + name[3:len(name)-1] + "}i"
+	case strings.HasPrefix(name, "sc(") && strings.HasSuffix(name, ")"):
+		format = "%{" + name[3:len(name)-1] + "}o"
+	default:
+		format = "-"
+	}
+	tokens, _ := parseFormat(format, nil)
+	return compile(o, tokens)
+}
@@ -0,0 +1,34 @@
+package accesslog
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestW3CFormat(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing?q=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11)")
+
+	buf := new(bytes.Buffer)
+	date := time.Date(2013, time.February, 3, 19, 54, 0, 0, time.FixedZone("EST", -5*3600))
+	w3c := W3CFormat("date", "time", "c-ip", "cs-method", "cs-uri-stem", "cs-uri-query", "sc-status",
+		"cs(User-Agent)", "cs(Referer)", "s-unknown")
+	handler := w3c(WithOutput(buf), WithTime(date), WithLocation(date.Location()))(http.HandlerFunc(HandlerTesting))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	line := "2013-02-04 00:54:00 10.0.0.1 GET /testing q=1 200 Mozilla/5.0+(X11) - -\n"
+	want := "#Version: 1.0\n#Date: 2013-02-04 00:54:00\n" +
+		"#Fields: date time c-ip cs-method cs-uri-stem cs-uri-query sc-status cs(User-Agent) cs(Referer) s-unknown\n" +
+		line + line
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+}
@@ -0,0 +1,356 @@
+package accesslog
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestResponseWriterFlush(t *testing.T) {
+	received := make(chan struct{})
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%>s %b", WithOutput(buf))
+	ts := httptest.NewServer(aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, ok := w.(http.Flusher)
+		if !ok {
+			t.Error("response writer is not a http.Flusher")
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 1; i <= 2; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			f.Flush()
+			<-received // the client must see the event before the handler returns
+		}
+	})))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	sc := bufio.NewScanner(res.Body)
+	for i := 1; i <= 2; i++ {
+		if !sc.Scan() {
+			t.Fatalf("missing event %d: %v", i, sc.Err())
+		}
+		if want := fmt.Sprintf("data: %d", i); sc.Text() != want {
+			t.Errorf("wrong event: got %v expect %v", sc.Text(), want)
+		}
+		sc.Scan() // blank line ending the event
+		received <- struct{}{}
+	}
+}
+
+func TestResponseWriterFlushLatchesStatus(t *testing.T) {
+	req, err := http.NewRequest("GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%s %>s", WithOutput(buf))
+	handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	want := "200 500\n"
+	if buf.String() != want {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+	}
+}
+
+func TestResponseWriterHijack(t *testing.T) {
+	upgrade := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\nhello"
+	tests := []struct {
+		opts []optFunc
+		want string
+	}{
+		{nil, "101 - -\n"},
+		{[]optFunc{WithHijackByteCounting()}, fmt.Sprintf("101 %d -\n", len(upgrade))},
+	}
+
+	for _, tt := range tests {
+		done := make(chan struct{})
+		buf := new(bytes.Buffer)
+		aLog := FormatWith("%>s %b %X", append(tt.opts, WithOutput(buf))...)
+		handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hj, ok := w.(http.Hijacker)
+			if !ok {
+				t.Error("response writer is not a http.Hijacker")
+				return
+			}
+			conn, brw, err := hj.Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			brw.WriteString(upgrade)
+			brw.Flush()
+		}))
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handler.ServeHTTP(w, r)
+			close(done)
+		}))
+
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		got, _ := io.ReadAll(conn)
+		conn.Close()
+		<-done
+		ts.Close()
+
+		if string(got) != upgrade {
+			t.Errorf("wrong response: got %q expect %q", got, upgrade)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("wrong log line: got %q expect %q", buf.String(), tt.want)
+		}
+	}
+}
+
+// pushRecorder is a http.ResponseWriter supporting HTTP/2 server push
+type pushRecorder struct {
+	*httptest.ResponseRecorder
+	pushed []string
+}
+
+func (p *pushRecorder) Push(target string, opts *http.PushOptions) error {
+	p.pushed = append(p.pushed, target)
+	return nil
+}
+
+func TestResponseWriterPush(t *testing.T) {
+	tests := []struct {
+		w    http.ResponseWriter
+		err  error
+		want string
+	}{
+		{&pushRecorder{ResponseRecorder: httptest.NewRecorder()}, nil, "/style.css,/app.js\n"},
+		{httptest.NewRecorder(), http.ErrNotSupported, "-\n"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		aLog := FormatWith("%{push}x", WithOutput(buf))
+		handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := w.(http.Pusher)
+			if !ok {
+				t.Fatal("response writer is not a http.Pusher")
+			}
+			for _, target := range []string{"/style.css", "/app.js"} {
+				if err := p.Push(target, nil); err != tt.err {
+					t.Errorf("wrong push error: got %v expect %v", err, tt.err)
+				}
+			}
+			HandlerTesting(w, r)
+		}))
+		handler.ServeHTTP(tt.w, req)
+
+		if buf.String() != tt.want {
+			t.Errorf("wrong log line: got %v expect %v", buf.String(), tt.want)
+		}
+	}
+}
+
+func TestResponseWriterReadFrom(t *testing.T) {
+	content := bytes.Repeat([]byte("accesslog"), 1<<10)
+	tests := []struct {
+		w http.ResponseWriter
+	}{
+		{httptest.NewRecorder()},
+		{struct{ http.ResponseWriter }{httptest.NewRecorder()}}, // no io.ReaderFrom
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		aLog := FormatWith("%>s %b", WithOutput(buf))
+		handler := aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := w.(io.ReaderFrom); !ok {
+				t.Fatal("response writer is not a io.ReaderFrom")
+			}
+			io.Copy(w, bytes.NewReader(content))
+		}))
+		handler.ServeHTTP(tt.w, req)
+
+		want := fmt.Sprintf("200 %d\n", len(content))
+		if buf.String() != want {
+			t.Errorf("wrong log line: got %v expect %v", buf.String(), want)
+		}
+	}
+}
+
+func TestResponseWriterContentLengthFallback(t *testing.T) {
+	// bypass writes the body to the underlying ResponseWriter, as some wrappers do
+	bypass := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "11")
+		w.WriteHeader(http.StatusOK)
+		if u, ok := w.(interface{ Unwrap() http.ResponseWriter }); ok {
+			io.WriteString(u.Unwrap(), "hello world")
+		}
+	}
+	tests := []struct {
+		name   string
+		method string
+		opts   []optFunc
+		want   string
+		header bool
+	}{
+		{"default", "GET", nil, "- 0\n", false},
+		{"fallback", "GET", []optFunc{WithContentLengthFallback()}, "11 11\n", true},
+		{"head", "HEAD", []optFunc{WithContentLengthFallback()}, "- 0\n", false},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, "/testing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		buf := new(bytes.Buffer)
+		var entry LogEntry
+		opts := append([]optFunc{WithOutput(buf), WithEntryHandler(func(e LogEntry) { entry = e })}, tt.opts...)
+		handler := FormatWith("%b %B", opts...)(http.HandlerFunc(bypass))
+		handler.ServeHTTP(rr, req)
+
+		if buf.String() != tt.want {
+			t.Errorf("%s: wrong log line: got %v expect %v", tt.name, buf.String(), tt.want)
+		}
+		if entry.BytesFromHeader != tt.header {
+			t.Errorf("%s: wrong bytes source: got %v expect %v", tt.name, entry.BytesFromHeader, tt.header)
+		}
+	}
+
+	// bytes written through the middleware are never replaced by the header
+	req, err := http.NewRequest("GET", "/testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	handler := FormatWith("%b", WithOutput(buf), WithContentLengthFallback())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		io.WriteString(w, "short")
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if buf.String() != "5\n" {
+		t.Errorf("wrong log line: got %v expect %v", buf.String(), "5\n")
+	}
+}
+
+func BenchmarkServeFile(b *testing.B) {
+	b.ReportAllocs()
+
+	f, err := os.CreateTemp(b.TempDir(), "accesslog")
+	if err != nil {
+		b.Fatal(err)
+	}
+	f.Write(bytes.Repeat([]byte("accesslog"), 1<<19)) // ~4.5MB
+	f.Close()
+
+	aLog := FormatWith(ApacheCommonLogFormat, WithOutput(io.Discard))
+	ts := httptest.NewServer(aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, f.Name())
+	})))
+	defer ts.Close()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		res, err := http.Get(ts.URL)
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}
+}
+
+func TestResponseWriterResponseController(t *testing.T) {
+	buf := new(bytes.Buffer)
+	aLog := FormatWith("%>s", WithOutput(buf))
+	ts := httptest.NewServer(aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		if err := rc.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Errorf("set write deadline: %v", err)
+		}
+		if err := rc.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Errorf("set read deadline: %v", err)
+		}
+		io.WriteString(w, "streamed")
+		if err := rc.Flush(); err != nil {
+			t.Errorf("flush: %v", err)
+		}
+	})))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+
+	if string(body) != "streamed" {
+		t.Errorf("wrong body: got %v expect %v", string(body), "streamed")
+	}
+}
+
+func TestResponseWriterClientAbort(t *testing.T) {
+	buf := new(syncBuffer)
+	var entry LogEntry
+	done := make(chan struct{})
+	aLog := FormatWith("%>s %X", WithOutput(buf), WithEntryHandler(func(e LogEntry) { entry = e }))
+	srv := httptest.NewServer(aLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		chunk := bytes.Repeat([]byte("x"), 4096)
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	})))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resp.Body.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	<-done
+	srv.Close()
+
+	if want := "200 X\n"; buf.String() != want {
+		t.Errorf("wrong log line: got %q expect %q", buf.String(), want)
+	}
+	if !entry.Aborted {
+		t.Error("aborted request not marked in the log entry")
+	}
+}